@@ -1,24 +1,94 @@
 package main
 
 import (
+	"context"
 	"cse224/proj4/pkg/surfstore"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 )
 
 // Arguments
 const ARG_COUNT int = 3
 
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d host:port baseDir blockSize"
+const USAGE_STRING = "./run-client.sh -d [-push-only | -pull-only] [-full-rescan] [-cache-dir dir [-cache-size bytes]] [-upload-limit bytes/sec] [-download-limit bytes/sec] [-timeout duration] [-op-timeouts rpc=duration,...] [-retries n [-retry-backoff duration] [-retry-max-backoff duration] [-retry-jitter fraction] [-retry-codes code,...]] [-max-recv-msg-size bytes] [-max-send-msg-size bytes] [-chunk-size bytes] [-index backend] [-trace-file file] [-dryrun [-json]] [-report] host:port baseDir blockSize"
 
 const DEBUG_NAME = "d"
 const DEBUG_USAGE = "Output log statements"
 
+const DRYRUN_NAME = "dryrun"
+const DRYRUN_USAGE = "Print the sync plan without changing local files, the local index or the server"
+
+const PUSH_ONLY_NAME = "push-only"
+const PUSH_ONLY_USAGE = "Only upload local changes, overwriting concurrent remote changes; the local tree is never modified"
+
+const PULL_ONLY_NAME = "pull-only"
+const PULL_ONLY_USAGE = "Only apply remote changes; local changes are never uploaded and are reverted to the server state"
+
+const FULL_RESCAN_NAME = "full-rescan"
+const FULL_RESCAN_USAGE = "Rehash every file instead of trusting the cached size, mtime and inode"
+
+const CACHE_DIR_NAME = "cache-dir"
+const CACHE_DIR_USAGE = "Directory of a local block cache, which can be shared by several clients"
+
+const CACHE_SIZE_NAME = "cache-size"
+const CACHE_SIZE_USAGE = "Maximum size of the local block cache in bytes"
+
+const UPLOAD_LIMIT_NAME = "upload-limit"
+const UPLOAD_LIMIT_USAGE = "Maximum upload rate of blocks in bytes/sec (0 = unlimited)"
+
+const DOWNLOAD_LIMIT_NAME = "download-limit"
+const DOWNLOAD_LIMIT_USAGE = "Maximum download rate of blocks in bytes/sec (0 = unlimited)"
+
+const TIMEOUT_NAME = "timeout"
+const TIMEOUT_USAGE = "Deadline of each attempt of an RPC"
+
+const OP_TIMEOUTS_NAME = "op-timeouts"
+const OP_TIMEOUTS_USAGE = "Deadlines of specific RPCs overriding -timeout, e.g. GetBlock=30s,PutBlock=30s"
+
+const RETRIES_NAME = "retries"
+const RETRIES_USAGE = "Maximum number of attempts of an RPC failing with a retryable status code"
+
+const RETRY_BACKOFF_NAME = "retry-backoff"
+const RETRY_BACKOFF_USAGE = "Wait before the first retry, doubled after each attempt"
+
+const RETRY_MAX_BACKOFF_NAME = "retry-max-backoff"
+const RETRY_MAX_BACKOFF_USAGE = "Maximum wait between two attempts"
+
+const RETRY_JITTER_NAME = "retry-jitter"
+const RETRY_JITTER_USAGE = "Fraction by which each wait is randomly shortened or lengthened"
+
+const RETRY_CODES_NAME = "retry-codes"
+const RETRY_CODES_USAGE = "Comma separated gRPC status codes which are retried"
+
+const MAX_RECV_MSG_SIZE_NAME = "max-recv-msg-size"
+const MAX_RECV_MSG_SIZE_USAGE = "Maximum size in bytes of a message the client receives (0 = gRPC default of 4 MiB)"
+
+const MAX_SEND_MSG_SIZE_NAME = "max-send-msg-size"
+const MAX_SEND_MSG_SIZE_USAGE = "Maximum size in bytes of a message the client sends (0 = unlimited)"
+
+const CHUNK_SIZE_NAME = "chunk-size"
+const CHUNK_SIZE_USAGE = "Blocks larger than this many bytes are transferred in chunks of this size"
+
+const INDEX_NAME = "index"
+const INDEX_USAGE = "Backend of the local index of a new base directory: sqlite or log (default sqlite if built with cgo); existing indexes keep theirs, see SurfstoreMigrateIndex"
+
+const TRACE_FILE_NAME = "trace-file"
+const TRACE_FILE_USAGE = "Append a trace of the sync and of its RPCs to this file, as OTLP/JSON lines"
+
+const JSON_NAME = "json"
+const JSON_USAGE = "Print the dry-run sync plan as JSON"
+
+const REPORT_NAME = "report"
+const REPORT_USAGE = "Print a JSON report of the sync: files uploaded, downloaded and deleted, conflicts, bytes transferred and errors"
+
 const ADDR_NAME = "host:port"
 const ADDR_USAGE = "IP address and port of the MetaStore the client is syncing to"
 
@@ -28,28 +98,79 @@ const BASEDIR_USAGE = "Base directory of the client"
 const BLOCK_NAME = "blockSize"
 const BLOCK_USAGE = "Size of the blocks used to fragment files"
 
+// 1 GiB
+const DEFAULT_CACHE_SIZE int64 = 1 << 30
+
 // Exit codes
 const EX_USAGE int = 64
 
+// Some part of the sync failed, a later sync retries it
+const EX_TEMPFAIL int = 75
+
 func main() {
 	// Custom flag Usage message
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PUSH_ONLY_NAME, PUSH_ONLY_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PULL_ONLY_NAME, PULL_ONLY_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", FULL_RESCAN_NAME, FULL_RESCAN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CACHE_DIR_NAME, CACHE_DIR_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CACHE_SIZE_NAME, CACHE_SIZE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", UPLOAD_LIMIT_NAME, UPLOAD_LIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DOWNLOAD_LIMIT_NAME, DOWNLOAD_LIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TIMEOUT_NAME, TIMEOUT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", OP_TIMEOUTS_NAME, OP_TIMEOUTS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RETRIES_NAME, RETRIES_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RETRY_BACKOFF_NAME, RETRY_BACKOFF_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RETRY_MAX_BACKOFF_NAME, RETRY_MAX_BACKOFF_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RETRY_JITTER_NAME, RETRY_JITTER_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RETRY_CODES_NAME, RETRY_CODES_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", MAX_RECV_MSG_SIZE_NAME, MAX_RECV_MSG_SIZE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", MAX_SEND_MSG_SIZE_NAME, MAX_SEND_MSG_SIZE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CHUNK_SIZE_NAME, CHUNK_SIZE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", INDEX_NAME, INDEX_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TRACE_FILE_NAME, TRACE_FILE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DRYRUN_NAME, DRYRUN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", JSON_NAME, JSON_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", REPORT_NAME, REPORT_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
 	}
 
 	// Parse command-line arguments and flags
-	debug := flag.Bool("d", false, DEBUG_USAGE)
+	debug := flag.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	pushOnly := flag.Bool(PUSH_ONLY_NAME, false, PUSH_ONLY_USAGE)
+	pullOnly := flag.Bool(PULL_ONLY_NAME, false, PULL_ONLY_USAGE)
+	fullRescan := flag.Bool(FULL_RESCAN_NAME, false, FULL_RESCAN_USAGE)
+	cacheDir := flag.String(CACHE_DIR_NAME, "", CACHE_DIR_USAGE)
+	cacheSize := flag.Int64(CACHE_SIZE_NAME, DEFAULT_CACHE_SIZE, CACHE_SIZE_USAGE)
+	uploadLimit := flag.Int64(UPLOAD_LIMIT_NAME, 0, UPLOAD_LIMIT_USAGE)
+	downloadLimit := flag.Int64(DOWNLOAD_LIMIT_NAME, 0, DOWNLOAD_LIMIT_USAGE)
+	defaultRetryPolicy := surfstore.DefaultRetryPolicy()
+	timeout := flag.Duration(TIMEOUT_NAME, surfstore.DEFAULT_RPC_TIMEOUT, TIMEOUT_USAGE)
+	opTimeouts := flag.String(OP_TIMEOUTS_NAME, "", OP_TIMEOUTS_USAGE)
+	retries := flag.Int(RETRIES_NAME, defaultRetryPolicy.MaxAttempts, RETRIES_USAGE)
+	retryBackoff := flag.Duration(RETRY_BACKOFF_NAME, defaultRetryPolicy.InitialBackoff, RETRY_BACKOFF_USAGE)
+	retryMaxBackoff := flag.Duration(RETRY_MAX_BACKOFF_NAME, defaultRetryPolicy.MaxBackoff, RETRY_MAX_BACKOFF_USAGE)
+	retryJitter := flag.Float64(RETRY_JITTER_NAME, defaultRetryPolicy.Jitter, RETRY_JITTER_USAGE)
+	retryCodes := flag.String(RETRY_CODES_NAME, surfstore.FormatRetryCodes(defaultRetryPolicy.RetryableCodes), RETRY_CODES_USAGE)
+	maxRecvMsgSize := flag.Int(MAX_RECV_MSG_SIZE_NAME, 0, MAX_RECV_MSG_SIZE_USAGE)
+	maxSendMsgSize := flag.Int(MAX_SEND_MSG_SIZE_NAME, 0, MAX_SEND_MSG_SIZE_USAGE)
+	chunkSize := flag.Int(CHUNK_SIZE_NAME, surfstore.BLOCK_CHUNK_SIZE, CHUNK_SIZE_USAGE)
+	indexBackend := flag.String(INDEX_NAME, "", INDEX_USAGE)
+	traceFile := flag.String(TRACE_FILE_NAME, "", TRACE_FILE_USAGE)
+	dryRun := flag.Bool(DRYRUN_NAME, false, DRYRUN_USAGE)
+	jsonPlan := flag.Bool(JSON_NAME, false, JSON_USAGE)
+	report := flag.Bool(REPORT_NAME, false, REPORT_USAGE)
 	flag.Parse()
 
 	// Use tail arguments to hold non-flag arguments
 	args := flag.Args()
 
-	if len(args) != ARG_COUNT {
+	if len(args) != ARG_COUNT || (*pushOnly && *pullOnly) {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
@@ -68,6 +189,84 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	if *indexBackend != "" && !surfstore.IsLocalIndexBackend(*indexBackend) {
+		fmt.Fprintf(flag.CommandLine.Output(), "local index backend %q is not available, use one of %v\n",
+			*indexBackend, surfstore.LocalIndexBackends())
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
 	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	surfstore.ClientSync(rpcClient)
+	rpcClient.IndexBackend = *indexBackend
+	rpcClient.UploadLimiter = surfstore.NewRateLimiter(*uploadLimit)
+	rpcClient.DownloadLimiter = surfstore.NewRateLimiter(*downloadLimit)
+	rpcClient.Timeout = *timeout
+	rpcClient.OpTimeouts, err = surfstore.ParseOpTimeouts(*opTimeouts)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	rpcClient.RetryPolicy.MaxAttempts = *retries
+	rpcClient.RetryPolicy.InitialBackoff = *retryBackoff
+	rpcClient.RetryPolicy.MaxBackoff = *retryMaxBackoff
+	rpcClient.RetryPolicy.Jitter = *retryJitter
+	rpcClient.RetryPolicy.RetryableCodes, err = surfstore.ParseRetryCodes(*retryCodes)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	rpcClient.MaxRecvMsgSize = *maxRecvMsgSize
+	rpcClient.MaxSendMsgSize = *maxSendMsgSize
+	rpcClient.ChunkSize = *chunkSize
+	opts := surfstore.SyncOptions{DryRun: *dryRun, FullRescan: *fullRescan}
+	if *pushOnly {
+		opts.Mode = surfstore.SYNC_PUSH_ONLY
+	} else if *pullOnly {
+		opts.Mode = surfstore.SYNC_PULL_ONLY
+	}
+	if len(*cacheDir) > 0 {
+		opts.BlockCache, err = surfstore.NewBlockCache(*cacheDir, *cacheSize)
+		if err != nil {
+			log.Fatal("Error while opening block cache ", err)
+		}
+	}
+	var exporter *surfstore.FileSpanExporter
+	if len(*traceFile) > 0 {
+		exporter, err = surfstore.NewFileSpanExporter(*traceFile)
+		if err != nil {
+			log.Fatal("Error while opening trace file ", err)
+		}
+		rpcClient.Tracer = surfstore.NewTracer("surfstore-client", exporter)
+	}
+	// An interrupt cancels the sync, the files synced so far stay recorded in the local index
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	summary := surfstore.ClientSyncContext(ctx, rpcClient, opts)
+	stop()
+	rpcClient.Close()
+	if exporter != nil {
+		exporter.Close()
+	}
+	if *report {
+		out, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			log.Fatal("Error while encoding sync report ", err)
+		}
+		fmt.Println(string(out))
+	} else if *dryRun {
+		plan := summary.Plan
+		if *jsonPlan {
+			out, err := json.MarshalIndent(plan, "", "  ")
+			if err != nil {
+				log.Fatal("Error while encoding sync plan ", err)
+			}
+			fmt.Println(string(out))
+		} else {
+			fmt.Print(plan)
+		}
+	}
+	if summary.Failed() {
+		os.Exit(EX_TEMPFAIL)
+	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Arguments
+const ARG_COUNT int = 1
+
+// Usage strings
+const USAGE_STRING = "./run-health-probe.sh -d [-service meta|block] [-timeout duration] host:port"
+
+const DEBUG_NAME = "d"
+const DEBUG_USAGE = "Output log statements"
+
+const SERVICE_NAME = "service"
+const SERVICE_USAGE = "Service to check: meta or block (default: the server as a whole)"
+
+const TIMEOUT_NAME = "timeout"
+const TIMEOUT_USAGE = "Deadline of the health check"
+
+const ADDR_NAME = "host:port"
+const ADDR_USAGE = "IP address and port of the server to check"
+
+// Names of the services in health checks, by -service value
+var SERVICES map[string]string = map[string]string{
+	"":      "",
+	"meta":  surfstore.HEALTH_SERVICE_META,
+	"block": surfstore.HEALTH_SERVICE_BLOCK,
+}
+
+// Exit codes
+const EX_USAGE int = 64
+
+// The service is not serving, unknown to the server, or the server could not be reached
+const EX_UNAVAILABLE int = 69
+
+func main() {
+	// Custom flag Usage message
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", SERVICE_NAME, SERVICE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TIMEOUT_NAME, TIMEOUT_USAGE)
+		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
+	}
+
+	// Parse command-line arguments and flags
+	debug := flag.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	service := flag.String(SERVICE_NAME, "", SERVICE_USAGE)
+	timeout := flag.Duration(TIMEOUT_NAME, surfstore.DEFAULT_RPC_TIMEOUT, TIMEOUT_USAGE)
+	flag.Parse()
+
+	// Use tail arguments to hold non-flag arguments
+	args := flag.Args()
+
+	healthService, exists := SERVICES[*service]
+	if len(args) != ARG_COUNT || !exists {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	hostPort := args[0]
+
+	// Disable log outputs if debug flag is missing
+	if !(*debug) {
+		log.SetFlags(0)
+		log.SetOutput(ioutil.Discard)
+	}
+
+	client := surfstore.NewSurfstoreRPCClient(hostPort, "", 0)
+	client.Timeout = *timeout
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	status, err := client.CheckHealthContext(ctx, hostPort, healthService)
+	cancel()
+	client.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error while checking health of", hostPort+":", err)
+		os.Exit(EX_UNAVAILABLE)
+	}
+	fmt.Println(status)
+	if status != healthpb.HealthCheckResponse_SERVING {
+		os.Exit(EX_UNAVAILABLE)
+	}
+}
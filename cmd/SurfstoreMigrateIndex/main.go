@@ -0,0 +1,68 @@
+package main
+
+import (
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Arguments
+const ARG_COUNT int = 1
+
+// Usage strings
+const USAGE_STRING = "./run-migrate-index.sh -d -to backend baseDir"
+
+const DEBUG_NAME = "d"
+const DEBUG_USAGE = "Output log statements"
+
+const TO_NAME = "to"
+const TO_USAGE = "Backend to convert the local index to: sqlite or log"
+
+const BASEDIR_NAME = "baseDir"
+const BASEDIR_USAGE = "Base directory of the client"
+
+// Exit codes
+const EX_USAGE int = 64
+
+// The base directory has no local index, or it could not be read or converted
+const EX_NOINPUT int = 66
+
+func main() {
+	// Custom flag Usage message
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v (available: %v)\n", TO_NAME, TO_USAGE, surfstore.LocalIndexBackends())
+		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
+	}
+
+	// Parse command-line arguments and flags
+	debug := flag.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	to := flag.String(TO_NAME, "", TO_USAGE)
+	flag.Parse()
+
+	// Use tail arguments to hold non-flag arguments
+	args := flag.Args()
+
+	if len(args) != ARG_COUNT || !surfstore.IsLocalIndexBackend(*to) {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	baseDir := args[0]
+
+	// Disable log outputs if debug flag is missing
+	if !(*debug) {
+		log.SetFlags(0)
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if err := surfstore.MigrateLocalIndex(baseDir, *to); err != nil {
+		fmt.Fprintln(os.Stderr, "Error while migrating local index:", err)
+		os.Exit(EX_NOINPUT)
+	}
+	log.Println("Local index of", baseDir, "migrated to", *to)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"cse224/proj4/pkg/surfstore"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// Arguments
+const MIN_ARG_COUNT int = 2
+
+// Usage strings
+const USAGE_STRING = "./run-remote.sh -d [-b blockSize] host:port command [args]"
+
+const DEBUG_NAME = "d"
+const DEBUG_USAGE = "Output log statements"
+
+const BLOCK_NAME = "b"
+const BLOCK_USAGE = "Size of the blocks used to fragment uploaded files"
+
+const ADDR_NAME = "host:port"
+const ADDR_USAGE = "IP address and port of the MetaStore"
+
+const COMMAND_NAME = "command"
+const COMMAND_USAGE = "One of: ls, stat <remote>, cat <remote>, get <remote> <local>, put <local> <remote>, rm <remote>"
+
+const DEFAULT_BLOCK_SIZE int = 4096
+
+// Commands and their number of arguments
+var COMMAND_ARGS map[string]int = map[string]int{
+	"ls":   0,
+	"stat": 1,
+	"cat":  1,
+	"get":  2,
+	"put":  2,
+	"rm":   1,
+}
+
+// Exit codes
+const EX_USAGE int = 64
+const EX_NOINPUT int = 66
+const EX_UNAVAILABLE int = 69
+
+func main() {
+	// Custom flag Usage message
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", BLOCK_NAME, BLOCK_USAGE)
+		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
+		fmt.Fprintf(w, "  %s: %v\n", COMMAND_NAME, COMMAND_USAGE)
+	}
+
+	// Parse command-line arguments and flags
+	debug := flag.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	blockSize := flag.Int(BLOCK_NAME, DEFAULT_BLOCK_SIZE, BLOCK_USAGE)
+	flag.Parse()
+
+	// Use tail arguments to hold non-flag arguments
+	args := flag.Args()
+
+	if len(args) < MIN_ARG_COUNT || *blockSize <= 0 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	hostPort := args[0]
+	command := args[1]
+	commandArgs := args[2:]
+	argCount, exists := COMMAND_ARGS[command]
+	if !exists || len(commandArgs) != argCount {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	// Disable log outputs if debug flag is missing
+	if !(*debug) {
+		log.SetFlags(0)
+		log.SetOutput(ioutil.Discard)
+	}
+
+	// No base directory, nothing is read from or written to a local index
+	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, "", *blockSize)
+	err := runCommand(rpcClient, command, commandArgs)
+	rpcClient.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		if err == surfstore.ErrRemoteFileNotFound {
+			os.Exit(EX_NOINPUT)
+		}
+		if errors.Is(err, surfstore.ErrInvalidFileName) {
+			os.Exit(EX_USAGE)
+		}
+		os.Exit(EX_UNAVAILABLE)
+	}
+}
+
+func runCommand(client surfstore.RPCClient, command string, args []string) error {
+	switch command {
+	case "ls":
+		files, err := surfstore.ListRemoteFiles(client)
+		if err != nil {
+			return err
+		}
+		for _, fileMetaData := range files {
+			fmt.Println(fileMetaData.Filename)
+		}
+	case "stat":
+		fileMetaData, err := surfstore.GetRemoteFileMeta(client, args[0])
+		if err != nil {
+			return err
+		}
+		printFileMetaData(fileMetaData)
+	case "cat":
+		fileMetaData, err := surfstore.GetRemoteFileMeta(client, args[0])
+		if err != nil {
+			return err
+		}
+		_, err = surfstore.ReadRemoteFile(client, fileMetaData, os.Stdout)
+		return err
+	case "get":
+		return surfstore.DownloadRemoteFile(client, args[0], args[1])
+	case "put":
+		version, err := surfstore.UploadLocalFile(client, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		log.Println("Uploaded", args[1], "version", version)
+	case "rm":
+		if err := surfstore.ValidateFileName(args[0]); err != nil {
+			return err
+		}
+		fileMetaData, err := surfstore.GetRemoteFileMeta(client, args[0])
+		if err != nil {
+			return err
+		}
+		if surfstore.IsRemoteFileDeleted(fileMetaData) {
+			return surfstore.ErrRemoteFileNotFound
+		}
+		_, err = surfstore.DeleteRemoteFile(client, args[0], surfstore.NextRemoteVersion(fileMetaData))
+		return err
+	}
+	return nil
+}
+
+func printFileMetaData(fileMetaData *surfstore.FileMetaData) {
+	fmt.Printf("name: %s\n", fileMetaData.Filename)
+	fmt.Printf("version: %d\n", fileMetaData.Version)
+	if surfstore.IsRemoteFileDeleted(fileMetaData) {
+		fmt.Println("deleted: true")
+		return
+	}
+	if fileMetaData.FileType == surfstore.FileType_SYMLINK {
+		fmt.Printf("type: symlink\n")
+		fmt.Printf("target: %s\n", fileMetaData.SymlinkTarget)
+	} else {
+		fmt.Printf("type: regular\n")
+		fmt.Printf("size: %d\n", fileMetaData.Size)
+	}
+	if fileMetaData.Mode != 0 {
+		fmt.Printf("mode: %v\n", os.FileMode(fileMetaData.Mode).Perm())
+	}
+	if fileMetaData.Mtime != 0 {
+		fmt.Printf("mtime: %s\n", time.Unix(0, fileMetaData.Mtime).Format(time.RFC3339Nano))
+	}
+	hashList := fileMetaData.BlockHashList
+	if len(hashList) == 1 && hashList[0] == surfstore.EMPTYFILE_HASHVALUE {
+		// Empty files and symlinks have no blocks
+		hashList = []string{}
+	}
+	fmt.Printf("blocks: %d\n", len(hashList))
+	for _, blockHash := range hashList {
+		fmt.Printf("  %s\n", blockHash)
+	}
+}
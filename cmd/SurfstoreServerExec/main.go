@@ -8,13 +8,17 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockStoreAddr*)"
+const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d [-http <host:port>] [-webdav <host:port>] [-http-block-size <size>] [-max-recv-msg-size <bytes>] [-max-send-msg-size <bytes>] [-hash <algorithm>] [-history <versions>] [-metrics <host:port>] [-trace-file <file>] [-drain <duration>] (blockStoreAddr*)"
 
 const (
 	BOTH  = "both"
@@ -26,9 +30,15 @@ const (
 // Set of valid services
 var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
 
+// Block size used by the HTTP gateway to split uploaded files
+const DEFAULT_HTTP_BLOCK_SIZE int = 4096
+
 // Exit codes
 const EX_USAGE int = 64
 
+// The server failed to start or stopped with an error
+const EX_UNAVAILABLE int = 69
+
 func main() {
 	// Custom flag Usage message
 	flag.Usage = func() {
@@ -45,6 +55,16 @@ func main() {
 	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
 	localOnly := flag.Bool("l", false, "Only listen on localhost")
 	debug := flag.Bool("d", false, "Output log statements")
+	httpAddr := flag.String("http", "", "Address (host:port) of an HTTP/JSON gateway to serve, requires the meta service")
+	webdavAddr := flag.String("webdav", "", "Address (host:port) of a WebDAV frontend to serve, requires the meta service")
+	httpBlockSize := flag.Int("http-block-size", DEFAULT_HTTP_BLOCK_SIZE, "Size of the blocks the HTTP gateway and the WebDAV frontend split uploaded files into")
+	maxRecvMsgSize := flag.Int("max-recv-msg-size", 0, "Maximum size in bytes of a message the server receives (0 = gRPC default of 4 MiB)")
+	maxSendMsgSize := flag.Int("max-send-msg-size", 0, "Maximum size in bytes of a message the server sends (0 = unlimited)")
+	hashAlgorithm := flag.String("hash", surfstore.DEFAULT_HASH_ALGORITHM, "Algorithm of the block hashes of the namespace: "+strings.Join(surfstore.SupportedHashAlgorithms(), ", ")+" (empty for untagged SHA-256 hashes)")
+	maxHistory := flag.Int("history", surfstore.DEFAULT_MAX_FILE_HISTORY, "Versions of each file the meta service keeps for the gateway's /history/")
+	metricsAddr := flag.String("metrics", "", "Address (host:port) of a Prometheus /metrics endpoint to serve")
+	traceFile := flag.String("trace-file", "", "Append a trace of every RPC the server handles to this file, as OTLP/JSON lines")
+	drain := flag.Duration("drain", 0, "On SIGTERM or SIGINT, report NOT_SERVING to health checks for this long before stopping")
 	flag.Parse()
 
 	// Use tail arguments to hold BlockStore address
@@ -55,10 +75,14 @@ func main() {
 	}
 
 	// Valid service type argument
-	if _, ok := SERVICE_TYPES[strings.ToLower(*service)]; !ok {
+	if _, ok := SERVICE_TYPES[strings.ToLower(*service)]; !ok || !surfstore.IsHashAlgorithm(*hashAlgorithm) {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
+	if err := checkFrontends(strings.ToLower(*service), *httpAddr, *webdavAddr); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(EX_USAGE)
+	}
 
 	// Add localhost if necessary
 	addr := ""
@@ -73,34 +97,158 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddrs))
+	err := startServer(addr, strings.ToLower(*service), blockStoreAddrs, *httpAddr, *webdavAddr, *httpBlockSize, *maxRecvMsgSize, *maxSendMsgSize, *hashAlgorithm, *maxHistory, *metricsAddr, *traceFile, *drain)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(EX_UNAVAILABLE)
+	}
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddrs []string) error {
+func startServer(hostAddr string, serviceType string, blockStoreAddrs []string, httpAddr string, webdavAddr string, httpBlockSize int, maxRecvMsgSize int, maxSendMsgSize int, hashAlgorithm string, maxHistory int, metricsAddr string, traceFile string, drain time.Duration) error {
 	_, exists := SERVICE_TYPES[serviceType]
 	// fmt.Println("hostAddr server", hostAddr)
 	if !exists {
-		log.Println("Service type %s not supported", serviceType)
-		return nil
+		return fmt.Errorf("service type %s not supported", serviceType)
+	}
+	if err := checkFrontends(serviceType, httpAddr, webdavAddr); err != nil {
+		return err
+	}
+	serverOptions := make([]grpc.ServerOption, 0)
+	if maxRecvMsgSize > 0 {
+		serverOptions = append(serverOptions, grpc.MaxRecvMsgSize(maxRecvMsgSize))
+	}
+	if maxSendMsgSize > 0 {
+		serverOptions = append(serverOptions, grpc.MaxSendMsgSize(maxSendMsgSize))
+	}
+	var tracer *surfstore.Tracer
+	if len(traceFile) > 0 {
+		exporter, err := surfstore.NewFileSpanExporter(traceFile)
+		if err != nil {
+			return err
+		}
+		defer exporter.Close()
+		tracer = surfstore.NewTracer("surfstore-"+serviceType, exporter)
+		serverOptions = append(serverOptions, grpc.ChainUnaryInterceptor(tracer.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(tracer.StreamServerInterceptor()))
+	}
+	var metrics *surfstore.Metrics
+	if len(metricsAddr) > 0 {
+		metrics = surfstore.NewMetrics()
+		serverOptions = append(serverOptions, grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(metrics.StreamServerInterceptor()))
+	}
+	grpcServer := grpc.NewServer(serverOptions...)
+
+	// Health checks report NOT_SERVING until the server is ready
+	healthServices := []string{}
+	if serviceType == BOTH || serviceType == META {
+		healthServices = append(healthServices, surfstore.HEALTH_SERVICE_META)
+	}
+	if serviceType == BOTH || serviceType == BLOCK {
+		healthServices = append(healthServices, surfstore.HEALTH_SERVICE_BLOCK)
 	}
-	grpcServer := grpc.NewServer()
+	healthServer := surfstore.NewHealthServer(healthServices...)
+	healthServer.Register(grpcServer)
 
+	var metaStore *surfstore.MetaStore
 	if serviceType == BOTH || serviceType == META {
-		surfstore.RegisterMetaStoreServer(grpcServer, surfstore.NewMetaStore(blockStoreAddrs))
+		metaStore = surfstore.NewMetaStore(blockStoreAddrs)
+		metaStore.HashAlgorithm = hashAlgorithm
+		metaStore.MaxHistory = maxHistory
+		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
+		if metrics != nil {
+			metrics.WatchMetaStore(metaStore)
+		}
 	}
 
 	if serviceType == BOTH || serviceType == BLOCK {
-		surfstore.RegisterBlockStoreServer(grpcServer, surfstore.NewBlockStore())
+		blockStore := surfstore.NewBlockStore()
+		// Chunked blocks obey the server's message limits
+		if maxRecvMsgSize > 0 {
+			blockStore.MaxBlockSize = surfstore.MAX_BLOCK_SIZE_FACTOR * maxRecvMsgSize
+		}
+		blockStore.ChunkSize = surfstore.ChunkSizeForMessageSize(maxSendMsgSize)
+		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		if metrics != nil {
+			metrics.WatchBlockStore(blockStore)
+		}
 	}
 
 	listener, err := net.Listen(TCP, hostAddr)
-	fmt.Println("Started listening")
 	if err != nil {
 		return err
 	}
+	// Also closed if a frontend fails to start before Serve
+	defer listener.Close()
+
+	// The gateway and the WebDAV frontend reach the MetaStore and the BlockStores through this
+	// server's gRPC address
+	client := surfstore.NewSurfstoreRPCClient(listener.Addr().String(), "", httpBlockSize)
+	// Messages between the frontends and the server obey the server's limits in both directions
+	client.MaxRecvMsgSize = maxSendMsgSize
+	client.MaxSendMsgSize = maxRecvMsgSize
+	// Requests of the frontends start the traces of the RPCs they make
+	client.Tracer = tracer
+	if len(httpAddr) > 0 {
+		if err := serveHTTP("HTTP gateway", httpAddr, surfstore.NewGateway(metaStore, client)); err != nil {
+			return err
+		}
+	}
+	if len(webdavAddr) > 0 {
+		if err := serveHTTP("WebDAV frontend", webdavAddr, surfstore.NewWebDAVHandler(client)); err != nil {
+			return err
+		}
+	}
+	if metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		if err := serveHTTP("Metrics endpoint", metricsAddr, mux); err != nil {
+			return err
+		}
+	}
+
+	// On SIGTERM or SIGINT, drain: fail health checks so that no new clients are routed here,
+	// then let the RPCs in flight finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		// A second signal stops the server at once
+		signal.Stop(signals)
+		log.Println("Received", sig, "draining for", drain)
+		healthServer.Drain()
+		time.Sleep(drain)
+		grpcServer.GracefulStop()
+	}()
+
+	healthServer.SetServing()
+	fmt.Println("Started listening")
 	err = grpcServer.Serve(listener)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// The HTTP gateway and the WebDAV frontend need the MetaStore of this server
+func checkFrontends(serviceType string, httpAddr string, webdavAddr string) error {
+	if (len(httpAddr) > 0 || len(webdavAddr) > 0) && serviceType == BLOCK {
+		return fmt.Errorf("the HTTP gateway and the WebDAV frontend require the meta service")
+	}
+	return nil
+}
+
+// Listens on addr and serves handler in the background
+func serveHTTP(name string, addr string, handler http.Handler) error {
+	listener, err := net.Listen(TCP, addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Println(name, "listening on", addr)
+		if err := http.Serve(listener, handler); err != nil {
+			log.Println(name, "stopped", err)
+		}
+	}()
+	return nil
+}
@@ -3,14 +3,16 @@ module cse224/proj4
 go 1.17
 
 require (
+	github.com/mattn/go-sqlite3 v1.14.16
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
 	google.golang.org/grpc v1.44.0
 	google.golang.org/protobuf v1.27.1
+	lukechampine.com/blake3 v1.1.7
 )
 
 require (
 	github.com/golang/protobuf v1.5.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.16 // indirect
-	golang.org/x/net v0.0.0-20200822124328-c89045814202 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.11 // indirect
 	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
 	golang.org/x/text v0.3.0 // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
@@ -1,14 +1,25 @@
 package surfstore
 
 import (
+	"bytes"
 	context "context"
-	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	"io"
 	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type BlockStore struct {
 	BlockMap map[string]*Block
-	rwMutex  sync.RWMutex
+	// Total size of the blocks in BlockMap
+	blockBytes int64
+	// Largest block PutBlockChunks accepts, 0 means DEFAULT_MAX_BLOCK_SIZE
+	MaxBlockSize int
+	// Largest chunk GetBlockChunks sends, 0 means BLOCK_CHUNK_SIZE
+	ChunkSize int
+	rwMutex   sync.RWMutex
 	UnimplementedBlockStoreServer
 }
 
@@ -23,15 +34,120 @@ func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Bloc
 
 func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
 	// Compute hash, and add the block to the map
-	hash := GetBlockHashString(block.BlockData)
+	hash, err := GetTaggedBlockHash(block.HashAlgorithm, block.BlockData)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	// Acquire write lock
 	bs.rwMutex.Lock()
+	if stored, exists := bs.BlockMap[hash]; exists {
+		bs.blockBytes -= int64(len(stored.BlockData))
+	}
 	bs.BlockMap[hash] = block
+	bs.blockBytes += int64(len(block.BlockData))
 	// Acquire write lock
 	bs.rwMutex.Unlock()
 	return &Success{Flag: true}, nil
 }
 
+// ChunkSizeForMessageSize returns the size of the chunks whose messages fit in maxMsgSize bytes,
+// BLOCK_CHUNK_SIZE at most or if maxMsgSize is 0
+func ChunkSizeForMessageSize(maxMsgSize int) int {
+	if maxMsgSize <= 0 || maxMsgSize-BLOCK_CHUNK_OVERHEAD > BLOCK_CHUNK_SIZE {
+		return BLOCK_CHUNK_SIZE
+	}
+	if maxMsgSize <= BLOCK_CHUNK_OVERHEAD {
+		return 1
+	}
+	return maxMsgSize - BLOCK_CHUNK_OVERHEAD
+}
+
+// Checks the size declared by the first chunk of a block against maxBlockSize, 0 meaning
+// DEFAULT_MAX_BLOCK_SIZE
+func checkChunkedBlockSize(blockSize int32, maxBlockSize int) error {
+	if maxBlockSize <= 0 {
+		maxBlockSize = DEFAULT_MAX_BLOCK_SIZE
+	}
+	if blockSize < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid block size %d", blockSize)
+	}
+	if int(blockSize) > maxBlockSize {
+		return status.Errorf(codes.ResourceExhausted, "block of %d bytes larger than the limit of %d bytes", blockSize, maxBlockSize)
+	}
+	return nil
+}
+
+// Sends the block in chunks of at most ChunkSize bytes
+func (bs *BlockStore) GetBlockChunks(blockHash *BlockHash, stream BlockStore_GetBlockChunksServer) error {
+	bs.rwMutex.RLock()
+	block := bs.BlockMap[blockHash.Hash]
+	bs.rwMutex.RUnlock()
+	if block == nil {
+		return status.Errorf(codes.NotFound, "block %s not found", blockHash.Hash)
+	}
+	maxChunkSize := bs.ChunkSize
+	if maxChunkSize <= 0 {
+		maxChunkSize = BLOCK_CHUNK_SIZE
+	}
+	blockData := block.BlockData
+	chunk := &BlockChunk{BlockSize: int32(len(blockData))}
+	for {
+		chunkSize := len(blockData)
+		if chunkSize > maxChunkSize {
+			chunkSize = maxChunkSize
+		}
+		chunk.ChunkData = blockData[:chunkSize]
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+		blockData = blockData[chunkSize:]
+		if len(blockData) == 0 {
+			return nil
+		}
+		chunk = &BlockChunk{}
+	}
+}
+
+// Reassembles a block from its chunks and stores it. The size declared by the first chunk is
+// checked against MaxBlockSize before anything is allocated, and the stream fails as soon as the
+// chunks go over it.
+func (bs *BlockStore) PutBlockChunks(stream BlockStore_PutBlockChunksServer) error {
+	var blockData bytes.Buffer
+	started := false
+	var blockSize int32
+	var hashAlgorithm string
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !started {
+			if err := checkChunkedBlockSize(chunk.BlockSize, bs.MaxBlockSize); err != nil {
+				return err
+			}
+			started = true
+			blockSize = chunk.BlockSize
+			hashAlgorithm = chunk.HashAlgorithm
+			blockData.Grow(int(blockSize))
+		}
+		if blockData.Len()+len(chunk.ChunkData) > int(blockSize) {
+			return status.Errorf(codes.InvalidArgument, "received more than the %d bytes of the block", blockSize)
+		}
+		blockData.Write(chunk.ChunkData)
+	}
+	if !started || int(blockSize) != blockData.Len() {
+		return status.Errorf(codes.InvalidArgument, "received %d bytes of a block of %d bytes", blockData.Len(), blockSize)
+	}
+	success, err := bs.PutBlock(stream.Context(), &Block{BlockData: blockData.Bytes(), BlockSize: blockSize, HashAlgorithm: hashAlgorithm})
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(success)
+}
+
 // Given a list of hashes “in”, returns a list containing the
 // subset of in that are stored in the key-value store
 func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
@@ -49,6 +165,13 @@ func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes)
 	return &BlockHashes{Hashes: outHashes}, nil
 }
 
+// Returns the number of blocks stored and their total size in bytes
+func (bs *BlockStore) Stats() (int, int64) {
+	bs.rwMutex.RLock()
+	defer bs.rwMutex.RUnlock()
+	return len(bs.BlockMap), bs.blockBytes
+}
+
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
 
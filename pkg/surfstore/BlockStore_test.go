@@ -0,0 +1,83 @@
+package surfstore_test
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Message limit of the servers and clients of the chunked transfer tests
+const TEST_MAX_MSG_SIZE int = 64 << 10
+
+// Blocks larger than the message limit go through PutBlockChunks and GetBlockChunks, in chunks
+// which fit the limits of the client and of the server
+func TestBlocksLargerThanMessageLimit(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1, grpc.MaxRecvMsgSize(TEST_MAX_MSG_SIZE), grpc.MaxSendMsgSize(TEST_MAX_MSG_SIZE))
+	defer cluster.Close()
+	cluster.BlockStore(cluster.BlockStoreAddrs[0]).ChunkSize = surfstore.ChunkSizeForMessageSize(TEST_MAX_MSG_SIZE)
+	newClient := func() surfstore.RPCClient {
+		client := cluster.NewClient(t.TempDir(), 4*TEST_MAX_MSG_SIZE)
+		t.Cleanup(func() { client.Close() })
+		client.MaxRecvMsgSize = TEST_MAX_MSG_SIZE
+		client.MaxSendMsgSize = TEST_MAX_MSG_SIZE
+		client.ChunkSize = surfstore.ChunkSizeForMessageSize(TEST_MAX_MSG_SIZE)
+		return client
+	}
+	alice, bob := newClient(), newClient()
+
+	content := testContent(1, 10*TEST_MAX_MSG_SIZE)
+	writeTestFile(t, alice, "large.bin", content)
+	syncClient(t, alice)
+	if blocks, _ := cluster.BlockStore(cluster.BlockStoreAddrs[0]).Stats(); blocks != 3 {
+		t.Fatalf("%d blocks stored, expected 3", blocks)
+	}
+	syncClient(t, bob)
+	checkTestFile(t, bob, "large.bin", content)
+}
+
+func TestPutBlockChunksRejectsMalformedStreams(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	blockStore := cluster.BlockStore(cluster.BlockStoreAddrs[0])
+	blockStore.MaxBlockSize = 1 << 20
+	client := newTestClient(t, cluster)
+	conn, err := grpc.Dial(cluster.BlockStoreAddrs[0], append(client.DialOptions, grpc.WithInsecure())...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, test := range []struct {
+		name     string
+		chunks   []*surfstore.BlockChunk
+		expected codes.Code
+	}{
+		{"negative size", []*surfstore.BlockChunk{{BlockSize: -5, ChunkData: []byte("abc")}}, codes.InvalidArgument},
+		{"size over the limit", []*surfstore.BlockChunk{{BlockSize: 1 << 30, ChunkData: []byte("abc")}}, codes.ResourceExhausted},
+		{"more data than declared", []*surfstore.BlockChunk{{BlockSize: 4, ChunkData: []byte("abc")}, {ChunkData: []byte("def")}}, codes.InvalidArgument},
+		{"less data than declared", []*surfstore.BlockChunk{{BlockSize: 4, ChunkData: []byte("abc")}}, codes.InvalidArgument},
+		{"no chunk", nil, codes.InvalidArgument},
+	} {
+		stream, err := surfstore.NewBlockStoreClient(conn).PutBlockChunks(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chunk := range test.chunks {
+			chunk.HashAlgorithm = surfstore.HASH_ALGORITHM_SHA256
+			if err := stream.Send(chunk); err != nil {
+				break
+			}
+		}
+		if _, err := stream.CloseAndRecv(); status.Code(err) != test.expected {
+			t.Errorf("%s: returned %v, expected %v", test.name, err, test.expected)
+		}
+	}
+	if blocks, _ := blockStore.Stats(); blocks != 0 {
+		t.Fatalf("%d blocks stored from malformed streams", blocks)
+	}
+}
@@ -17,7 +17,8 @@ func (c ConsistentHashRing) GetResponsibleServer(blockId string) string {
 	}
 	sort.Strings(hashes)
 	var responsibleServerAddr = ""
-	blockHash := blockId
+	// Blocks are placed by their digest, whatever algorithm produced it
+	_, blockHash := ParseBlockHash(blockId)
 	firstServerAddr := ""
 	for _, serverHash := range hashes {
 		if len(firstServerAddr) == 0 {
@@ -6,14 +6,24 @@ import (
 	// "fmt"
 	"sync"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type MetaStore struct {
-	FileMetaMap        map[string]*FileMetaData
+	FileMetaMap map[string]*FileMetaData
+	// Latest versions of each file accepted by UpdateFile, oldest first, at most MaxHistory of them
+	FileHistory map[string][]*FileMetaData
+	// Versions kept in FileHistory per file, 0 means DEFAULT_MAX_FILE_HISTORY
+	MaxHistory         int
 	BlockStoreAddrs    []string
 	ConsistentHashRing *ConsistentHashRing
-	rwMutex            sync.RWMutex
+	// Algorithm of the block hashes of the namespace
+	HashAlgorithm string
+	// Updates rejected by UpdateFile because of an outdated version
+	updateConflicts uint64
+	rwMutex         sync.RWMutex
 	UnimplementedMetaStoreServer
 }
 
@@ -27,37 +37,46 @@ func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*File
 }
 
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
+	// Names which would escape the base directory of the clients are refused
+	if err := ValidateFileName(fileMetaData.Filename); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	fileName := fileMetaData.Filename
 	fileVersion := fileMetaData.Version
-	// Acquire read lock
-	// log.Println("server updateFile 1")
-	m.rwMutex.RLock()
-	_, exists := m.FileMetaMap[fileName]
-	m.rwMutex.RUnlock()
-	// log.Println("server updateFile 2")
-	if exists {
-		m.rwMutex.RLock()
-		curFileVersion := m.FileMetaMap[fileName].Version
-		m.rwMutex.RUnlock()
-		// log.Println("server updateFile 3")
-		// Replace the metadata only if the version is 1 greater than current file version
-		if fileVersion == 1+curFileVersion {
-			m.rwMutex.Lock()
-			m.FileMetaMap[fileName] = fileMetaData
-			m.rwMutex.Unlock()
-		} else {
-			// Else send version -1 to the client
-			return &Version{Version: -1}, nil
-		}
-		// log.Println("server updateFile 4")
-	} else {
-		m.rwMutex.Lock()
-		m.FileMetaMap[fileName] = fileMetaData
-		m.rwMutex.Unlock()
+	// The version is checked and the file replaced under a single lock, so that concurrent
+	// updates of the same version can't both succeed
+	m.rwMutex.Lock()
+	defer m.rwMutex.Unlock()
+	// Replace the metadata only if the version is 1 greater than current file version
+	if current, exists := m.FileMetaMap[fileName]; exists && fileVersion != 1+current.Version {
+		// Else send version -1 to the client
+		m.updateConflicts++
+		return &Version{Version: -1}, nil
 	}
+	m.FileMetaMap[fileName] = fileMetaData
+	m.appendHistory(fileMetaData)
 	return &Version{Version: fileVersion}, nil
 }
 
+// Records an accepted version in FileHistory, dropping the oldest ones beyond MaxHistory.
+// Called with the write lock held.
+func (m *MetaStore) appendHistory(fileMetaData *FileMetaData) {
+	maxHistory := m.MaxHistory
+	if maxHistory <= 0 {
+		maxHistory = DEFAULT_MAX_FILE_HISTORY
+	}
+	history := m.FileHistory[fileMetaData.Filename]
+	if len(history) >= maxHistory {
+		dropped := len(history) - maxHistory + 1
+		copy(history, history[dropped:])
+		for i := len(history) - dropped; i < len(history); i++ {
+			history[i] = nil
+		}
+		history = history[:len(history)-dropped]
+	}
+	m.FileHistory[fileMetaData.Filename] = append(history, fileMetaData)
+}
+
 func (m *MetaStore) GetBlockStoreMap(ctx context.Context, blockHashesIn *BlockHashes) (*BlockStoreMap, error) {
 	var blockStoreMap *BlockStoreMap = &BlockStoreMap{}
 	blockStoreMap.BlockStoreMap = make(map[string]*BlockHashes)
@@ -102,6 +121,41 @@ func (m *MetaStore) GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*
 	return blockStoreAddrs, nil
 }
 
+// Returns the namespace's hash algorithm if the client supports it. Clients which support none
+// of the algorithms can't read or write the namespace's blocks.
+func (m *MetaStore) NegotiateHashAlgorithm(ctx context.Context, supported *HashAlgorithms) (*HashAlgorithm, error) {
+	m.rwMutex.RLock()
+	algorithm := m.HashAlgorithm
+	m.rwMutex.RUnlock()
+	if algorithm == HASH_ALGORITHM_LEGACY {
+		// Untagged hashes are understood by every client
+		return &HashAlgorithm{Algorithm: algorithm}, nil
+	}
+	for _, supportedAlgorithm := range supported.Algorithms {
+		if supportedAlgorithm == algorithm {
+			return &HashAlgorithm{Algorithm: algorithm}, nil
+		}
+	}
+	return nil, status.Errorf(codes.FailedPrecondition, "namespace uses hash algorithm %s, which the client doesn't support", algorithm)
+}
+
+// Returns the latest versions of the file accepted so far, oldest first
+func (m *MetaStore) GetFileHistory(fileName string) []*FileMetaData {
+	m.rwMutex.RLock()
+	defer m.rwMutex.RUnlock()
+	history := make([]*FileMetaData, len(m.FileHistory[fileName]))
+	copy(history, m.FileHistory[fileName])
+	return history
+}
+
+// Returns the number of files in FileMetaMap and the number of updates rejected by UpdateFile
+// because of an outdated version
+func (m *MetaStore) Stats() (int, uint64) {
+	m.rwMutex.RLock()
+	defer m.rwMutex.RUnlock()
+	return len(m.FileMetaMap), m.updateConflicts
+}
+
 // This line guarantees all method for MetaStore are implemented
 var _ MetaStoreInterface = new(MetaStore)
 
@@ -109,7 +163,9 @@ func NewMetaStore(blockStoreAddrs []string) *MetaStore {
 	// log.Println("meta store ctr BlockStoreAddrs", blockStoreAddrs)
 	return &MetaStore{
 		FileMetaMap:        map[string]*FileMetaData{},
+		FileHistory:        map[string][]*FileMetaData{},
 		BlockStoreAddrs:    blockStoreAddrs,
 		ConsistentHashRing: NewConsistentHashRing(blockStoreAddrs),
+		HashAlgorithm:      DEFAULT_HASH_ALGORITHM,
 	}
 }
@@ -0,0 +1,58 @@
+package surfstore_test
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"sync"
+	"testing"
+)
+
+// Concurrent updates of the same version: exactly one is accepted
+func TestUpdateFileIsCompareAndSet(t *testing.T) {
+	metaStore := surfstore.NewMetaStore(nil)
+	ctx := context.Background()
+	for version := int32(1); version <= 20; version++ {
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		accepted := 0
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				fileMetaData := &surfstore.FileMetaData{Filename: "a.txt", Version: version, BlockHashList: []string{string(rune('a' + i))}}
+				returned, err := metaStore.UpdateFile(ctx, fileMetaData)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if returned.Version == version {
+					mutex.Lock()
+					accepted++
+					mutex.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		if accepted != 1 {
+			t.Fatalf("%d updates to version %d accepted", accepted, version)
+		}
+	}
+	if _, conflicts := metaStore.Stats(); conflicts != 20*7 {
+		t.Fatalf("%d conflicts, expected %d", conflicts, 20*7)
+	}
+}
+
+func TestFileHistoryIsCapped(t *testing.T) {
+	metaStore := surfstore.NewMetaStore(nil)
+	metaStore.MaxHistory = 3
+	for version := int32(1); version <= 5; version++ {
+		fileMetaData := &surfstore.FileMetaData{Filename: "a.txt", Version: version, BlockHashList: []string{surfstore.EMPTYFILE_HASHVALUE}}
+		if _, err := metaStore.UpdateFile(context.Background(), fileMetaData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history := metaStore.GetFileHistory("a.txt")
+	if len(history) != 3 || history[0].Version != 3 || history[2].Version != 5 {
+		t.Fatalf("history has %d versions, from %d", len(history), history[0].Version)
+	}
+}
@@ -2,6 +2,31 @@ package surfstore
 
 const DEFAULT_META_FILENAME string = "index.db"
 
+// Local index of the log backend, see SurfstoreIndexLog.go
+const INDEX_LOG_FILENAME string = "index.log"
+
+const DEFAULT_IGNORE_FILENAME string = ".surfignore"
+
+// Marks the hidden temporary files a download is written to before replacing the target
+const TEMP_FILE_MARKER string = ".surftmp-"
+
+// Largest piece of a block sent in a single message by GetBlockChunks and PutBlockChunks
+const BLOCK_CHUNK_SIZE int = 1 << 20
+
+// Bytes of a BlockChunk message besides its data, kept free when fitting chunks in a message limit
+const BLOCK_CHUNK_OVERHEAD int = 64
+
+// Largest block transferred in chunks, by default 16 times gRPC's default message limit of 4 MiB
+const MAX_BLOCK_SIZE_FACTOR int = 16
+const DEFAULT_MAX_BLOCK_SIZE int = MAX_BLOCK_SIZE_FACTOR << 22
+
+// Versions of each file the MetaStore keeps in its history by default
+const DEFAULT_MAX_FILE_HISTORY int = 32
+
+// A full BlockCache evicts blocks until it holds at most this percentage of its size limit, so
+// that the cache directory is only walked once every few puts
+const BLOCK_CACHE_LOW_WATER_PERCENT int64 = 90
+
 const TOMBSTONE_HASHVALUE string = "0"
 const EMPTYFILE_HASHVALUE string = "-1"
 
@@ -23,6 +23,9 @@ type BlockStoreClient interface {
 	PutBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Success, error)
 	HasBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
 	GetBlockHashes(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockHashes, error)
+	// Chunked variants of GetBlock and PutBlock, for blocks larger than the message size limit
+	GetBlockChunks(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (BlockStore_GetBlockChunksClient, error)
+	PutBlockChunks(ctx context.Context, opts ...grpc.CallOption) (BlockStore_PutBlockChunksClient, error)
 }
 
 type blockStoreClient struct {
@@ -69,6 +72,72 @@ func (c *blockStoreClient) GetBlockHashes(ctx context.Context, in *emptypb.Empty
 	return out, nil
 }
 
+func (c *blockStoreClient) GetBlockChunks(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (BlockStore_GetBlockChunksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BlockStore_ServiceDesc.Streams[0], "/surfstore.BlockStore/GetBlockChunks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &blockStoreGetBlockChunksClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type BlockStore_GetBlockChunksClient interface {
+	Recv() (*BlockChunk, error)
+	grpc.ClientStream
+}
+
+type blockStoreGetBlockChunksClient struct {
+	grpc.ClientStream
+}
+
+func (x *blockStoreGetBlockChunksClient) Recv() (*BlockChunk, error) {
+	m := new(BlockChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *blockStoreClient) PutBlockChunks(ctx context.Context, opts ...grpc.CallOption) (BlockStore_PutBlockChunksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BlockStore_ServiceDesc.Streams[1], "/surfstore.BlockStore/PutBlockChunks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &blockStorePutBlockChunksClient{stream}
+	return x, nil
+}
+
+type BlockStore_PutBlockChunksClient interface {
+	Send(*BlockChunk) error
+	CloseAndRecv() (*Success, error)
+	grpc.ClientStream
+}
+
+type blockStorePutBlockChunksClient struct {
+	grpc.ClientStream
+}
+
+func (x *blockStorePutBlockChunksClient) Send(m *BlockChunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *blockStorePutBlockChunksClient) CloseAndRecv() (*Success, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Success)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // BlockStoreServer is the server API for BlockStore service.
 // All implementations must embed UnimplementedBlockStoreServer
 // for forward compatibility
@@ -77,6 +146,9 @@ type BlockStoreServer interface {
 	PutBlock(context.Context, *Block) (*Success, error)
 	HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
 	GetBlockHashes(context.Context, *emptypb.Empty) (*BlockHashes, error)
+	// Chunked variants of GetBlock and PutBlock, for blocks larger than the message size limit
+	GetBlockChunks(*BlockHash, BlockStore_GetBlockChunksServer) error
+	PutBlockChunks(BlockStore_PutBlockChunksServer) error
 	mustEmbedUnimplementedBlockStoreServer()
 }
 
@@ -96,6 +168,12 @@ func (UnimplementedBlockStoreServer) HasBlocks(context.Context, *BlockHashes) (*
 func (UnimplementedBlockStoreServer) GetBlockHashes(context.Context, *emptypb.Empty) (*BlockHashes, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockHashes not implemented")
 }
+func (UnimplementedBlockStoreServer) GetBlockChunks(*BlockHash, BlockStore_GetBlockChunksServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetBlockChunks not implemented")
+}
+func (UnimplementedBlockStoreServer) PutBlockChunks(BlockStore_PutBlockChunksServer) error {
+	return status.Errorf(codes.Unimplemented, "method PutBlockChunks not implemented")
+}
 func (UnimplementedBlockStoreServer) mustEmbedUnimplementedBlockStoreServer() {}
 
 // UnsafeBlockStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -181,6 +259,53 @@ func _BlockStore_GetBlockHashes_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BlockStore_GetBlockChunks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BlockHash)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BlockStoreServer).GetBlockChunks(m, &blockStoreGetBlockChunksServer{stream})
+}
+
+type BlockStore_GetBlockChunksServer interface {
+	Send(*BlockChunk) error
+	grpc.ServerStream
+}
+
+type blockStoreGetBlockChunksServer struct {
+	grpc.ServerStream
+}
+
+func (x *blockStoreGetBlockChunksServer) Send(m *BlockChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _BlockStore_PutBlockChunks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BlockStoreServer).PutBlockChunks(&blockStorePutBlockChunksServer{stream})
+}
+
+type BlockStore_PutBlockChunksServer interface {
+	SendAndClose(*Success) error
+	Recv() (*BlockChunk, error)
+	grpc.ServerStream
+}
+
+type blockStorePutBlockChunksServer struct {
+	grpc.ServerStream
+}
+
+func (x *blockStorePutBlockChunksServer) SendAndClose(m *Success) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *blockStorePutBlockChunksServer) Recv() (*BlockChunk, error) {
+	m := new(BlockChunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // BlockStore_ServiceDesc is the grpc.ServiceDesc for BlockStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -205,7 +330,18 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _BlockStore_GetBlockHashes_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetBlockChunks",
+			Handler:       _BlockStore_GetBlockChunks_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "PutBlockChunks",
+			Handler:       _BlockStore_PutBlockChunks_Handler,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "pkg/surfstore/SurfStore.proto",
 }
 
@@ -217,6 +353,8 @@ type MetaStoreClient interface {
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
 	GetBlockStoreMap(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockStoreMap, error)
 	GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error)
+	// Returns the block hash algorithm of the namespace, if the client supports it
+	NegotiateHashAlgorithm(ctx context.Context, in *HashAlgorithms, opts ...grpc.CallOption) (*HashAlgorithm, error)
 }
 
 type metaStoreClient struct {
@@ -263,6 +401,15 @@ func (c *metaStoreClient) GetBlockStoreAddrs(ctx context.Context, in *emptypb.Em
 	return out, nil
 }
 
+func (c *metaStoreClient) NegotiateHashAlgorithm(ctx context.Context, in *HashAlgorithms, opts ...grpc.CallOption) (*HashAlgorithm, error) {
+	out := new(HashAlgorithm)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/NegotiateHashAlgorithm", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetaStoreServer is the server API for MetaStore service.
 // All implementations must embed UnimplementedMetaStoreServer
 // for forward compatibility
@@ -271,6 +418,8 @@ type MetaStoreServer interface {
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
 	GetBlockStoreMap(context.Context, *BlockHashes) (*BlockStoreMap, error)
 	GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error)
+	// Returns the block hash algorithm of the namespace, if the client supports it
+	NegotiateHashAlgorithm(context.Context, *HashAlgorithms) (*HashAlgorithm, error)
 	mustEmbedUnimplementedMetaStoreServer()
 }
 
@@ -290,6 +439,9 @@ func (UnimplementedMetaStoreServer) GetBlockStoreMap(context.Context, *BlockHash
 func (UnimplementedMetaStoreServer) GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddrs not implemented")
 }
+func (UnimplementedMetaStoreServer) NegotiateHashAlgorithm(context.Context, *HashAlgorithms) (*HashAlgorithm, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method NegotiateHashAlgorithm not implemented")
+}
 func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
 // UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -375,6 +527,24 @@ func _MetaStore_GetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_NegotiateHashAlgorithm_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HashAlgorithms)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).NegotiateHashAlgorithm(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/NegotiateHashAlgorithm",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).NegotiateHashAlgorithm(ctx, req.(*HashAlgorithms))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -398,6 +568,10 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetBlockStoreAddrs",
 			Handler:    _MetaStore_GetBlockStoreAddrs_Handler,
 		},
+		{
+			MethodName: "NegotiateHashAlgorithm",
+			Handler:    _MetaStore_NegotiateHashAlgorithm_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
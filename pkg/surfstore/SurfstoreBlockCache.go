@@ -0,0 +1,173 @@
+package surfstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlockCache is a content-addressed directory of blocks, keyed by block hash, which can be shared
+// by every client on a machine. Blocks are written atomically so that concurrent clients never see
+// a partial block, and once the cache grows past its size limit the least recently used blocks are
+// evicted down to BLOCK_CACHE_LOW_WATER_PERCENT of it. A nil *BlockCache is a valid, always empty
+// cache.
+type BlockCache struct {
+	Dir      string
+	MaxBytes int64
+
+	mutex sync.Mutex
+	// Approximate size of the cache directory, -1 until it has been measured
+	size int64
+}
+
+// Creates the cache directory if necessary
+func NewBlockCache(dir string, maxBytes int64) (*BlockCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &BlockCache{Dir: dir, MaxBytes: maxBytes, size: -1}, nil
+}
+
+// Blocks are spread over subdirectories named after the first two characters of their digest.
+// The tag separator is replaced in file names, since some file systems don't allow it.
+func (cache *BlockCache) blockPath(blockHash string) (string, error) {
+	_, digest := ParseBlockHash(blockHash)
+	if len(digest) < 3 || strings.ContainsAny(blockHash, "/\\._") {
+		return "", fmt.Errorf("invalid block hash %q", blockHash)
+	}
+	return filepath.Join(cache.Dir, digest[:2], strings.Replace(blockHash, HASH_TAG_SEPARATOR, "_", 1)), nil
+}
+
+// Has reports whether the block is cached
+func (cache *BlockCache) Has(blockHash string) bool {
+	if cache == nil {
+		return false
+	}
+	path, err := cache.blockPath(blockHash)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Get returns the cached block. A cached block which doesn't match its hash is dropped.
+func (cache *BlockCache) Get(blockHash string) ([]byte, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	path, err := cache.blockPath(blockHash)
+	if err != nil {
+		return nil, false
+	}
+	blockData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	if !VerifyBlockHash(blockHash, blockData) {
+		os.Remove(path)
+		return nil, false
+	}
+	// The modification time records the last use for LRU eviction
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return blockData, true
+}
+
+// Put stores the block and evicts least recently used blocks if the cache is full
+func (cache *BlockCache) Put(blockHash string, blockData []byte) error {
+	if cache == nil {
+		return nil
+	}
+	path, err := cache.blockPath(blockHash)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Named after the block file, whose name is valid where the tagged hash may not be
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+TEMP_FILE_MARKER)
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(blockData); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.size < 0 {
+		// Measured by the eviction below
+		return cache.evict()
+	}
+	cache.size += int64(len(blockData))
+	if cache.size > cache.MaxBytes {
+		return cache.evict()
+	}
+	return nil
+}
+
+// Measures the cache directory, which other clients may have changed, and if it exceeds its size
+// limit removes the least recently used blocks down to the low-water mark. The caller holds the
+// mutex.
+func (cache *BlockCache) evict() error {
+	type cachedBlock struct {
+		path     string
+		size     int64
+		lastUsed time.Time
+	}
+	blocks := make([]cachedBlock, 0)
+	var size int64
+	err := filepath.Walk(cache.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Removed concurrently by another client
+			return nil
+		}
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			blocks = append(blocks, cachedBlock{path: path, size: info.Size(), lastUsed: info.ModTime()})
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if size <= cache.MaxBytes {
+		cache.size = size
+		return nil
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].lastUsed.Before(blocks[j].lastUsed)
+	})
+	lowWater := cache.MaxBytes * BLOCK_CACHE_LOW_WATER_PERCENT / 100
+	for _, block := range blocks {
+		if size <= lowWater {
+			break
+		}
+		if err := os.Remove(block.path); err == nil || os.IsNotExist(err) {
+			size -= block.size
+		}
+	}
+	cache.size = size
+	return nil
+}
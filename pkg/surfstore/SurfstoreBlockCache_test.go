@@ -0,0 +1,140 @@
+package surfstore_test
+
+import (
+	"bytes"
+	"cse224/proj4/pkg/surfstore"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Caches a block of TEST_BLOCK_SIZE bytes and returns its hash
+func putTestBlock(t *testing.T, cache *surfstore.BlockCache, seed byte) string {
+	t.Helper()
+	blockHash, err := surfstore.GetTaggedBlockHash(surfstore.HASH_ALGORITHM_SHA256, testContent(seed, TEST_BLOCK_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put(blockHash, testContent(seed, TEST_BLOCK_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	return blockHash
+}
+
+// Returns the path of the cached block, whatever the cache's layout
+func cachedBlockPath(t *testing.T, cache *surfstore.BlockCache, blockHash string) string {
+	t.Helper()
+	_, digest := surfstore.ParseBlockHash(blockHash)
+	paths, err := filepath.Glob(filepath.Join(cache.Dir, "*", "*"+digest))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("%s cached at %v: %v", blockHash, paths, err)
+	}
+	return paths[0]
+}
+
+func setBlockLastUsed(t *testing.T, cache *surfstore.BlockCache, blockHash string, lastUsed time.Time) {
+	t.Helper()
+	if err := os.Chtimes(cachedBlockPath(t, cache, blockHash), lastUsed, lastUsed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cacheDirSize(t *testing.T, cache *surfstore.BlockCache) int64 {
+	t.Helper()
+	var size int64
+	err := filepath.Walk(cache.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return size
+}
+
+// A Get counts as a use, the least recently used blocks are evicted first
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := surfstore.NewBlockCache(t.TempDir(), int64(3*TEST_BLOCK_SIZE+TEST_BLOCK_SIZE/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := putTestBlock(t, cache, 1)
+	second := putTestBlock(t, cache, 2)
+	third := putTestBlock(t, cache, 3)
+	past := time.Now().Add(-time.Hour)
+	setBlockLastUsed(t, cache, first, past)
+	setBlockLastUsed(t, cache, second, past.Add(time.Minute))
+	setBlockLastUsed(t, cache, third, past.Add(2*time.Minute))
+	if blockData, ok := cache.Get(first); !ok || !bytes.Equal(blockData, testContent(1, TEST_BLOCK_SIZE)) {
+		t.Fatal("cached block not returned")
+	}
+
+	fourth := putTestBlock(t, cache, 4)
+	if cache.Has(second) {
+		t.Fatal("least recently used block kept")
+	}
+	for _, blockHash := range []string{first, third, fourth} {
+		if !cache.Has(blockHash) {
+			t.Fatalf("%s evicted", blockHash)
+		}
+	}
+}
+
+// Eviction goes below the size limit, so the following puts don't walk the cache
+func TestBlockCacheSizeLimit(t *testing.T) {
+	maxBytes := int64(20 * TEST_BLOCK_SIZE)
+	cache, err := surfstore.NewBlockCache(t.TempDir(), maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lowWater := maxBytes * surfstore.BLOCK_CACHE_LOW_WATER_PERCENT / 100
+	var size int64
+	evictions := 0
+	for seed := byte(0); seed < 100; seed++ {
+		putTestBlock(t, cache, seed)
+		previous := size
+		size = cacheDirSize(t, cache)
+		if size > maxBytes {
+			t.Fatalf("cache holds %d bytes, limit %d", size, maxBytes)
+		}
+		if size <= previous {
+			evictions++
+			if size > lowWater {
+				t.Fatalf("cache holds %d bytes after eviction, low-water mark %d", size, lowWater)
+			}
+		}
+	}
+	// Each eviction leaves room for several blocks
+	if evictions == 0 || evictions > 30 {
+		t.Fatalf("%d evictions", evictions)
+	}
+}
+
+// A corrupted block is dropped rather than returned
+func TestBlockCacheGetVerifiesHash(t *testing.T) {
+	cache, err := surfstore.NewBlockCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockHash := putTestBlock(t, cache, 1)
+	if err := os.WriteFile(cachedBlockPath(t, cache, blockHash), testContent(2, TEST_BLOCK_SIZE), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(blockHash); ok {
+		t.Fatal("corrupted block returned")
+	}
+	if cache.Has(blockHash) {
+		t.Fatal("corrupted block kept")
+	}
+	if err := cache.Put("sha256:../../evil", []byte("evil")); err == nil {
+		t.Fatal("invalid block hash accepted")
+	}
+
+	var nilCache *surfstore.BlockCache
+	if _, ok := nilCache.Get(blockHash); ok || nilCache.Put(blockHash, nil) != nil {
+		t.Fatal("nil cache isn't empty")
+	}
+}
@@ -0,0 +1,75 @@
+package surfstore
+
+import (
+	"errors"
+	"sync"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+var ErrConnPoolClosed = errors.New("connection pool is closed")
+
+// ConnPool keeps a single gRPC connection per server address, which every RPC to that server
+// shares. Connections are dialed on first use and replaced once they fail.
+type ConnPool struct {
+	mutex  sync.Mutex
+	conns  map[string]*grpc.ClientConn
+	closed bool
+}
+
+func NewConnPool() *ConnPool {
+	return &ConnPool{conns: make(map[string]*grpc.ClientConn)}
+}
+
+// Get returns the connection to the address, dialing a new one with the given options if there is
+// none yet or if the previous one is shut down or failing
+func (pool *ConnPool) Get(addr string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.closed {
+		return nil, ErrConnPoolClosed
+	}
+	if conn, exists := pool.conns[addr]; exists {
+		switch conn.GetState() {
+		case connectivity.Shutdown, connectivity.TransientFailure:
+			// Redial instead of waiting for the connection's reconnect backoff
+			conn.Close()
+			delete(pool.conns, addr)
+		default:
+			return conn, nil
+		}
+	}
+	conn, err := connectToGrpcServer(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	pool.conns[addr] = conn
+	return conn, nil
+}
+
+// Discard closes the connection after an RPC on it failed, so that the next call redials.
+// A connection which has already been replaced is left alone.
+func (pool *ConnPool) Discard(addr string, conn *grpc.ClientConn) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.conns[addr] == conn {
+		delete(pool.conns, addr)
+	}
+	conn.Close()
+}
+
+// Close closes every connection of the pool, later calls to Get fail
+func (pool *ConnPool) Close() error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.closed = true
+	var firstErr error
+	for addr, conn := range pool.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(pool.conns, addr)
+	}
+	return firstErr
+}
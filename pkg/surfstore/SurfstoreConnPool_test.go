@@ -0,0 +1,80 @@
+package surfstore_test
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func getPooledConn(t *testing.T, pool *surfstore.ConnPool, addr string, opts []grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+	conn, err := pool.Get(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Fails unless an RPC on the connection reaches the MetaStore
+func checkConnWorks(t *testing.T, conn *grpc.ClientConn) {
+	t.Helper()
+	if _, err := surfstore.NewMetaStoreClient(conn).GetBlockStoreAddrs(context.Background(), &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnPool(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	pool := surfstore.NewConnPool()
+	metaAddr, blockStoreAddr := cluster.MetaAddr, cluster.BlockStoreAddrs[0]
+	// Dials the in-memory listeners of the cluster
+	opts := newTestClient(t, cluster).DialOptions
+
+	// One connection per address, shared by every Get
+	conn := getPooledConn(t, pool, metaAddr, opts)
+	checkConnWorks(t, conn)
+	if again := getPooledConn(t, pool, metaAddr, opts); again != conn {
+		t.Fatal("second Get dialed a new connection")
+	}
+	blockStoreConn := getPooledConn(t, pool, blockStoreAddr, opts)
+	if blockStoreConn == conn {
+		t.Fatal("two addresses share a connection")
+	}
+
+	// A discarded connection is closed and replaced by the next Get
+	pool.Discard(metaAddr, conn)
+	if state := conn.GetState(); state != connectivity.Shutdown {
+		t.Fatalf("discarded connection is %v", state)
+	}
+	redialed := getPooledConn(t, pool, metaAddr, opts)
+	if redialed == conn {
+		t.Fatal("Get returned the discarded connection")
+	}
+	checkConnWorks(t, redialed)
+	// Discarding the connection again leaves its replacement alone
+	pool.Discard(metaAddr, conn)
+	if again := getPooledConn(t, pool, metaAddr, opts); again != redialed {
+		t.Fatal("discarding a replaced connection dropped its replacement")
+	}
+	checkConnWorks(t, redialed)
+
+	// Close releases every connection, and the pool can't be used any more
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, pooled := range []*grpc.ClientConn{redialed, blockStoreConn} {
+		if state := pooled.GetState(); state != connectivity.Shutdown {
+			t.Fatalf("connection is %v after Close", state)
+		}
+	}
+	if _, err := pool.Get(metaAddr); !errors.Is(err, surfstore.ErrConnPoolClosed) {
+		t.Fatalf("Get after Close returned %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	HTTP/JSON Gateway
+
+	GET    /files                  list of the files on the server (JSON)
+	GET    /files/<name>           content of the latest version
+	PUT    /files/<name>           upload the request body as the next version
+	DELETE /files/<name>           delete the file
+	GET    /meta/<name>            metadata of the latest version (JSON)
+	GET    /history/<name>         metadata of the versions kept by the MetaStore (JSON)
+
+	Files are split into blocks and reassembled by the gateway, the blocks are stored on the
+	BlockStores chosen by the MetaStore's consistent hash ring. PUT and DELETE accept an
+	If-Match header holding the version they replace and fail with 409 Conflict otherwise.
+*/
+
+// Header holding the version of the file a response refers to
+const VERSION_HEADER string = "X-Surfstore-Version"
+
+// Gateway serves the HTTP/JSON API on top of a MetaStore
+type Gateway struct {
+	metaStore *MetaStore
+	// Client of the MetaStore and the BlockStores, its BlockSize is used to split uploads
+	client RPCClient
+	mux    *http.ServeMux
+}
+
+// JSON representation of FileMetaData
+type gatewayFileMeta struct {
+	Name          string   `json:"name"`
+	Version       int32    `json:"version"`
+	Deleted       bool     `json:"deleted"`
+	Type          string   `json:"type,omitempty"`
+	Size          int64    `json:"size"`
+	Mode          string   `json:"mode,omitempty"`
+	Mtime         string   `json:"mtime,omitempty"`
+	SymlinkTarget string   `json:"symlinkTarget,omitempty"`
+	BlockHashList []string `json:"blockHashList,omitempty"`
+}
+
+type gatewayError struct {
+	Error string `json:"error"`
+}
+
+func NewGateway(metaStore *MetaStore, client RPCClient) *Gateway {
+	gateway := &Gateway{metaStore: metaStore, client: client, mux: http.NewServeMux()}
+	gateway.mux.HandleFunc("/files", gateway.handleList)
+	gateway.mux.HandleFunc("/files/", gateway.handleFile)
+	gateway.mux.HandleFunc("/meta/", gateway.handleMeta)
+	gateway.mux.HandleFunc("/history/", gateway.handleHistory)
+	return gateway
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Gateway", r.Method, r.URL.Path)
+	g.mux.ServeHTTP(w, r)
+}
+
+func (g *Gateway) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeGatewayError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	files, err := ListRemoteFiles(g.client)
+	if err != nil {
+		writeGatewayError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	list := make([]*gatewayFileMeta, 0, len(files))
+	for _, fileMetaData := range files {
+		list = append(list, newGatewayFileMeta(fileMetaData))
+	}
+	writeGatewayJSON(w, http.StatusOK, list)
+}
+
+func (g *Gateway) handleMeta(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeGatewayError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	fileName, ok := gatewayFileName(w, r, "/meta/")
+	if !ok {
+		return
+	}
+	fileMetaData, err := GetRemoteFileMeta(g.client, fileName)
+	if err != nil {
+		writeRemoteError(w, err)
+		return
+	}
+	writeGatewayJSON(w, http.StatusOK, newGatewayFileMeta(fileMetaData))
+}
+
+func (g *Gateway) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeGatewayError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	fileName, ok := gatewayFileName(w, r, "/history/")
+	if !ok {
+		return
+	}
+	history := g.metaStore.GetFileHistory(fileName)
+	if len(history) == 0 {
+		writeRemoteError(w, ErrRemoteFileNotFound)
+		return
+	}
+	versions := make([]*gatewayFileMeta, 0, len(history))
+	for _, fileMetaData := range history {
+		versions = append(versions, newGatewayFileMeta(fileMetaData))
+	}
+	writeGatewayJSON(w, http.StatusOK, versions)
+}
+
+func (g *Gateway) handleFile(w http.ResponseWriter, r *http.Request) {
+	fileName, ok := gatewayFileName(w, r, "/files/")
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		g.getFile(w, r, fileName)
+	case http.MethodPut:
+		g.putFile(w, r, fileName)
+	case http.MethodDelete:
+		g.deleteFile(w, r, fileName)
+	default:
+		writeGatewayError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (g *Gateway) getFile(w http.ResponseWriter, r *http.Request, fileName string) {
+	fileMetaData, err := GetRemoteFileMeta(g.client, fileName)
+	if err == nil && isFileDeleted(fileMetaData) {
+		err = ErrRemoteFileNotFound
+	}
+	if err != nil {
+		writeRemoteError(w, err)
+		return
+	}
+	if fileMetaData.FileType == FileType_SYMLINK {
+		writeGatewayError(w, http.StatusConflict, fileName+" is a symlink to "+fileMetaData.SymlinkTarget)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(VERSION_HEADER, strconv.Itoa(int(fileMetaData.Version)))
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(int(fileMetaData.Version))))
+	if fileMetaData.Mtime != 0 {
+		w.Header().Set("Last-Modified", time.Unix(0, fileMetaData.Mtime).UTC().Format(http.TimeFormat))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	// Headers are sent with the first block, a failure after that can only abort the response
+	if _, err := ReadRemoteFile(g.client, fileMetaData, w); err != nil {
+		log.Println("Gateway error while reading", fileName, err)
+	}
+}
+
+func (g *Gateway) putFile(w http.ResponseWriter, r *http.Request, fileName string) {
+	current, err := GetRemoteFileMeta(g.client, fileName)
+	if err != nil && err != ErrRemoteFileNotFound {
+		writeRemoteError(w, err)
+		return
+	}
+	if !matchesIfMatch(r, current) {
+		writeRemoteError(w, ErrVersionConflict)
+		return
+	}
+	fileMetaData := &FileMetaData{
+		Filename: fileName,
+		Version:  NextRemoteVersion(current),
+		Mtime:    time.Now().UnixNano(),
+		FileType: FileType_REGULAR,
+	}
+	version, err := WriteRemoteFile(g.client, fileMetaData, r.Body)
+	if err != nil {
+		writeRemoteError(w, err)
+		return
+	}
+	w.Header().Set(VERSION_HEADER, strconv.Itoa(int(version)))
+	writeGatewayJSON(w, http.StatusOK, newGatewayFileMeta(fileMetaData))
+}
+
+func (g *Gateway) deleteFile(w http.ResponseWriter, r *http.Request, fileName string) {
+	current, err := GetRemoteFileMeta(g.client, fileName)
+	if err == nil && isFileDeleted(current) {
+		err = ErrRemoteFileNotFound
+	}
+	if err != nil {
+		writeRemoteError(w, err)
+		return
+	}
+	if !matchesIfMatch(r, current) {
+		writeRemoteError(w, ErrVersionConflict)
+		return
+	}
+	version, err := DeleteRemoteFile(g.client, fileName, NextRemoteVersion(current))
+	if err != nil {
+		writeRemoteError(w, err)
+		return
+	}
+	w.Header().Set(VERSION_HEADER, strconv.Itoa(int(version)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reports whether the If-Match header, if any, names the current version of the file.
+// "*" matches any existing file, version 0 a file which doesn't exist yet.
+func matchesIfMatch(r *http.Request, current *FileMetaData) bool {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if len(ifMatch) == 0 {
+		return true
+	}
+	if ifMatch == "*" {
+		return current != nil
+	}
+	expected, err := strconv.Atoi(strings.Trim(ifMatch, "\""))
+	if err != nil {
+		return false
+	}
+	if current == nil {
+		return expected == 0
+	}
+	return int32(expected) == current.Version
+}
+
+// Returns the file name following the prefix of the request path
+func gatewayFileName(w http.ResponseWriter, r *http.Request, prefix string) (string, bool) {
+	fileName := strings.TrimPrefix(r.URL.Path, prefix)
+	if err := ValidateFileName(fileName); err != nil {
+		writeGatewayError(w, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return fileName, true
+}
+
+func newGatewayFileMeta(fileMetaData *FileMetaData) *gatewayFileMeta {
+	fileMeta := &gatewayFileMeta{Name: fileMetaData.Filename, Version: fileMetaData.Version}
+	if isFileDeleted(fileMetaData) {
+		fileMeta.Deleted = true
+		return fileMeta
+	}
+	fileMeta.Type = "regular"
+	fileMeta.Size = fileMetaData.Size
+	if fileMetaData.FileType == FileType_SYMLINK {
+		fileMeta.Type = "symlink"
+		fileMeta.SymlinkTarget = fileMetaData.SymlinkTarget
+	}
+	if fileMetaData.Mode != 0 {
+		fileMeta.Mode = "0" + strconv.FormatUint(uint64(fileMetaData.Mode), 8)
+	}
+	if fileMetaData.Mtime != 0 {
+		fileMeta.Mtime = time.Unix(0, fileMetaData.Mtime).UTC().Format(time.RFC3339Nano)
+	}
+	fileMeta.BlockHashList = fileMetaData.BlockHashList
+	return fileMeta
+}
+
+// Maps the errors of the remote file operations to HTTP statuses
+func writeRemoteError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrRemoteFileNotFound:
+		writeGatewayError(w, http.StatusNotFound, err.Error())
+	case ErrVersionConflict:
+		writeGatewayError(w, http.StatusConflict, err.Error())
+	default:
+		writeGatewayError(w, http.StatusBadGateway, err.Error())
+	}
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, message string) {
+	writeGatewayJSON(w, status, &gatewayError{Error: message})
+}
+
+func writeGatewayJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("Gateway error while writing response", err)
+	}
+}
@@ -0,0 +1,156 @@
+package surfstore_test
+
+import (
+	"bytes"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type gatewayTestClient struct {
+	t       *testing.T
+	baseURL string
+}
+
+// Sends the request and checks its status, returning the response body
+func (c *gatewayTestClient) expect(expected int, method string, path string, body []byte, ifMatch string) []byte {
+	c.t.Helper()
+	status, respBody := c.do(method, path, body, ifMatch)
+	if status != expected {
+		c.t.Fatalf("%s %s returned %d, expected %d: %s", method, path, status, expected, respBody)
+	}
+	return respBody
+}
+
+func (c *gatewayTestClient) do(method string, path string, body []byte, ifMatch string) (int, []byte) {
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		c.t.Error(err)
+		return 0, nil
+	}
+	if len(ifMatch) > 0 {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Error(err)
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Error(err)
+	}
+	return resp.StatusCode, respBody
+}
+
+type gatewayTestMeta struct {
+	Name    string `json:"name"`
+	Version int32  `json:"version"`
+	Deleted bool   `json:"deleted"`
+	Size    int64  `json:"size"`
+}
+
+func decodeGatewayJSON(t *testing.T, body []byte, value interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(body, value); err != nil {
+		t.Fatalf("invalid JSON %s: %v", body, err)
+	}
+}
+
+func newGatewayTestServer(t *testing.T, cluster *surfstoretest.Cluster) *gatewayTestClient {
+	server := httptest.NewServer(surfstore.NewGateway(cluster.MetaStore(), newTestClient(t, cluster)))
+	t.Cleanup(server.Close)
+	return &gatewayTestClient{t: t, baseURL: server.URL}
+}
+
+func TestGateway(t *testing.T) {
+	cluster := surfstoretest.NewCluster(2)
+	defer cluster.Close()
+	gateway := newGatewayTestServer(t, cluster)
+
+	content := testContent(1, 3*TEST_BLOCK_SIZE)
+	var meta gatewayTestMeta
+	decodeGatewayJSON(t, gateway.expect(http.StatusOK, http.MethodPut, "/files/a.txt", content, ""), &meta)
+	if meta.Name != "a.txt" || meta.Version != 1 || meta.Size != int64(len(content)) {
+		t.Fatalf("PUT returned %+v", meta)
+	}
+	if body := gateway.expect(http.StatusOK, http.MethodGet, "/files/a.txt", nil, ""); !bytes.Equal(body, content) {
+		t.Fatalf("GET returned %d bytes", len(body))
+	}
+
+	// Writes naming another version are rejected
+	gateway.expect(http.StatusConflict, http.MethodPut, "/files/a.txt", []byte("stale"), `"0"`)
+	updated := testContent(2, TEST_BLOCK_SIZE)
+	gateway.expect(http.StatusOK, http.MethodPut, "/files/a.txt", updated, `"1"`)
+	gateway.expect(http.StatusConflict, http.MethodDelete, "/files/a.txt", nil, `"1"`)
+
+	decodeGatewayJSON(t, gateway.expect(http.StatusOK, http.MethodGet, "/meta/a.txt", nil, ""), &meta)
+	if meta.Version != 2 || meta.Deleted || meta.Size != int64(len(updated)) {
+		t.Fatalf("metadata %+v", meta)
+	}
+	gateway.expect(http.StatusOK, http.MethodPut, "/files/b.txt", []byte("b"), `"0"`)
+	var list []gatewayTestMeta
+	decodeGatewayJSON(t, gateway.expect(http.StatusOK, http.MethodGet, "/files", nil, ""), &list)
+	if len(list) != 2 || list[0].Name != "a.txt" || list[1].Name != "b.txt" {
+		t.Fatalf("listed %+v", list)
+	}
+
+	gateway.expect(http.StatusNoContent, http.MethodDelete, "/files/a.txt", nil, `"2"`)
+	gateway.expect(http.StatusNotFound, http.MethodGet, "/files/a.txt", nil, "")
+	decodeGatewayJSON(t, gateway.expect(http.StatusOK, http.MethodGet, "/meta/a.txt", nil, ""), &meta)
+	if meta.Version != 3 || !meta.Deleted {
+		t.Fatalf("metadata of the deleted file %+v", meta)
+	}
+	var history []gatewayTestMeta
+	decodeGatewayJSON(t, gateway.expect(http.StatusOK, http.MethodGet, "/history/a.txt", nil, ""), &history)
+	if len(history) != 3 || history[0].Version != 1 || !history[2].Deleted {
+		t.Fatalf("history %+v", history)
+	}
+
+	gateway.expect(http.StatusNotFound, http.MethodGet, "/meta/missing.txt", nil, "")
+	gateway.expect(http.StatusNotFound, http.MethodGet, "/history/missing.txt", nil, "")
+	gateway.expect(http.StatusMethodNotAllowed, http.MethodPost, "/files", nil, "")
+	// Paths holding "." or ".." segments are redirected by the mux, backslashes reach the handlers
+	for _, path := range []string{"/files/..%5Cevil", "/meta/a%5C..%5Cevil", "/history/a%00b"} {
+		gateway.expect(http.StatusBadRequest, http.MethodGet, path, nil, "")
+	}
+	gateway.expect(http.StatusBadRequest, http.MethodPut, "/files/a%5C..%5Cevil", []byte("evil"), "")
+	if _, exists := cluster.MetaStore().FileMetaMap[`a\..\evil`]; exists {
+		t.Fatal("invalid name published")
+	}
+}
+
+// Concurrent PUTs naming the same version: one succeeds, the others conflict
+func TestGatewayConcurrentPuts(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	gateway := newGatewayTestServer(t, cluster)
+	gateway.expect(http.StatusOK, http.MethodPut, "/files/a.txt", []byte("first"), "")
+
+	statuses := make(chan int, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, _ := gateway.do(http.MethodPut, "/files/a.txt", testContent(byte(i), TEST_BLOCK_SIZE), `"1"`)
+			statuses <- status
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != cap(statuses)-1 {
+		t.Fatalf("statuses %v", counts)
+	}
+	checkRemoteVersion(t, cluster, "a.txt", 2, false)
+}
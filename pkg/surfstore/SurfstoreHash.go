@@ -0,0 +1,152 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"lukechampine.com/blake3"
+)
+
+/*
+	Block Hash Algorithms
+
+	Block hashes are tagged with the algorithm which produced them, "<algorithm>:<hex digest>"
+	(e.g. "sha256:9f86d0..."). Each MetaStore namespace uses a single algorithm, which clients
+	negotiate before hashing. Untagged hashes, written before hashes were tagged, are SHA-256 hex
+	digests and stay readable: they verify as SHA-256 and equal their "sha256:" tagged form.
+*/
+
+// Algorithm of the untagged hashes of legacy clients and servers (SHA-256)
+const HASH_ALGORITHM_LEGACY string = ""
+
+const HASH_ALGORITHM_SHA256 string = "sha256"
+const HASH_ALGORITHM_SHA512_256 string = "sha512-256"
+const HASH_ALGORITHM_BLAKE3 string = "blake3"
+
+// Algorithm of a new namespace
+const DEFAULT_HASH_ALGORITHM string = HASH_ALGORITHM_SHA256
+
+const HASH_TAG_SEPARATOR string = ":"
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	HASH_ALGORITHM_SHA256:     sha256.New,
+	HASH_ALGORITHM_SHA512_256: sha512.New512_256,
+	HASH_ALGORITHM_BLAKE3:     func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// RegisterHashAlgorithm makes another hash algorithm available to clients and servers. It must be
+// called before any of them starts. The hex digests are placed on the consistent hash ring next to
+// the SHA-256 positions of the BlockStores, so they should be uniformly distributed.
+func RegisterHashAlgorithm(name string, newHash func() hash.Hash) {
+	if len(name) == 0 || strings.Contains(name, HASH_TAG_SEPARATOR) {
+		panic(fmt.Sprintf("invalid hash algorithm name %q", name))
+	}
+	hashAlgorithms[name] = newHash
+}
+
+// SupportedHashAlgorithms returns the names of the registered hash algorithms, sorted
+func SupportedHashAlgorithms() []string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsHashAlgorithm reports whether blocks can be hashed with the algorithm
+func IsHashAlgorithm(algorithm string) bool {
+	if algorithm == HASH_ALGORITHM_LEGACY {
+		return true
+	}
+	_, exists := hashAlgorithms[algorithm]
+	return exists
+}
+
+// GetTaggedBlockHash returns the hash of the block tagged with the algorithm, or an untagged
+// SHA-256 hash for HASH_ALGORITHM_LEGACY
+func GetTaggedBlockHash(algorithm string, blockData []byte) (string, error) {
+	if algorithm == HASH_ALGORITHM_LEGACY {
+		return GetBlockHashString(blockData), nil
+	}
+	newHash, exists := hashAlgorithms[algorithm]
+	if !exists {
+		return "", fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+	h := newHash()
+	h.Write(blockData)
+	return algorithm + HASH_TAG_SEPARATOR + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ParseBlockHash splits a block hash into its algorithm and its hex digest. Untagged hashes
+// have the algorithm HASH_ALGORITHM_LEGACY.
+func ParseBlockHash(blockHash string) (string, string) {
+	if idx := strings.Index(blockHash, HASH_TAG_SEPARATOR); idx >= 0 {
+		return blockHash[:idx], blockHash[idx+1:]
+	}
+	return HASH_ALGORITHM_LEGACY, blockHash
+}
+
+// VerifyBlockHash reports whether the block has the given hash
+func VerifyBlockHash(blockHash string, blockData []byte) bool {
+	algorithm, _ := ParseBlockHash(blockHash)
+	computed, err := GetTaggedBlockHash(algorithm, blockData)
+	return err == nil && computed == blockHash
+}
+
+// Reports whether both hashes name the same block, an untagged hash being equal to its
+// "sha256:" tagged form
+func sameBlockHash(first, second string) bool {
+	if first == second {
+		return true
+	}
+	firstAlgorithm, firstDigest := ParseBlockHash(first)
+	secondAlgorithm, secondDigest := ParseBlockHash(second)
+	return firstDigest == secondDigest && canonicalHashAlgorithm(firstAlgorithm) == canonicalHashAlgorithm(secondAlgorithm)
+}
+
+func canonicalHashAlgorithm(algorithm string) string {
+	if algorithm == HASH_ALGORITHM_LEGACY {
+		return HASH_ALGORITHM_SHA256
+	}
+	return algorithm
+}
+
+// Reports whether the blocks of the hash list were hashed with the algorithm. The markers of
+// empty and deleted files match any algorithm.
+func usesHashAlgorithm(hashList []string, algorithm string) bool {
+	for _, blockHash := range hashList {
+		if blockHash == EMPTYFILE_HASHVALUE || blockHash == TOMBSTONE_HASHVALUE {
+			continue
+		}
+		if hashAlgorithm, _ := ParseBlockHash(blockHash); hashAlgorithm != algorithm {
+			return false
+		}
+	}
+	return true
+}
+
+// Asks the MetaStore which algorithm the blocks of its namespace are hashed with. A MetaStore
+// which predates tagged hashes uses untagged SHA-256 hashes.
+func negotiateHashAlgorithm(ctx context.Context, client RPCClient) (string, error) {
+	var algorithm string
+	err := client.NegotiateHashAlgorithmContext(ctx, SupportedHashAlgorithms(), &algorithm)
+	if status.Code(err) == codes.Unimplemented {
+		return HASH_ALGORITHM_LEGACY, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !IsHashAlgorithm(algorithm) {
+		return "", fmt.Errorf("MetaStore chose unknown hash algorithm %q", algorithm)
+	}
+	return algorithm, nil
+}
@@ -0,0 +1,67 @@
+package surfstore
+
+import (
+	context "context"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+/*
+	Health Checking Related
+
+	A server registers the standard grpc.health.v1.Health service, which reports the status of
+	each Surfstore service it hosts ("surfstore.MetaStore", "surfstore.BlockStore") and of the
+	server as a whole (""). Every status is NOT_SERVING until the server has started, and again
+	once it drains before stopping.
+*/
+
+// Names of the services in health checks, the server as a whole is ""
+const HEALTH_SERVICE_META string = "surfstore.MetaStore"
+const HEALTH_SERVICE_BLOCK string = "surfstore.BlockStore"
+
+type HealthServer struct {
+	*health.Server
+	services []string
+}
+
+// NewHealthServer returns the health service of a server hosting services, all NOT_SERVING
+func NewHealthServer(services ...string) *HealthServer {
+	h := &HealthServer{Server: health.NewServer(), services: append([]string{""}, services...)}
+	for _, service := range h.services {
+		h.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	return h
+}
+
+// Register adds the health service to the gRPC server
+func (h *HealthServer) Register(grpcServer *grpc.Server) {
+	healthpb.RegisterHealthServer(grpcServer, h)
+}
+
+// SetServing reports every service as SERVING, once the server is ready to handle requests
+func (h *HealthServer) SetServing() {
+	for _, service := range h.services {
+		h.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	}
+}
+
+// Drain reports every service as NOT_SERVING for good, before the server stops
+func (h *HealthServer) Drain() {
+	h.Shutdown()
+}
+
+// CheckHealthContext asks the server at addr for the status of service, "" for the whole server
+func (surfClient *RPCClient) CheckHealthContext(ctx context.Context, addr string, service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	var resp *healthpb.HealthCheckResponse
+	err := surfClient.call(ctx, "Check", addr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		resp, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service}, surfClient.callOptions()...)
+		return err
+	})
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, err
+	}
+	return resp.Status, nil
+}
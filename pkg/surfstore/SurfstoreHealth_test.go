@@ -0,0 +1,70 @@
+package surfstore_test
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func checkHealth(t *testing.T, client surfstore.RPCClient, addr string, service string, expected healthpb.HealthCheckResponse_ServingStatus) {
+	t.Helper()
+	serving, err := client.CheckHealthContext(context.Background(), addr, service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serving != expected {
+		t.Fatalf("%q on %s is %v, expected %v", service, addr, serving, expected)
+	}
+}
+
+func TestHealthServerStartsNotServing(t *testing.T) {
+	health := surfstore.NewHealthServer(surfstore.HEALTH_SERVICE_META)
+	for _, service := range []string{"", surfstore.HEALTH_SERVICE_META} {
+		resp, err := health.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Fatalf("%q is %v before the server started", service, resp.Status)
+		}
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	client := newTestClient(t, cluster)
+	blockAddr := cluster.BlockStoreAddrs[0]
+
+	checkHealth(t, client, cluster.MetaAddr, "", healthpb.HealthCheckResponse_SERVING)
+	checkHealth(t, client, cluster.MetaAddr, surfstore.HEALTH_SERVICE_META, healthpb.HealthCheckResponse_SERVING)
+	checkHealth(t, client, blockAddr, surfstore.HEALTH_SERVICE_BLOCK, healthpb.HealthCheckResponse_SERVING)
+
+	// Services the server doesn't host are unknown
+	if _, err := client.CheckHealthContext(context.Background(), blockAddr, surfstore.HEALTH_SERVICE_META); status.Code(err) != codes.NotFound {
+		t.Fatalf("checking the meta service on a BlockStore returned %v", err)
+	}
+
+	// A draining server stays NOT_SERVING, while its RPCs still succeed
+	health := cluster.Health(cluster.MetaAddr)
+	health.Drain()
+	health.SetServing()
+	checkHealth(t, client, cluster.MetaAddr, "", healthpb.HealthCheckResponse_NOT_SERVING)
+	checkHealth(t, client, cluster.MetaAddr, surfstore.HEALTH_SERVICE_META, healthpb.HealthCheckResponse_NOT_SERVING)
+	checkHealth(t, client, blockAddr, surfstore.HEALTH_SERVICE_BLOCK, healthpb.HealthCheckResponse_SERVING)
+	writeTestFile(t, client, "a.txt", testContent(1, TEST_BLOCK_SIZE))
+	syncClient(t, client)
+
+	// A stopped server can't be checked, and serves again once restarted
+	cluster.Kill(cluster.MetaAddr)
+	if _, err := client.CheckHealthContext(context.Background(), cluster.MetaAddr, ""); err == nil {
+		t.Fatal("checked the health of a stopped server")
+	}
+	cluster.Restart(cluster.MetaAddr)
+	checkHealth(t, client, cluster.MetaAddr, "", healthpb.HealthCheckResponse_SERVING)
+}
@@ -0,0 +1,197 @@
+package surfstore
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A single pattern of a .surfignore file
+type ignorePattern struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreMatcher decides which paths of the base directory are excluded from syncing.
+// Patterns follow the gitignore syntax: blank lines and lines starting with # are skipped,
+// a leading ! re-includes a path, a trailing / only matches directories, a pattern without
+// a slash matches at any level and *, ?, [...] and ** behave like in git.
+type IgnoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// LoadIgnoreFile reads the .surfignore file of the base directory.
+// A missing file yields a matcher which ignores nothing.
+func LoadIgnoreFile(baseDir string) (*IgnoreMatcher, error) {
+	ignoreFile, err := os.Open(filepath.Join(baseDir, DEFAULT_IGNORE_FILENAME))
+	if os.IsNotExist(err) {
+		return &IgnoreMatcher{}, nil
+	}
+	if err != nil {
+		return &IgnoreMatcher{}, err
+	}
+	defer ignoreFile.Close()
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(ignoreFile)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return &IgnoreMatcher{}, err
+	}
+	return NewIgnoreMatcher(lines), nil
+}
+
+// NewIgnoreMatcher compiles the given gitignore-style pattern lines
+func NewIgnoreMatcher(lines []string) *IgnoreMatcher {
+	matcher := &IgnoreMatcher{}
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var pattern ignorePattern
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if len(line) == 0 {
+			continue
+		}
+		// Patterns containing a slash are relative to the base directory,
+		// the others match a name at any depth
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		expr := globToRegexp(line)
+		if !anchored && !strings.HasPrefix(line, "**/") {
+			expr = "(?:.*/)?" + expr
+		}
+		regex, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			continue
+		}
+		pattern.regex = regex
+		matcher.patterns = append(matcher.patterns, pattern)
+	}
+	return matcher
+}
+
+// Match reports whether the slash separated path, relative to the base directory, is ignored.
+// A path is also ignored when one of its parent directories is.
+func (m *IgnoreMatcher) Match(relPath string, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.matchPath(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.matchPath(relPath, isDir)
+}
+
+// The last pattern matching the path decides whether it is ignored
+func (m *IgnoreMatcher) matchPath(relPath string, isDir bool) bool {
+	ignored := false
+	for _, pattern := range m.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.regex.MatchString(relPath) {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+// Translates a gitignore glob into an (unanchored) regular expression
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				// "**/" matches zero or more directories, a trailing "**" matches everything
+				if i+2 < len(glob) && glob[i+2] == '/' {
+					sb.WriteString("(?:.*/)?")
+					i += 2
+				} else {
+					sb.WriteString(".*")
+					i++
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			// A ']' right after the opening bracket, or its negation, belongs to the class
+			start := i + 1
+			negate := start < len(glob) && (glob[start] == '!' || glob[start] == '^')
+			if negate {
+				start++
+			}
+			if start < len(glob) && glob[start] == ']' {
+				start++
+			}
+			end := strings.IndexByte(glob[start:], ']')
+			if end < 0 {
+				sb.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			end += start
+			body := glob[i+1 : end]
+			if negate {
+				// Like *, a negated class never matches the separator
+				body = "^/" + body[1:]
+			}
+			sb.WriteString("[" + globClassToRegexp(body) + "]")
+			i = end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// Escapes the characters of a bracket expression which are special in a regexp class, keeping
+// ranges and a leading ^
+func globClassToRegexp(body string) string {
+	var sb strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '^' && i == 0:
+			sb.WriteByte(c)
+		case c == '\\' && i+1 < len(body):
+			i++
+			if body[i] == '-' {
+				sb.WriteString("\\-")
+			} else {
+				sb.WriteString(regexp.QuoteMeta(string(body[i])))
+			}
+		case c == '\\' || c == '[' || c == ']' || c == '^':
+			sb.WriteString("\\" + string(c))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
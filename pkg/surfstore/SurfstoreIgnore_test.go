@@ -0,0 +1,99 @@
+package surfstore_test
+
+import (
+	"cse224/proj4/pkg/surfstore"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	for _, test := range []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		ignored  bool
+	}{
+		// A pattern without a slash matches at any depth
+		{[]string{"*.swp"}, "a.swp", false, true},
+		{[]string{"*.swp"}, "dir/sub/a.swp", false, true},
+		{[]string{"*.swp"}, "a.swp.txt", false, false},
+		{[]string{"*.swp"}, ".swp", false, true},
+		// A trailing slash only matches directories, and ignores what they hold
+		{[]string{".git/"}, ".git", true, true},
+		{[]string{".git/"}, ".git", false, false},
+		{[]string{".git/"}, ".git/config", false, true},
+		{[]string{".git/"}, "sub/.git/objects/ab", false, true},
+		// A leading slash anchors the pattern to the base directory
+		{[]string{"/build"}, "build", true, true},
+		{[]string{"/build"}, "build/out.o", false, true},
+		{[]string{"/build"}, "src/build", true, false},
+		// ** matches any number of directories, * none
+		{[]string{"**/logs/*.log"}, "logs/a.log", false, true},
+		{[]string{"**/logs/*.log"}, "x/y/logs/a.log", false, true},
+		{[]string{"**/logs/*.log"}, "logs/sub/a.log", false, false},
+		{[]string{"**/logs/*.log"}, "xlogs/a.log", false, false},
+		{[]string{"doc/*.txt"}, "doc/a.txt", false, true},
+		{[]string{"doc/*.txt"}, "doc/sub/a.txt", false, false},
+		{[]string{"doc/**"}, "doc/sub/a.txt", false, true},
+		{[]string{"a/**/b"}, "a/b", false, true},
+		{[]string{"a/**/b"}, "a/x/y/b", false, true},
+		// The last matching pattern decides, ! re-includes
+		{[]string{"*.swp", "!keep.swp"}, "keep.swp", false, false},
+		{[]string{"*.swp", "!keep.swp"}, "other.swp", false, true},
+		{[]string{"!keep.swp", "*.swp"}, "keep.swp", false, true},
+		// A file can't be re-included when its parent directory is ignored
+		{[]string{"build/", "!build/keep.txt"}, "build/keep.txt", false, true},
+		{[]string{"tmp"}, "tmp/a/b.txt", false, true},
+		// Character classes and ?
+		{[]string{"[!a]x"}, "bx", false, true},
+		{[]string{"[!a]x"}, "ax", false, false},
+		{[]string{"[!a]x"}, "dir/bx", false, true},
+		{[]string{"a[!b]c"}, "a/c", false, false},
+		{[]string{"a[^b]c"}, "axc", false, true},
+		{[]string{"a[^b]c"}, "a/c", false, false},
+		{[]string{"[]a]x"}, "]x", false, true},
+		{[]string{"[]a]x"}, "ax", false, true},
+		{[]string{"[!]]x"}, "]x", false, false},
+		{[]string{`[a\-c]x`}, "-x", false, true},
+		{[]string{`[a\-c]x`}, "bx", false, false},
+		{[]string{"[ab"}, "[ab", false, true},
+		{[]string{"[a-c].txt"}, "b.txt", false, true},
+		{[]string{"[a-c].txt"}, "d.txt", false, false},
+		{[]string{"?.txt"}, "a.txt", false, true},
+		{[]string{"?.txt"}, "ab.txt", false, false},
+		{[]string{"a?b"}, "a/b", false, false},
+		// Comments, escapes and blank lines
+		{[]string{"# comment", "", "   "}, "# comment", false, false},
+		{[]string{`\#file`}, "#file", false, true},
+		{[]string{`\!file`}, "!file", false, true},
+		{[]string{`a\*b`}, "a*b", false, true},
+		{[]string{`a\*b`}, "axb", false, false},
+		{[]string{"a.txt "}, "a.txt", false, true},
+		{[]string{"a.txt"}, "a.txtx", false, false},
+	} {
+		matcher := surfstore.NewIgnoreMatcher(test.patterns)
+		if ignored := matcher.Match(test.path, test.isDir); ignored != test.ignored {
+			t.Errorf("patterns %q, path %q (dir %v): ignored %v, expected %v", test.patterns, test.path, test.isDir, ignored, test.ignored)
+		}
+	}
+}
+
+func TestLoadIgnoreFile(t *testing.T) {
+	baseDir := t.TempDir()
+	matcher, err := surfstore.LoadIgnoreFile(baseDir)
+	if err != nil || matcher.Match("a.swp", false) {
+		t.Fatalf("missing ignore file: %v", err)
+	}
+	content := "# editor files\r\n*.swp\r\n!keep.swp\r\n"
+	if err := os.WriteFile(filepath.Join(baseDir, surfstore.DEFAULT_IGNORE_FILENAME), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	matcher, err = surfstore.LoadIgnoreFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matcher.Match("a.swp", false) || matcher.Match("keep.swp", false) {
+		t.Fatal("ignore file not applied")
+	}
+}
@@ -0,0 +1,443 @@
+package surfstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Log Local Index Related
+
+	A pure-Go backend, for builds without cgo. index.log is a header line followed by records, one
+	JSON object per line, each holding the files, stat cache entries and journal entries it adds or
+	replaces and the ones it deletes. A record is appended and synced to disk as a whole, so it is
+	the unit of atomicity: a line cut short by a crash is dropped when the log is read. Once enough
+	records have piled up, the log is compacted into a single record written to a temporary file
+	which then replaces it.
+*/
+
+func init() {
+	localIndexBackends[INDEX_BACKEND_LOG] = func(path string) LocalIndex {
+		return &logLocalIndex{path: path}
+	}
+}
+
+const INDEX_LOG_FORMAT string = "surfstore-index-log"
+const INDEX_LOG_VERSION int = 1
+
+// Records after which the log is compacted at the end of a sync
+const INDEX_LOG_COMPACT_RECORDS int = 64
+
+type indexLogHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type indexLogFile struct {
+	Version       int32    `json:"version"`
+	BlockHashList []string `json:"blockHashList"`
+	Mode          uint32   `json:"mode,omitempty"`
+	Mtime         int64    `json:"mtime,omitempty"`
+	FileType      FileType `json:"fileType,omitempty"`
+	SymlinkTarget string   `json:"symlinkTarget,omitempty"`
+}
+
+type indexLogStat struct {
+	Size      int64    `json:"size"`
+	Mtime     int64    `json:"mtime"`
+	Inode     uint64   `json:"inode"`
+	BlockSize int      `json:"blockSize"`
+	HashList  []string `json:"hashList"`
+}
+
+type indexLogJournal struct {
+	Operation      string        `json:"operation"`
+	Meta           *indexLogFile `json:"meta"`
+	UploadedBlocks []string      `json:"uploadedBlocks,omitempty"`
+	Replaced       bool          `json:"replaced,omitempty"`
+}
+
+type indexLogRecord struct {
+	Files          map[string]*indexLogFile    `json:"files,omitempty"`
+	DeletedFiles   []string                    `json:"deletedFiles,omitempty"`
+	StatCache      map[string]*indexLogStat    `json:"statCache,omitempty"`
+	DeletedStats   []string                    `json:"deletedStatCache,omitempty"`
+	Journal        map[string]*indexLogJournal `json:"journal,omitempty"`
+	DeletedJournal []string                    `json:"deletedJournal,omitempty"`
+}
+
+func (record *indexLogRecord) empty() bool {
+	return len(record.Files) == 0 && len(record.DeletedFiles) == 0 && len(record.StatCache) == 0 &&
+		len(record.DeletedStats) == 0 && len(record.Journal) == 0 && len(record.DeletedJournal) == 0
+}
+
+// The state of the index is read from the log once and then kept up to date with every record
+// appended, for the duration of a sync
+type logLocalIndex struct {
+	path      string
+	loaded    bool
+	files     map[string]*FileMetaData
+	statCache map[string]*statCacheEntry
+	journal   map[string]*journalEntry
+	// Files whose journal entries are dropped by the next writeSyncState
+	finished map[string]bool
+	// Records in the log and length of its complete lines
+	records   int
+	validSize int64
+}
+
+func (index *logLocalIndex) Backend() string {
+	return INDEX_BACKEND_LOG
+}
+
+func toIndexLogFile(meta *FileMetaData) *indexLogFile {
+	return &indexLogFile{
+		Version:       meta.Version,
+		BlockHashList: meta.BlockHashList,
+		Mode:          meta.Mode,
+		Mtime:         meta.Mtime,
+		FileType:      meta.FileType,
+		SymlinkTarget: meta.SymlinkTarget,
+	}
+}
+
+func (file *indexLogFile) toFileMetaData(fileName string) *FileMetaData {
+	blockHashList := make([]string, len(file.BlockHashList))
+	copy(blockHashList, file.BlockHashList)
+	return &FileMetaData{
+		Filename:      fileName,
+		Version:       file.Version,
+		BlockHashList: blockHashList,
+		Mode:          file.Mode,
+		Mtime:         file.Mtime,
+		FileType:      file.FileType,
+		SymlinkTarget: file.SymlinkTarget,
+	}
+}
+
+func copyFileMetaData(meta *FileMetaData) *FileMetaData {
+	return toIndexLogFile(meta).toFileMetaData(meta.Filename)
+}
+
+func toIndexLogJournal(entry *journalEntry) *indexLogJournal {
+	return &indexLogJournal{
+		Operation:      entry.operation,
+		Meta:           toIndexLogFile(entry.meta),
+		UploadedBlocks: entry.uploadedBlocks,
+		Replaced:       entry.replaced,
+	}
+}
+
+// Reads the log into memory, dropping a last line cut short by a crash
+func (index *logLocalIndex) load() error {
+	if index.loaded {
+		return nil
+	}
+	index.files = make(map[string]*FileMetaData)
+	index.statCache = make(map[string]*statCacheEntry)
+	index.journal = make(map[string]*journalEntry)
+	index.records, index.validSize = 0, 0
+	logFile, err := os.Open(index.path)
+	if os.IsNotExist(err) {
+		index.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	reader := bufio.NewReader(logFile)
+	for lineNumber := 0; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Complete lines end with a newline
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if lineNumber == 0 {
+			var header indexLogHeader
+			if err := json.Unmarshal(line, &header); err != nil || header.Format != INDEX_LOG_FORMAT {
+				return fmt.Errorf("%s is not a local index log", index.path)
+			}
+			if header.Version > INDEX_LOG_VERSION {
+				return fmt.Errorf("%s has format version %d, this client supports up to %d",
+					index.path, header.Version, INDEX_LOG_VERSION)
+			}
+		} else {
+			var record indexLogRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return fmt.Errorf("%s: corrupt record on line %d: %v", index.path, lineNumber+1, err)
+			}
+			index.apply(&record)
+			index.records++
+		}
+		index.validSize += int64(len(line))
+	}
+	index.loaded = true
+	return nil
+}
+
+// Applies a record to the state in memory
+func (index *logLocalIndex) apply(record *indexLogRecord) {
+	for _, fileName := range record.DeletedFiles {
+		delete(index.files, fileName)
+	}
+	for fileName, file := range record.Files {
+		index.files[fileName] = file.toFileMetaData(fileName)
+	}
+	for _, fileName := range record.DeletedStats {
+		delete(index.statCache, fileName)
+	}
+	for fileName, stat := range record.StatCache {
+		index.statCache[fileName] = &statCacheEntry{size: stat.Size, mtime: stat.Mtime, inode: stat.Inode,
+			blockSize: stat.BlockSize, hashList: stat.HashList}
+	}
+	for _, fileName := range record.DeletedJournal {
+		delete(index.journal, fileName)
+	}
+	for fileName, entry := range record.Journal {
+		if entry.Meta == nil {
+			continue
+		}
+		index.journal[fileName] = &journalEntry{operation: entry.Operation, meta: entry.Meta.toFileMetaData(fileName),
+			uploadedBlocks: entry.UploadedBlocks, replaced: entry.Replaced}
+	}
+}
+
+func encodeIndexLogLine(value interface{}) ([]byte, error) {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// Appends a record to the log and applies it once it is on disk. Empty records are skipped.
+func (index *logLocalIndex) append(record *indexLogRecord) error {
+	if err := index.load(); err != nil {
+		return err
+	}
+	if record.empty() && index.validSize > 0 {
+		return nil
+	}
+	line, err := encodeIndexLogLine(record)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(index.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	var buf bytes.Buffer
+	if index.validSize == 0 {
+		header, err := encodeIndexLogLine(indexLogHeader{Format: INDEX_LOG_FORMAT, Version: INDEX_LOG_VERSION})
+		if err != nil {
+			return err
+		}
+		buf.Write(header)
+	}
+	buf.Write(line)
+	// Overwrites a line cut short by an earlier crash
+	if err := logFile.Truncate(index.validSize); err != nil {
+		return err
+	}
+	if _, err := logFile.WriteAt(buf.Bytes(), index.validSize); err != nil {
+		return err
+	}
+	if err := logFile.Sync(); err != nil {
+		return err
+	}
+	index.validSize += int64(buf.Len())
+	index.records++
+	index.apply(record)
+	return nil
+}
+
+// Rewrites the log as a single record holding the current state
+func (index *logLocalIndex) compact() error {
+	record := indexLogRecord{
+		Files:     make(map[string]*indexLogFile),
+		StatCache: make(map[string]*indexLogStat),
+		Journal:   make(map[string]*indexLogJournal),
+	}
+	for fileName, meta := range index.files {
+		record.Files[fileName] = toIndexLogFile(meta)
+	}
+	for fileName, entry := range index.statCache {
+		record.StatCache[fileName] = &indexLogStat{Size: entry.size, Mtime: entry.mtime, Inode: entry.inode,
+			BlockSize: entry.blockSize, HashList: entry.hashList}
+	}
+	for fileName, entry := range index.journal {
+		record.Journal[fileName] = toIndexLogJournal(entry)
+	}
+	dir := filepath.Dir(index.path)
+	tempPath := filepath.Join(dir, "."+filepath.Base(index.path)+TEMP_FILE_MARKER+"compact")
+	compacted := &logLocalIndex{path: tempPath, loaded: true, files: make(map[string]*FileMetaData),
+		statCache: make(map[string]*statCacheEntry), journal: make(map[string]*journalEntry)}
+	os.Remove(tempPath)
+	if err := compacted.append(&record); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, index.path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	syncDir(dir)
+	index.records, index.validSize = compacted.records, compacted.validSize
+	return nil
+}
+
+func (index *logLocalIndex) LoadMeta() (map[string]*FileMetaData, error) {
+	fileMetaMap := make(map[string]*FileMetaData)
+	if err := index.load(); err != nil {
+		return fileMetaMap, err
+	}
+	for fileName, meta := range index.files {
+		fileMetaMap[fileName] = copyFileMetaData(meta)
+	}
+	return fileMetaMap, nil
+}
+
+// Returns the record turning the indexed files into fileMetas
+func (index *logLocalIndex) diffFiles(fileMetas map[string]*FileMetaData, record *indexLogRecord) {
+	record.Files = make(map[string]*indexLogFile)
+	for fileName := range index.files {
+		if _, exists := fileMetas[fileName]; !exists {
+			record.DeletedFiles = append(record.DeletedFiles, fileName)
+		}
+	}
+	for fileName, meta := range fileMetas {
+		if stored, exists := index.files[fileName]; !exists || !sameFileMetaData(stored, meta) {
+			record.Files[fileName] = toIndexLogFile(meta)
+		}
+	}
+}
+
+// Only the files which changed are written to the log
+func (index *logLocalIndex) WriteMeta(fileMetas map[string]*FileMetaData) error {
+	if err := index.load(); err != nil {
+		return err
+	}
+	var record indexLogRecord
+	index.diffFiles(fileMetas, &record)
+	return index.append(&record)
+}
+
+func (index *logLocalIndex) writeSyncState(fileMetas map[string]*FileMetaData, statCache map[string]*statCacheEntry) error {
+	if err := index.load(); err != nil {
+		return err
+	}
+	var record indexLogRecord
+	index.diffFiles(fileMetas, &record)
+	record.StatCache = make(map[string]*indexLogStat)
+	for fileName := range index.statCache {
+		if _, exists := statCache[fileName]; !exists {
+			record.DeletedStats = append(record.DeletedStats, fileName)
+		}
+	}
+	for fileName, entry := range statCache {
+		if stored, exists := index.statCache[fileName]; !exists || !stored.equals(entry) {
+			record.StatCache[fileName] = &indexLogStat{Size: entry.size, Mtime: entry.mtime, Inode: entry.inode,
+				BlockSize: entry.blockSize, HashList: entry.hashList}
+		}
+	}
+	record.DeletedJournal = sortedKeys(index.finished)
+	if err := index.append(&record); err != nil {
+		return err
+	}
+	index.finished = nil
+	if index.records > INDEX_LOG_COMPACT_RECORDS {
+		return index.compact()
+	}
+	return nil
+}
+
+func (index *logLocalIndex) loadStatCache() (map[string]*statCacheEntry, error) {
+	statCache := make(map[string]*statCacheEntry)
+	if err := index.load(); err != nil {
+		return statCache, err
+	}
+	for fileName, entry := range index.statCache {
+		copied := *entry
+		statCache[fileName] = &copied
+	}
+	return statCache, nil
+}
+
+// The log is read once and every record is appended as it is made, there is nothing to hold open
+func (index *logLocalIndex) open(writable bool) error {
+	return nil
+}
+
+func (index *logLocalIndex) close() error {
+	return nil
+}
+
+func (index *logLocalIndex) remove() error {
+	index.loaded = false
+	return os.Remove(index.path)
+}
+
+/*
+	Sync Journal
+*/
+
+func (index *logLocalIndex) loadJournal() ([]*journalEntry, error) {
+	entries := make([]*journalEntry, 0)
+	if err := index.load(); err != nil {
+		return entries, err
+	}
+	for _, entry := range index.journal {
+		copied := *entry
+		copied.meta = copyFileMetaData(entry.meta)
+		entries = append(entries, &copied)
+	}
+	return entries, nil
+}
+
+func (index *logLocalIndex) writeJournalEntry(entry *journalEntry) error {
+	delete(index.finished, entry.meta.Filename)
+	return index.append(&indexLogRecord{Journal: map[string]*indexLogJournal{entry.meta.Filename: toIndexLogJournal(entry)}})
+}
+
+// Rewrites the journal entry of the file with fn applied, if there is one
+func (index *logLocalIndex) updateJournalEntry(fileName string, fn func(entry *journalEntry)) error {
+	if err := index.load(); err != nil {
+		return err
+	}
+	stored, exists := index.journal[fileName]
+	if !exists {
+		return nil
+	}
+	updated := *stored
+	fn(&updated)
+	return index.writeJournalEntry(&updated)
+}
+
+func (index *logLocalIndex) markJournalBlocksUploaded(fileName string, uploadedBlocks []string) error {
+	return index.updateJournalEntry(fileName, func(entry *journalEntry) {
+		entry.uploadedBlocks = uploadedBlocks
+	})
+}
+
+func (index *logLocalIndex) markJournalFileReplaced(fileName string) error {
+	return index.updateJournalEntry(fileName, func(entry *journalEntry) {
+		entry.replaced = true
+	})
+}
+
+func (index *logLocalIndex) finishJournalEntry(fileName string) {
+	if index.finished == nil {
+		index.finished = make(map[string]bool)
+	}
+	index.finished[fileName] = true
+}
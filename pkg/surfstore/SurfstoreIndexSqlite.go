@@ -0,0 +1,582 @@
+//go:build cgo
+// +build cgo
+
+package surfstore
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/*
+	SQLite Local Index Related
+
+	The default backend, storing the local index in index.db through mattn/go-sqlite3, which needs
+	cgo. Builds without cgo only have the log backend (SurfstoreIndexLog.go).
+
+	The schema of index.db is versioned. The schema_version table records every migration applied
+	to the file, and openMetaDb brings older files up to date, each migration in its own transaction.
+	Index files written before the schema was versioned have no schema_version table and start at
+	version 0; their tables are kept as they are. Only writes migrate: reads open index.db read-only
+	and cope with the tables an older schema lacks, so that a dry run leaves the file untouched.
+
+	A sync opens index.db once. Its journal entries are written as they are made, each in its own
+	transaction, since they must be on disk before the operation starts. Everything else, the
+	indexed files, the stat cache and the removal of the finished journal entries, is written by a
+	single transaction at the end of the sync.
+*/
+
+func init() {
+	localIndexBackends[INDEX_BACKEND_SQLITE] = func(path string) LocalIndex {
+		return &sqliteLocalIndex{path: path}
+	}
+}
+
+const createSchemaVersionTable string = `create table if not exists schema_version (
+		version INT PRIMARY KEY
+	);`
+
+const getSchemaVersion string = `select max(version) from schema_version;`
+
+const countTables string = `select count(*) from sqlite_master where type = 'table' and name = ?;`
+
+const insertSchemaVersion string = `insert into schema_version (version) VALUES (?);`
+
+const createTable string = `create table if not exists indexes (
+		fileName TEXT,
+		version INT,
+		hashIndex INT,
+		hashValue TEXT
+	);`
+
+// Rows of a file are looked up, replaced and deleted by file name, in hash index order
+const createIndexesFileNameIndex string = `create unique index if not exists indexes_fileName_hashIndex on indexes (fileName, hashIndex);`
+
+// insert into indexes (fileName, version, hashIndex, hashValue) VALUES ("test.jpg", 1, 1, "aggr");
+const insertTuple string = `insert into indexes (fileName, version, hashIndex, hashValue) VALUES (?, ?, ?, ?);`
+
+const deleteTuplesByFileName string = `delete from indexes where fileName = ?;`
+
+const getTuples string = `select fileName, version, hashValue from indexes order by fileName, hashIndex ASC;`
+
+// File attributes (mode, modification time, file type and symlink target) are kept apart from
+// the hash list rows of the indexes table, one row per file
+const createFileAttrsTable string = `create table if not exists fileattrs (
+		fileName TEXT PRIMARY KEY,
+		mode INT,
+		mtime INT,
+		fileType INT,
+		symlinkTarget TEXT
+	);`
+
+const insertFileAttrs string = `insert or replace into fileattrs (fileName, mode, mtime, fileType, symlinkTarget) VALUES (?, ?, ?, ?, ?);`
+
+const deleteFileAttrsByFileName string = `delete from fileattrs where fileName = ?;`
+
+const getFileAttrs string = `select fileName, mode, mtime, fileType, symlinkTarget from fileattrs;`
+
+const createJournalTable string = `create table if not exists journal (
+		fileName TEXT PRIMARY KEY,
+		operation TEXT,
+		version INT,
+		hashList TEXT,
+		mode INT,
+		mtime INT,
+		fileType INT,
+		symlinkTarget TEXT,
+		uploadedBlocks TEXT,
+		replaced INT
+	);`
+
+const insertJournalEntry string = `insert or replace into journal (fileName, operation, version, hashList, mode, mtime, fileType, symlinkTarget, uploadedBlocks, replaced) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+const getJournalEntries string = `select fileName, operation, version, hashList, mode, mtime, fileType, symlinkTarget, uploadedBlocks, replaced from journal;`
+
+const deleteJournalEntry string = `delete from journal where fileName = ?;`
+
+const updateJournalUploadedBlocks string = `update journal set uploadedBlocks = ? where fileName = ?;`
+
+const updateJournalReplaced string = `update journal set replaced = 1 where fileName = ?;`
+
+const createStatCacheTable string = `create table if not exists statcache (
+		fileName TEXT PRIMARY KEY,
+		size INT,
+		mtime INT,
+		inode INT,
+		blockSize INT,
+		hashList TEXT
+	);`
+
+const getStatCacheEntries string = `select fileName, size, mtime, inode, blockSize, hashList from statcache;`
+
+const deleteStatCacheEntry string = `delete from statcache where fileName = ?;`
+
+const insertStatCacheEntry string = `insert or replace into statcache (fileName, size, mtime, inode, blockSize, hashList) VALUES (?, ?, ?, ?, ?, ?);`
+
+// Migration i brings the schema from version i to version i+1
+var metaDbMigrations = [][]string{
+	// 1: the tables, created unless an older client already did
+	{createTable, createFileAttrsTable, createJournalTable, createStatCacheTable},
+	// 2: the index of the hash list rows
+	{createIndexesFileNameIndex},
+}
+
+type sqliteLocalIndex struct {
+	path string
+	// Database shared by the reads and writes of a sync, between open and close
+	db       *sql.DB
+	readOnly bool
+	// Files whose journal entries are dropped by the next writeSyncState
+	finished map[string]bool
+}
+
+func (index *sqliteLocalIndex) Backend() string {
+	return INDEX_BACKEND_SQLITE
+}
+
+// Reports whether index.db exists, so that reading a missing index does not create it
+func (index *sqliteLocalIndex) exists() bool {
+	stats, err := os.Stat(index.path)
+	return err == nil && !stats.IsDir()
+}
+
+// Opens index.db, creating it if necessary and migrating it to the current schema
+func openMetaDb(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateMetaDb(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Opens index.db read-only, as it is. Fails if its schema is newer than this client's.
+func openMetaDbReadOnly(path string) (*sql.DB, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	uri := &url.URL{Scheme: "file", Path: filepath.ToSlash(absPath), RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite3", uri.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchemaVersion(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Fails if the schema of the database is newer than the latest migration
+func checkSchemaVersion(db *sql.DB) error {
+	var tables int
+	if err := db.QueryRow(countTables, "schema_version").Scan(&tables); err != nil || tables == 0 {
+		return err
+	}
+	var version sql.NullInt64
+	if err := db.QueryRow(getSchemaVersion).Scan(&version); err != nil {
+		return err
+	}
+	if current, latest := int(version.Int64), len(metaDbMigrations); current > latest {
+		return fmt.Errorf("%s has schema version %d, this client supports up to %d",
+			DEFAULT_META_FILENAME, current, latest)
+	}
+	return nil
+}
+
+// Reports whether the table exists, which it may not in an unmigrated index
+func tableExists(tx *sql.Tx, table string) (bool, error) {
+	var tables int
+	err := tx.QueryRow(countTables, table).Scan(&tables)
+	return tables > 0, err
+}
+
+// Applies the migrations the database is missing
+func migrateMetaDb(db *sql.DB) error {
+	if _, err := db.Exec(createSchemaVersionTable); err != nil {
+		return err
+	}
+	for {
+		applied, err := applyNextMigration(db)
+		if err != nil || !applied {
+			return err
+		}
+	}
+}
+
+// Applies the migration following the current schema version, reporting whether there was one.
+// The version is read within the transaction, so that concurrent clients apply each migration once.
+func applyNextMigration(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var version sql.NullInt64
+	if err := tx.QueryRow(getSchemaVersion).Scan(&version); err != nil {
+		return false, err
+	}
+	current, latest := int(version.Int64), len(metaDbMigrations)
+	if current > latest {
+		return false, fmt.Errorf("%s has schema version %d, this client supports up to %d",
+			DEFAULT_META_FILENAME, current, latest)
+	}
+	if current == latest {
+		return false, nil
+	}
+	for _, statement := range metaDbMigrations[current] {
+		if _, err := tx.Exec(statement); err != nil {
+			return false, fmt.Errorf("migrating %s to schema version %d: %v", DEFAULT_META_FILENAME, current+1, err)
+		}
+	}
+	if _, err := tx.Exec(insertSchemaVersion, current+1); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (index *sqliteLocalIndex) open(writable bool) error {
+	if index.db != nil {
+		return nil
+	}
+	if !writable && !index.exists() {
+		return nil
+	}
+	var db *sql.DB
+	var err error
+	if writable {
+		db, err = openMetaDb(index.path)
+	} else {
+		db, err = openMetaDbReadOnly(index.path)
+	}
+	if err != nil {
+		return err
+	}
+	index.db, index.readOnly = db, !writable
+	return nil
+}
+
+func (index *sqliteLocalIndex) close() error {
+	if index.db == nil {
+		return nil
+	}
+	err := index.db.Close()
+	index.db = nil
+	return err
+}
+
+// Runs fn in a single transaction, committed if it succeeds
+func (index *sqliteLocalIndex) update(fn func(tx *sql.Tx) error) error {
+	db := index.db
+	if db == nil || index.readOnly {
+		var err error
+		if db, err = openMetaDb(index.path); err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Runs fn in a read transaction on the index opened read-only, unless it does not exist yet
+func (index *sqliteLocalIndex) view(fn func(tx *sql.Tx) error) error {
+	db := index.db
+	if db == nil {
+		if !index.exists() {
+			return nil
+		}
+		var err error
+		if db, err = openMetaDbReadOnly(index.path); err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+func (index *sqliteLocalIndex) LoadMeta() (map[string]*FileMetaData, error) {
+	fileMetaMap := make(map[string]*FileMetaData)
+	err := index.view(func(tx *sql.Tx) error {
+		var err error
+		fileMetaMap, err = loadMetaTx(tx)
+		return err
+	})
+	return fileMetaMap, err
+}
+
+// Only the rows of files which changed since the index was loaded are written
+func (index *sqliteLocalIndex) WriteMeta(fileMetas map[string]*FileMetaData) error {
+	return index.update(func(tx *sql.Tx) error {
+		return writeMetaFileTx(tx, fileMetas)
+	})
+}
+
+func (index *sqliteLocalIndex) writeSyncState(fileMetas map[string]*FileMetaData, statCache map[string]*statCacheEntry) error {
+	err := index.update(func(tx *sql.Tx) error {
+		if err := writeMetaFileTx(tx, fileMetas); err != nil {
+			return err
+		}
+		if err := writeStatCacheTx(tx, statCache); err != nil {
+			return err
+		}
+		for fileName := range index.finished {
+			if _, err := tx.Exec(deleteJournalEntry, fileName); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		index.finished = nil
+	}
+	return err
+}
+
+func (index *sqliteLocalIndex) remove() error {
+	index.close()
+	return os.Remove(index.path)
+}
+
+// Reads the file meta map from the indexes and fileattrs tables, either of which may be missing
+func loadMetaTx(tx *sql.Tx) (map[string]*FileMetaData, error) {
+	fileMetaMap := make(map[string]*FileMetaData)
+	if exists, err := tableExists(tx, "indexes"); err != nil || !exists {
+		return fileMetaMap, err
+	}
+	rows, err := tx.Query(getTuples)
+	if err != nil {
+		return fileMetaMap, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fileName, hashValue string
+		var version int32
+		if err := rows.Scan(&fileName, &version, &hashValue); err != nil {
+			return fileMetaMap, err
+		}
+		fileMetaData, exists := fileMetaMap[fileName]
+		if !exists {
+			fileMetaData = &FileMetaData{Filename: fileName, Version: version, BlockHashList: make([]string, 0)}
+			fileMetaMap[fileName] = fileMetaData
+		}
+		fileMetaData.BlockHashList = append(fileMetaData.BlockHashList, hashValue)
+	}
+	if err := rows.Err(); err != nil {
+		return fileMetaMap, err
+	}
+	if exists, err := tableExists(tx, "fileattrs"); err != nil || !exists {
+		return fileMetaMap, err
+	}
+	attrRows, err := tx.Query(getFileAttrs)
+	if err != nil {
+		return fileMetaMap, err
+	}
+	defer attrRows.Close()
+	for attrRows.Next() {
+		var fileName string
+		var mode uint32
+		var mtime int64
+		var fileType int32
+		var symlinkTarget string
+		if err := attrRows.Scan(&fileName, &mode, &mtime, &fileType, &symlinkTarget); err != nil {
+			return fileMetaMap, err
+		}
+		if fileMetaData, exists := fileMetaMap[fileName]; exists {
+			fileMetaData.Mode = mode
+			fileMetaData.Mtime = mtime
+			fileMetaData.FileType = FileType(fileType)
+			fileMetaData.SymlinkTarget = symlinkTarget
+		}
+	}
+	return fileMetaMap, attrRows.Err()
+}
+
+// Brings the indexes and fileattrs tables in line with the file meta map
+func writeMetaFileTx(tx *sql.Tx, fileMetas map[string]*FileMetaData) error {
+	storedMetas, err := loadMetaTx(tx)
+	if err != nil {
+		return err
+	}
+	for fileName := range storedMetas {
+		if _, exists := fileMetas[fileName]; exists {
+			continue
+		}
+		if _, err := tx.Exec(deleteTuplesByFileName, fileName); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(deleteFileAttrsByFileName, fileName); err != nil {
+			return err
+		}
+	}
+	for fileName, fileMetaData := range fileMetas {
+		if storedMeta, exists := storedMetas[fileName]; exists && sameFileMetaData(storedMeta, fileMetaData) {
+			continue
+		}
+		if err := replaceFileMetaTx(tx, fileName, fileMetaData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the hash list rows and the attributes of a single file
+func replaceFileMetaTx(tx *sql.Tx, fileName string, fileMetaData *FileMetaData) error {
+	if _, err := tx.Exec(deleteTuplesByFileName, fileName); err != nil {
+		return err
+	}
+	for hashIndex, hash := range fileMetaData.BlockHashList {
+		if _, err := tx.Exec(insertTuple, fileName, fileMetaData.Version, hashIndex, hash); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(insertFileAttrs, fileName, fileMetaData.Mode, fileMetaData.Mtime, fileMetaData.FileType,
+		fileMetaData.SymlinkTarget)
+	return err
+}
+
+/*
+	Stat Cache
+*/
+
+func (index *sqliteLocalIndex) loadStatCache() (map[string]*statCacheEntry, error) {
+	statCache := make(map[string]*statCacheEntry)
+	err := index.view(func(tx *sql.Tx) error {
+		var err error
+		statCache, err = loadStatCacheTx(tx)
+		return err
+	})
+	return statCache, err
+}
+
+// Reads the statcache table, if it exists
+func loadStatCacheTx(tx *sql.Tx) (map[string]*statCacheEntry, error) {
+	statCache := make(map[string]*statCacheEntry)
+	if exists, err := tableExists(tx, "statcache"); err != nil || !exists {
+		return statCache, err
+	}
+	rows, err := tx.Query(getStatCacheEntries)
+	if err != nil {
+		return statCache, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fileName, hashList string
+		var entry statCacheEntry
+		if err := rows.Scan(&fileName, &entry.size, &entry.mtime, &entry.inode, &entry.blockSize, &hashList); err != nil {
+			return statCache, err
+		}
+		entry.hashList = splitHashes(hashList)
+		statCache[fileName] = &entry
+	}
+	return statCache, rows.Err()
+}
+
+// Brings the statcache table in line with the stat cache, writing only the entries which changed
+func writeStatCacheTx(tx *sql.Tx, statCache map[string]*statCacheEntry) error {
+	storedCache, err := loadStatCacheTx(tx)
+	if err != nil {
+		return err
+	}
+	for fileName := range storedCache {
+		if _, exists := statCache[fileName]; !exists {
+			if _, err := tx.Exec(deleteStatCacheEntry, fileName); err != nil {
+				return err
+			}
+		}
+	}
+	for fileName, entry := range statCache {
+		if stored, exists := storedCache[fileName]; exists && stored.equals(entry) {
+			continue
+		}
+		if _, err := tx.Exec(insertStatCacheEntry, fileName, entry.size, entry.mtime, entry.inode,
+			entry.blockSize, joinHashes(entry.hashList)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	Sync Journal
+*/
+
+func (index *sqliteLocalIndex) writeJournalEntry(entry *journalEntry) error {
+	delete(index.finished, entry.meta.Filename)
+	return index.update(func(tx *sql.Tx) error {
+		meta := entry.meta
+		_, err := tx.Exec(insertJournalEntry, meta.Filename, entry.operation, meta.Version, joinHashes(meta.BlockHashList),
+			meta.Mode, meta.Mtime, meta.FileType, meta.SymlinkTarget, joinHashes(entry.uploadedBlocks), entry.replaced)
+		return err
+	})
+}
+
+func (index *sqliteLocalIndex) markJournalBlocksUploaded(fileName string, uploadedBlocks []string) error {
+	return index.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(updateJournalUploadedBlocks, joinHashes(uploadedBlocks), fileName)
+		return err
+	})
+}
+
+func (index *sqliteLocalIndex) markJournalFileReplaced(fileName string) error {
+	return index.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(updateJournalReplaced, fileName)
+		return err
+	})
+}
+
+func (index *sqliteLocalIndex) finishJournalEntry(fileName string) {
+	if index.finished == nil {
+		index.finished = make(map[string]bool)
+	}
+	index.finished[fileName] = true
+}
+
+func (index *sqliteLocalIndex) loadJournal() ([]*journalEntry, error) {
+	entries := make([]*journalEntry, 0)
+	err := index.view(func(tx *sql.Tx) error {
+		if exists, err := tableExists(tx, "journal"); err != nil || !exists {
+			return err
+		}
+		rows, err := tx.Query(getJournalEntries)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			entry := journalEntry{meta: &FileMetaData{}}
+			meta := entry.meta
+			var hashList, uploadedBlocks string
+			if err := rows.Scan(&meta.Filename, &entry.operation, &meta.Version, &hashList, &meta.Mode, &meta.Mtime,
+				&meta.FileType, &meta.SymlinkTarget, &uploadedBlocks, &entry.replaced); err != nil {
+				return err
+			}
+			meta.BlockHashList = splitHashes(hashList)
+			entry.uploadedBlocks = splitHashes(uploadedBlocks)
+			entries = append(entries, &entry)
+		}
+		return rows.Err()
+	})
+	return entries, err
+}
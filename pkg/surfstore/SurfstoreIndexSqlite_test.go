@@ -0,0 +1,164 @@
+//go:build cgo
+// +build cgo
+
+package surfstore_test
+
+import (
+	"bytes"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestIndex(t *testing.T, baseDir string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(baseDir, surfstore.DEFAULT_META_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Returns the rowid of the hash list row of a file
+func indexRowId(t *testing.T, db *sql.DB, fileName string, hashIndex int) int64 {
+	t.Helper()
+	var rowId int64
+	if err := db.QueryRow(`select rowid from indexes where fileName = ? and hashIndex = ?;`, fileName, hashIndex).Scan(&rowId); err != nil {
+		t.Fatalf("row %d of %s: %v", hashIndex, fileName, err)
+	}
+	return rowId
+}
+
+func TestWriteMetaFileOnlyWritesChangedRows(t *testing.T) {
+	baseDir := t.TempDir()
+	fileMetas := map[string]*surfstore.FileMetaData{
+		"kept.txt":    {Filename: "kept.txt", Version: 1, BlockHashList: []string{"sha256:aa", "sha256:bb"}},
+		"changed.txt": {Filename: "changed.txt", Version: 1, BlockHashList: []string{"sha256:cc"}},
+		"removed.txt": {Filename: "removed.txt", Version: 3, BlockHashList: []string{"0"}},
+	}
+	if err := surfstore.WriteMetaFile(fileMetas, baseDir); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestIndex(t, baseDir)
+	keptRowId := indexRowId(t, db, "kept.txt", 1)
+
+	fileMetas["changed.txt"] = &surfstore.FileMetaData{Filename: "changed.txt", Version: 2, BlockHashList: []string{"sha256:dd"}}
+	delete(fileMetas, "removed.txt")
+	if err := surfstore.WriteMetaFile(fileMetas, baseDir); err != nil {
+		t.Fatal(err)
+	}
+	if rowId := indexRowId(t, db, "kept.txt", 1); rowId != keptRowId {
+		t.Fatalf("unchanged row rewritten, rowid %d became %d", keptRowId, rowId)
+	}
+
+	localIndex, err := surfstore.LoadMetaFromMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(localIndex) != 2 {
+		t.Fatalf("local index has %d files, expected 2", len(localIndex))
+	}
+	if meta := localIndex["changed.txt"]; meta.Version != 2 || meta.BlockHashList[0] != "sha256:dd" {
+		t.Fatalf("changed.txt stored as %v", meta)
+	}
+	if meta := localIndex["kept.txt"]; len(meta.BlockHashList) != 2 || meta.BlockHashList[1] != "sha256:bb" {
+		t.Fatalf("kept.txt stored as %v", meta)
+	}
+}
+
+// Creates an index.db as written by clients which predate the schema version table
+func writeUnversionedIndex(t *testing.T, baseDir string) *sql.DB {
+	t.Helper()
+	db := openTestIndex(t, baseDir)
+	for _, statement := range []string{
+		`create table indexes (fileName TEXT, version INT, hashIndex INT, hashValue TEXT);`,
+		`insert into indexes (fileName, version, hashIndex, hashValue) VALUES ("a.txt", 2, 0, "aa"), ("a.txt", 2, 1, "bb");`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func schemaVersionExists(t *testing.T, db *sql.DB) bool {
+	t.Helper()
+	var tables int
+	if err := db.QueryRow(`select count(*) from sqlite_master where name = 'schema_version';`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	return tables > 0
+}
+
+// Index files of clients which predate the schema version table are read as they are, and
+// migrated in place by the first write
+func TestMigrateUnversionedIndex(t *testing.T) {
+	baseDir := t.TempDir()
+	db := writeUnversionedIndex(t, baseDir)
+
+	localIndex, err := surfstore.LoadMetaFromMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, exists := localIndex["a.txt"]; !exists || meta.Version != 2 || len(meta.BlockHashList) != 2 {
+		t.Fatalf("legacy index loaded as %v", localIndex)
+	}
+	if schemaVersionExists(t, db) {
+		t.Fatal("index migrated by a read")
+	}
+
+	if err := surfstore.WriteMetaFile(localIndex, baseDir); err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err := db.QueryRow(`select max(version) from schema_version;`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version < 2 {
+		t.Fatalf("schema version %d after migration", version)
+	}
+}
+
+// A dry run reads an unversioned index without changing index.db
+func TestDryRunLeavesIndexUntouched(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	client := newTestClient(t, cluster)
+	db := writeUnversionedIndex(t, client.BaseDir)
+	writeTestFile(t, client, "b.txt", testContent(1, TEST_BLOCK_SIZE))
+	indexPath := filepath.Join(client.BaseDir, surfstore.DEFAULT_META_FILENAME)
+	before, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := surfstore.ClientSyncWithOptions(client, surfstore.SyncOptions{DryRun: true})
+	if summary.Failed() {
+		t.Fatalf("dry run failed: %v", summary.Errors)
+	}
+	after, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) || schemaVersionExists(t, db) {
+		t.Fatal("index.db changed by a dry run")
+	}
+}
+
+func TestNewerSchemaVersionIsRejected(t *testing.T) {
+	baseDir := t.TempDir()
+	if err := surfstore.WriteMetaFile(map[string]*surfstore.FileMetaData{}, baseDir); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestIndex(t, baseDir)
+	if _, err := db.Exec(`insert into schema_version (version) VALUES (1000);`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := surfstore.LoadMetaFromMetaFile(baseDir); err == nil {
+		t.Fatal("loaded an index with a newer schema version")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package surfstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the inode number of the file, or 0 if it is unknown
+func fileInode(fileInfo os.FileInfo) uint64 {
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,8 @@
+package surfstore
+
+import "os"
+
+// Inode numbers are not exposed through os.FileInfo on Windows
+func fileInode(fileInfo os.FileInfo) uint64 {
+	return 0
+}
@@ -18,6 +18,9 @@ type MetaStoreInterface interface {
 
 	// Retrieve all BlockStore Addresses
 	GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error)
+
+	// Choose the block hash algorithm among the ones the client supports
+	NegotiateHashAlgorithm(ctx context.Context, supported *HashAlgorithms) (*HashAlgorithm, error)
 }
 
 type BlockStoreInterface interface {
@@ -34,6 +37,12 @@ type BlockStoreInterface interface {
 
 	// Get which blocks are on this BlockStore server
 	GetBlockHashes(ctx context.Context, _ *emptypb.Empty) (*BlockHashes, error)
+
+	// Get a block in chunks, for blocks larger than the message size limit
+	GetBlockChunks(blockHash *BlockHash, stream BlockStore_GetBlockChunksServer) error
+
+	// Put a block sent in chunks
+	PutBlockChunks(stream BlockStore_PutBlockChunksServer) error
 }
 
 type ClientInterface interface {
@@ -42,6 +51,7 @@ type ClientInterface interface {
 	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
 	GetBlockStoreMap(blockHashesIn []string, blockStoreMap *map[string][]string) error
 	GetBlockStoreAddrs(blockStoreAddrs *[]string) error
+	NegotiateHashAlgorithm(supported []string, algorithm *string) error
 
 	// BlockStore
 	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
@@ -49,3 +59,20 @@ type ClientInterface interface {
 	HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
 	GetBlockHashes(blockStoreAddr string, blockHashes *[]string) error
 }
+
+// ClientContextInterface is the context-first variant of ClientInterface. The context cancels
+// the RPC and its retries, bounds them with its deadline and carries the outgoing gRPC metadata.
+type ClientContextInterface interface {
+	// MetaStore
+	GetFileInfoMapContext(ctx context.Context, serverFileInfoMap *map[string]*FileMetaData) error
+	UpdateFileContext(ctx context.Context, fileMetaData *FileMetaData, latestVersion *int32) error
+	GetBlockStoreMapContext(ctx context.Context, blockHashesIn []string, blockStoreMap *map[string][]string) error
+	GetBlockStoreAddrsContext(ctx context.Context, blockStoreAddrs *[]string) error
+	NegotiateHashAlgorithmContext(ctx context.Context, supported []string, algorithm *string) error
+
+	// BlockStore
+	GetBlockContext(ctx context.Context, blockHash string, blockStoreAddr string, block *Block) error
+	PutBlockContext(ctx context.Context, block *Block, blockStoreAddr string, succ *bool) error
+	HasBlocksContext(ctx context.Context, blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
+	GetBlockHashesContext(ctx context.Context, blockStoreAddr string, blockHashes *[]string) error
+}
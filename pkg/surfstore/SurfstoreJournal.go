@@ -0,0 +1,109 @@
+package surfstore
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Sync Journal Related
+
+	Every operation of a sync which changes the server or the local tree is recorded in the journal
+	of the local index before it starts. The outcomes of the finished operations are written to the
+	index at the end of the sync, together with the removal of their journal entries. If the client
+	is killed before, the next sync finds the entries and either rolls each operation forward (it
+	did take effect) or rolls it back.
+	A rolled back upload is retried by the regular sync logic, which skips the blocks the journal
+	recorded as uploaded and only asks the BlockStores about the others.
+*/
+
+// Operations recorded in the journal
+const (
+	JOURNAL_UPLOAD        string = "upload"
+	JOURNAL_DOWNLOAD      string = "download"
+	JOURNAL_DELETE_REMOTE string = "deleteRemote"
+	JOURNAL_DELETE_LOCAL  string = "deleteLocal"
+)
+
+// A pending operation on a single file
+type journalEntry struct {
+	operation string
+	// Metadata (version, hash list, attributes) of the file once the operation has been applied
+	meta *FileMetaData
+	// Blocks already stored on the BlockStores (upload)
+	uploadedBlocks []string
+	// Whether the local file has already been replaced or removed (download, deleteLocal)
+	replaced bool
+}
+
+func joinHashes(hashes []string) string {
+	return strings.Join(hashes, HASH_DELIMITER)
+}
+
+func splitHashes(hashes string) []string {
+	if len(hashes) == 0 {
+		return []string{}
+	}
+	return strings.Split(hashes, HASH_DELIMITER)
+}
+
+// Resolves the operations of an interrupted sync against the current server and local state.
+// An operation is rolled forward when it took effect, its outcome is then recorded in localIndex,
+// and rolled back otherwise, leaving the file to the regular sync logic. Returns the blocks
+// already uploaded by the rolled back uploads, keyed by file name.
+func recoverJournal(client RPCClient, index LocalIndex, localIndex map[string]*FileMetaData, remoteIndex map[string]*FileMetaData, localFiles map[string]*FileMetaData, persist bool) map[string][]string {
+	uploadedBlocks := make(map[string][]string)
+	entries, err := index.loadJournal()
+	if err != nil {
+		log.Println("Error while loading sync journal", err)
+		return uploadedBlocks
+	}
+	for _, entry := range entries {
+		fileName := entry.meta.Filename
+		remoteMeta, remoteExists := remoteIndex[fileName]
+		committedRemotely := remoteExists && remoteMeta.Version == entry.meta.Version &&
+			areEqualHashLists(remoteMeta.BlockHashList, entry.meta.BlockHashList)
+		localFile, localExists := localFiles[fileName]
+		rollForward := false
+		switch entry.operation {
+		case JOURNAL_UPLOAD, JOURNAL_DELETE_REMOTE:
+			// The server accepted the new version
+			rollForward = committedRemotely
+		case JOURNAL_DOWNLOAD:
+			// The downloaded file replaced the local one
+			rollForward = entry.replaced || (localExists && !hasLocalChanges(localFile, entry.meta))
+		case JOURNAL_DELETE_LOCAL:
+			rollForward = entry.replaced || !localExists
+		}
+		log.Println("Recovering interrupted", entry.operation, "of", fileName, "roll forward:", rollForward)
+		if rollForward {
+			localIndex[fileName] = entry.meta
+		} else if entry.operation == JOURNAL_UPLOAD {
+			uploadedBlocks[fileName] = entry.uploadedBlocks
+		}
+		if !persist {
+			continue
+		}
+		if !rollForward && entry.operation == JOURNAL_DOWNLOAD {
+			removeTempFiles(client.BaseDir, fileName)
+		}
+		index.finishJournalEntry(fileName)
+	}
+	return uploadedBlocks
+}
+
+// Removes the temporary files left behind by interrupted downloads of the file
+func removeTempFiles(baseDir string, fileName string) {
+	allFiles, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return
+	}
+	for _, file := range allFiles {
+		if strings.HasPrefix(file.Name(), "."+fileName+TEMP_FILE_MARKER) {
+			os.Remove(filepath.Join(baseDir, file.Name()))
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package surfstore_test
+
+import (
+	"bytes"
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// Returns a client whose local index is a log, so that journal entries can be planted in it
+func newJournalTestClient(t *testing.T, cluster *surfstoretest.Cluster) surfstore.RPCClient {
+	return newIndexTestClient(t, cluster, surfstore.INDEX_BACKEND_LOG)
+}
+
+// Appends a journal entry to the local index of the client, as a sync killed during the
+// operation leaves it behind
+func writeTestJournalEntry(t *testing.T, client surfstore.RPCClient, operation string, meta *surfstore.FileMetaData, replaced bool, uploadedBlocks []string) {
+	t.Helper()
+	entry := map[string]interface{}{
+		"operation": operation,
+		"meta": map[string]interface{}{
+			"version":       meta.Version,
+			"blockHashList": meta.BlockHashList,
+			"mode":          meta.Mode,
+			"mtime":         meta.Mtime,
+			"fileType":      int32(meta.FileType),
+			"symlinkTarget": meta.SymlinkTarget,
+		},
+		"uploadedBlocks": uploadedBlocks,
+		"replaced":       replaced,
+	}
+	var lines []byte
+	logPath := filepath.Join(client.BaseDir, surfstore.INDEX_LOG_FILENAME)
+	if _, err := os.Stat(logPath); os.IsNotExist(err) {
+		header, _ := json.Marshal(map[string]interface{}{"format": surfstore.INDEX_LOG_FORMAT, "version": surfstore.INDEX_LOG_VERSION})
+		lines = append(header, '\n')
+	}
+	record, err := json.Marshal(map[string]interface{}{"journal": map[string]interface{}{meta.Filename: entry}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = append(append(lines, record...), '\n')
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	if _, err := logFile.Write(lines); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Replays the journal records of the log index of the client and checks none is left pending
+func checkJournalEmpty(t *testing.T, client surfstore.RPCClient) {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(client.BaseDir, surfstore.INDEX_LOG_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := make(map[string]bool)
+	for _, line := range bytes.Split(content, []byte("\n"))[1:] {
+		if len(line) == 0 {
+			continue
+		}
+		var record struct {
+			Journal        map[string]json.RawMessage `json:"journal"`
+			DeletedJournal []string                   `json:"deletedJournal"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		for _, fileName := range record.DeletedJournal {
+			delete(pending, fileName)
+		}
+		for fileName := range record.Journal {
+			pending[fileName] = true
+		}
+	}
+	if len(pending) != 0 {
+		t.Fatalf("journal still has %v", pending)
+	}
+}
+
+func TestRecoverInterruptedUpload(t *testing.T) {
+	// The server accepted the new version before the client was killed
+	t.Run("applied", func(t *testing.T) {
+		cluster := surfstoretest.NewCluster(1)
+		defer cluster.Close()
+		alice, bob := newJournalTestClient(t, cluster), newTestClient(t, cluster)
+		writeTestFile(t, alice, "a.txt", testContent(1, 2*TEST_BLOCK_SIZE))
+		syncClient(t, alice)
+		syncClient(t, bob)
+		writeTestFile(t, bob, "a.txt", testContent(2, 2*TEST_BLOCK_SIZE))
+		syncClient(t, bob)
+
+		writeTestFile(t, alice, "a.txt", testContent(2, 2*TEST_BLOCK_SIZE))
+		published := remoteMeta(t, cluster, "a.txt")
+		writeTestJournalEntry(t, alice, surfstore.JOURNAL_UPLOAD, published, false, published.BlockHashList)
+		summary := syncClient(t, alice)
+		// Otherwise the local file would look edited since version 1 and conflict with version 2
+		checkPlan(t, summary.Plan, surfstore.SyncPlan{})
+		if len(summary.Conflicts) != 0 {
+			t.Fatalf("conflicts %v", summary.Conflicts)
+		}
+		checkIndexedVersion(t, alice.BaseDir, "a.txt", 2)
+		checkRemoteVersion(t, cluster, "a.txt", 2, false)
+		checkJournalEmpty(t, alice)
+	})
+
+	// Some blocks were stored, the version was not published
+	t.Run("rolled back", func(t *testing.T) {
+		var mutex sync.Mutex
+		askedHashes := make(map[string]bool)
+		recordHasBlocks := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if info.FullMethod == "/surfstore.BlockStore/HasBlocks" {
+				mutex.Lock()
+				for _, blockHash := range req.(*surfstore.BlockHashes).Hashes {
+					askedHashes[blockHash] = true
+				}
+				mutex.Unlock()
+			}
+			return handler(ctx, req)
+		}
+		cluster := surfstoretest.NewCluster(1, grpc.ChainUnaryInterceptor(recordHasBlocks))
+		defer cluster.Close()
+		alice, bob := newJournalTestClient(t, cluster), newTestClient(t, cluster)
+		content := testContent(1, 3*TEST_BLOCK_SIZE)
+		writeTestFile(t, alice, "a.txt", content)
+		var hashList []string
+		for i := 0; i < 3; i++ {
+			blockHash, err := surfstore.GetTaggedBlockHash(surfstore.HASH_ALGORITHM_SHA256, content[i*TEST_BLOCK_SIZE:(i+1)*TEST_BLOCK_SIZE])
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashList = append(hashList, blockHash)
+		}
+		firstBlock := content[:TEST_BLOCK_SIZE]
+		if _, err := cluster.BlockStore(cluster.BlockStoreAddrs[0]).PutBlock(context.Background(), &surfstore.Block{
+			BlockData: firstBlock, BlockSize: int32(len(firstBlock)), HashAlgorithm: surfstore.HASH_ALGORITHM_SHA256}); err != nil {
+			t.Fatal(err)
+		}
+		meta := &surfstore.FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: hashList, Mode: 0644,
+			FileType: surfstore.FileType_REGULAR}
+		writeTestJournalEntry(t, alice, surfstore.JOURNAL_UPLOAD, meta, false, hashList[:1])
+
+		summary := syncClient(t, alice)
+		checkPlan(t, summary.Plan, surfstore.SyncPlan{Upload: []string{"a.txt"}})
+		// The recorded block is neither looked up nor uploaded again
+		if summary.BytesSkipped != int64(TEST_BLOCK_SIZE) || summary.BytesUploaded != int64(2*TEST_BLOCK_SIZE) {
+			t.Fatalf("skipped %d bytes, uploaded %d bytes", summary.BytesSkipped, summary.BytesUploaded)
+		}
+		if askedHashes[hashList[0]] || !askedHashes[hashList[1]] {
+			t.Fatalf("HasBlocks asked about %v", askedHashes)
+		}
+		checkRemoteVersion(t, cluster, "a.txt", 1, false)
+		checkJournalEmpty(t, alice)
+		syncClient(t, bob)
+		checkTestFile(t, bob, "a.txt", content)
+	})
+}
+
+func TestRecoverInterruptedDownload(t *testing.T) {
+	// Returns a client at version 1 of a.txt, the server has version 2
+	setup := func(t *testing.T) (*surfstoretest.Cluster, surfstore.RPCClient) {
+		cluster := surfstoretest.NewCluster(1)
+		t.Cleanup(cluster.Close)
+		alice, bob := newTestClient(t, cluster), newJournalTestClient(t, cluster)
+		writeTestFile(t, alice, "a.txt", testContent(1, 2*TEST_BLOCK_SIZE))
+		syncClient(t, alice)
+		syncClient(t, bob)
+		writeTestFile(t, alice, "a.txt", testContent(2, 3*TEST_BLOCK_SIZE))
+		syncClient(t, alice)
+		return cluster, bob
+	}
+
+	// Killed after the downloaded file replaced the local one, whether or not that was recorded
+	for _, replaced := range []bool{true, false} {
+		replaced := replaced
+		t.Run(fmt.Sprintf("applied replaced=%v", replaced), func(t *testing.T) {
+			cluster, bob := setup(t)
+			writeTestFile(t, bob, "a.txt", testContent(2, 3*TEST_BLOCK_SIZE))
+			writeTestJournalEntry(t, bob, surfstore.JOURNAL_DOWNLOAD, remoteMeta(t, cluster, "a.txt"), replaced, nil)
+			summary := syncClient(t, bob)
+			// The new content is not mistaken for a local edit of version 1
+			checkPlan(t, summary.Plan, surfstore.SyncPlan{})
+			checkIndexedVersion(t, bob.BaseDir, "a.txt", 2)
+			checkRemoteVersion(t, cluster, "a.txt", 2, false)
+			checkJournalEmpty(t, bob)
+		})
+	}
+
+	// Killed while the blocks were written to the temporary file
+	t.Run("rolled back", func(t *testing.T) {
+		cluster, bob := setup(t)
+		tempPath := filepath.Join(bob.BaseDir, ".a.txt"+surfstore.TEMP_FILE_MARKER+"1234")
+		if err := os.WriteFile(tempPath, testContent(2, TEST_BLOCK_SIZE), 0600); err != nil {
+			t.Fatal(err)
+		}
+		writeTestJournalEntry(t, bob, surfstore.JOURNAL_DOWNLOAD, remoteMeta(t, cluster, "a.txt"), false, nil)
+		summary := syncClient(t, bob)
+		checkPlan(t, summary.Plan, surfstore.SyncPlan{Download: []string{"a.txt"}})
+		checkTestFile(t, bob, "a.txt", testContent(2, 3*TEST_BLOCK_SIZE))
+		if _, err := os.Lstat(tempPath); !os.IsNotExist(err) {
+			t.Fatalf("temporary file left behind: %v", err)
+		}
+		checkIndexedVersion(t, bob.BaseDir, "a.txt", 2)
+		checkJournalEmpty(t, bob)
+	})
+}
+
+func TestRecoverInterruptedLocalDelete(t *testing.T) {
+	// Returns a client at version 1 of a.txt, the server has deleted it in version 2
+	setup := func(t *testing.T) (*surfstoretest.Cluster, surfstore.RPCClient) {
+		cluster := surfstoretest.NewCluster(1)
+		t.Cleanup(cluster.Close)
+		alice, bob := newTestClient(t, cluster), newJournalTestClient(t, cluster)
+		writeTestFile(t, alice, "a.txt", testContent(1, 2*TEST_BLOCK_SIZE))
+		syncClient(t, alice)
+		syncClient(t, bob)
+		removeTestFile(t, alice, "a.txt")
+		syncClient(t, alice)
+		return cluster, bob
+	}
+
+	// Killed once the local file was removed
+	t.Run("applied", func(t *testing.T) {
+		cluster, bob := setup(t)
+		removeTestFile(t, bob, "a.txt")
+		writeTestJournalEntry(t, bob, surfstore.JOURNAL_DELETE_LOCAL, remoteMeta(t, cluster, "a.txt"), false, nil)
+		summary := syncClient(t, bob)
+		// The missing file is not mistaken for a local delete of version 1
+		checkPlan(t, summary.Plan, surfstore.SyncPlan{})
+		checkIndexedVersion(t, bob.BaseDir, "a.txt", 2)
+		checkRemoteVersion(t, cluster, "a.txt", 2, true)
+		checkJournalEmpty(t, bob)
+	})
+
+	// Killed before the local file was removed
+	t.Run("rolled back", func(t *testing.T) {
+		cluster, bob := setup(t)
+		writeTestJournalEntry(t, bob, surfstore.JOURNAL_DELETE_LOCAL, remoteMeta(t, cluster, "a.txt"), false, nil)
+		summary := syncClient(t, bob)
+		checkPlan(t, summary.Plan, surfstore.SyncPlan{DeleteLocal: []string{"a.txt"}})
+		checkTestFileMissing(t, bob, "a.txt")
+		checkIndexedVersion(t, bob.BaseDir, "a.txt", 2)
+		checkJournalEmpty(t, bob)
+	})
+}
+
+func TestRecoverInterruptedRemoteDelete(t *testing.T) {
+	tombstone := &surfstore.FileMetaData{Filename: "a.txt", Version: 2, BlockHashList: []string{surfstore.TOMBSTONE_HASHVALUE}}
+	// Returns a client which deleted a.txt after syncing version 1 of it
+	setup := func(t *testing.T) (*surfstoretest.Cluster, surfstore.RPCClient) {
+		cluster := surfstoretest.NewCluster(1)
+		t.Cleanup(cluster.Close)
+		alice := newJournalTestClient(t, cluster)
+		writeTestFile(t, alice, "a.txt", testContent(1, 2*TEST_BLOCK_SIZE))
+		syncClient(t, alice)
+		removeTestFile(t, alice, "a.txt")
+		return cluster, alice
+	}
+
+	// Killed once the server accepted the tombstone
+	t.Run("applied", func(t *testing.T) {
+		cluster, alice := setup(t)
+		if _, err := cluster.MetaStore().UpdateFile(context.Background(), tombstone); err != nil {
+			t.Fatal(err)
+		}
+		writeTestJournalEntry(t, alice, surfstore.JOURNAL_DELETE_REMOTE, tombstone, false, nil)
+		summary := syncClient(t, alice)
+		checkPlan(t, summary.Plan, surfstore.SyncPlan{})
+		checkIndexedVersion(t, alice.BaseDir, "a.txt", 2)
+		checkRemoteVersion(t, cluster, "a.txt", 2, true)
+		checkJournalEmpty(t, alice)
+	})
+
+	// Killed before the server got the tombstone
+	t.Run("rolled back", func(t *testing.T) {
+		cluster, alice := setup(t)
+		writeTestJournalEntry(t, alice, surfstore.JOURNAL_DELETE_REMOTE, tombstone, false, nil)
+		summary := syncClient(t, alice)
+		checkPlan(t, summary.Plan, surfstore.SyncPlan{DeleteRemote: []string{"a.txt"}})
+		checkIndexedVersion(t, alice.BaseDir, "a.txt", 2)
+		checkRemoteVersion(t, cluster, "a.txt", 2, true)
+		checkJournalEmpty(t, alice)
+	})
+}
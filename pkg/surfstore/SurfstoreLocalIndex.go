@@ -0,0 +1,214 @@
+package surfstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+	Local Index Related
+
+	The local index of a base directory records the version, hash list and attributes of every
+	synced file, the stat cache and the journal of pending operations. It is stored by one of the
+	backends below, in its own file of the base directory, so the backend of an existing base
+	directory is found from the file present. New base directories use the backend the client asks
+	for, by default SQLite when the build has cgo and the log backend otherwise.
+*/
+
+const INDEX_BACKEND_SQLITE string = "sqlite"
+const INDEX_BACKEND_LOG string = "log"
+
+// Index file of each backend, in the order existing index files are looked for
+var localIndexFiles = []struct {
+	backend  string
+	fileName string
+}{
+	{INDEX_BACKEND_SQLITE, DEFAULT_META_FILENAME},
+	{INDEX_BACKEND_LOG, INDEX_LOG_FILENAME},
+}
+
+// Backends compiled into this build, opening the index stored at path
+var localIndexBackends = map[string]func(path string) LocalIndex{}
+
+// LocalIndex stores the local index of a base directory. Reading an index which does not exist
+// yet returns an empty index without creating it.
+type LocalIndex interface {
+	// Backend returns the name of the backend storing the index
+	Backend() string
+	// LoadMeta returns the indexed files keyed by file name
+	LoadMeta() (map[string]*FileMetaData, error)
+	// WriteMeta replaces the indexed files, atomically
+	WriteMeta(fileMetas map[string]*FileMetaData) error
+
+	// Stores the indexed files and the stat cache at the end of a sync and drops the journal
+	// entries of the finished operations, atomically
+	writeSyncState(fileMetas map[string]*FileMetaData, statCache map[string]*statCacheEntry) error
+	loadStatCache() (map[string]*statCacheEntry, error)
+
+	// Reads the pending operations left behind by an interrupted sync
+	loadJournal() ([]*journalEntry, error)
+	// Records an operation before it is started
+	writeJournalEntry(entry *journalEntry) error
+	// Records the blocks of a pending upload which are stored on the BlockStores
+	markJournalBlocksUploaded(fileName string, uploadedBlocks []string) error
+	// Records that the local file of a pending download or local delete has been replaced or removed
+	markJournalFileReplaced(fileName string) error
+	// Marks the operation on the file as finished, whether or not it took effect. Its journal entry
+	// is dropped by the next writeSyncState, which stores the outcome.
+	finishJournalEntry(fileName string)
+
+	// Keeps the index open for the reads and writes of a sync, read-only unless writable, until
+	// close. Outside of a sync each call opens the index on its own.
+	open(writable bool) error
+	close() error
+
+	// Deletes the index file
+	remove() error
+}
+
+// LocalIndexBackends returns the names of the backends compiled into this build, sorted
+func LocalIndexBackends() []string {
+	names := make([]string, 0, len(localIndexBackends))
+	for name := range localIndexBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsLocalIndexBackend reports whether the backend is compiled into this build
+func IsLocalIndexBackend(backend string) bool {
+	_, exists := localIndexBackends[backend]
+	return exists
+}
+
+// DefaultLocalIndexBackend returns the backend of new base directories
+func DefaultLocalIndexBackend() string {
+	if _, exists := localIndexBackends[INDEX_BACKEND_SQLITE]; exists {
+		return INDEX_BACKEND_SQLITE
+	}
+	return INDEX_BACKEND_LOG
+}
+
+// Returns the backend whose index file is present in baseDir, or "" if there is none. Backends
+// compiled into this build are preferred, in case an interrupted migration left two index files.
+func detectLocalIndexBackend(baseDir string) string {
+	found := ""
+	for _, indexFile := range localIndexFiles {
+		if stats, err := os.Stat(filepath.Join(baseDir, indexFile.fileName)); err != nil || stats.IsDir() {
+			continue
+		}
+		if _, available := localIndexBackends[indexFile.backend]; available {
+			return indexFile.backend
+		}
+		if found == "" {
+			found = indexFile.backend
+		}
+	}
+	return found
+}
+
+func localIndexFileName(backend string) string {
+	for _, indexFile := range localIndexFiles {
+		if indexFile.backend == backend {
+			return indexFile.fileName
+		}
+	}
+	return ""
+}
+
+// Reports whether the file of the base directory belongs to a local index rather than to the
+// synced tree
+func isLocalIndexFile(fileName string) bool {
+	for _, indexFile := range localIndexFiles {
+		switch fileName {
+		case indexFile.fileName, indexFile.fileName + "-journal", indexFile.fileName + "-wal", indexFile.fileName + "-shm":
+			return true
+		}
+	}
+	return false
+}
+
+// Opens the index stored by backend at path
+func openLocalIndexFile(backend string, path string) (LocalIndex, error) {
+	newIndex, exists := localIndexBackends[backend]
+	if !exists {
+		return nil, fmt.Errorf("local index backend %q is not available in this build (available: %v)",
+			backend, LocalIndexBackends())
+	}
+	return newIndex(path), nil
+}
+
+// OpenLocalIndex opens the local index of baseDir. An existing index is opened with the backend
+// which wrote it; backend, if not empty, must then match it. A new index uses backend, or
+// DefaultLocalIndexBackend if it is empty.
+func OpenLocalIndex(baseDir string, backend string) (LocalIndex, error) {
+	existing := detectLocalIndexBackend(baseDir)
+	if existing != "" {
+		if backend != "" && backend != existing {
+			return nil, fmt.Errorf("%s has a %s local index, migrate it to %s first", baseDir, existing, backend)
+		}
+		backend = existing
+	} else if backend == "" {
+		backend = DefaultLocalIndexBackend()
+	}
+	return openLocalIndexFile(backend, filepath.Join(baseDir, localIndexFileName(backend)))
+}
+
+// MigrateLocalIndex converts the local index of baseDir to backend, keeping the indexed files,
+// the stat cache and the journal. The new index is written to a temporary file which replaces
+// the old index only once it is complete.
+func MigrateLocalIndex(baseDir string, backend string) error {
+	fileName := localIndexFileName(backend)
+	if fileName == "" {
+		return fmt.Errorf("unknown local index backend %q", backend)
+	}
+	if detectLocalIndexBackend(baseDir) == "" {
+		return fmt.Errorf("%s has no local index", baseDir)
+	}
+	source, err := OpenLocalIndex(baseDir, "")
+	if err != nil {
+		return err
+	}
+	if source.Backend() == backend {
+		return nil
+	}
+	fileMetas, err := source.LoadMeta()
+	if err != nil {
+		return err
+	}
+	statCache, err := source.loadStatCache()
+	if err != nil {
+		return err
+	}
+	entries, err := source.loadJournal()
+	if err != nil {
+		return err
+	}
+
+	tempPath := filepath.Join(baseDir, "."+fileName+TEMP_FILE_MARKER+"migrate")
+	os.Remove(tempPath)
+	target, err := openLocalIndexFile(backend, tempPath)
+	if err != nil {
+		return err
+	}
+	if err := target.writeSyncState(fileMetas, statCache); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	for _, entry := range entries {
+		if err := target.writeJournalEntry(entry); err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+	}
+	if err := os.Rename(tempPath, filepath.Join(baseDir, fileName)); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	syncDir(baseDir)
+	// Until the old index is gone both are complete, and either can be used
+	return source.remove()
+}
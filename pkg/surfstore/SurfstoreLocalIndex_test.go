@@ -0,0 +1,163 @@
+package surfstore_test
+
+import (
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Runs the test once for every backend compiled into this build
+func forEachIndexBackend(t *testing.T, test func(t *testing.T, backend string)) {
+	for _, backend := range surfstore.LocalIndexBackends() {
+		backend := backend
+		t.Run(backend, func(t *testing.T) { test(t, backend) })
+	}
+}
+
+func newIndexTestClient(t *testing.T, cluster *surfstoretest.Cluster, backend string) surfstore.RPCClient {
+	client := newTestClient(t, cluster)
+	client.IndexBackend = backend
+	return client
+}
+
+func checkIndexedVersion(t *testing.T, baseDir string, fileName string, version int32) {
+	t.Helper()
+	localIndex, err := surfstore.LoadMetaFromMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, exists := localIndex[fileName]; !exists || meta.Version != version {
+		t.Fatalf("local index has %v for %s, expected version %d", meta, fileName, version)
+	}
+}
+
+func TestLocalIndexBackends(t *testing.T) {
+	forEachIndexBackend(t, func(t *testing.T, backend string) {
+		cluster := surfstoretest.NewCluster(1)
+		defer cluster.Close()
+		alice, bob := newIndexTestClient(t, cluster, backend), newIndexTestClient(t, cluster, backend)
+
+		writeTestFile(t, alice, "a.txt", testContent(1, 2*TEST_BLOCK_SIZE))
+		writeTestFile(t, alice, "b.txt", testContent(2, 10))
+		syncClient(t, alice)
+		syncClient(t, bob)
+		checkIndexedVersion(t, bob.BaseDir, "a.txt", 1)
+
+		writeTestFile(t, bob, "a.txt", testContent(3, TEST_BLOCK_SIZE))
+		removeTestFile(t, bob, "b.txt")
+		if summary := syncClient(t, bob); len(summary.Uploaded) != 1 || len(summary.DeletedRemotely) != 1 {
+			t.Fatalf("uploaded %v, deleted %v", summary.Uploaded, summary.DeletedRemotely)
+		}
+		syncClient(t, alice)
+		checkTestFile(t, alice, "a.txt", testContent(3, TEST_BLOCK_SIZE))
+		checkTestFileMissing(t, alice, "b.txt")
+		checkIndexedVersion(t, alice.BaseDir, "b.txt", 2)
+
+		// Nothing is pending once both are in sync
+		if summary := syncClient(t, alice); len(summary.Uploaded)+len(summary.Downloaded) != 0 {
+			t.Fatalf("uploaded %v, downloaded %v", summary.Uploaded, summary.Downloaded)
+		}
+	})
+}
+
+func TestFileNamesWithQuotes(t *testing.T) {
+	forEachIndexBackend(t, func(t *testing.T, backend string) {
+		cluster := surfstoretest.NewCluster(1)
+		defer cluster.Close()
+		alice, bob := newIndexTestClient(t, cluster, backend), newIndexTestClient(t, cluster, backend)
+
+		fileName := `it's "quoted".txt`
+		content := testContent(1, 2*TEST_BLOCK_SIZE)
+		writeTestFile(t, alice, fileName, content)
+		syncClient(t, alice)
+		syncClient(t, bob)
+		checkTestFile(t, bob, fileName, content)
+		checkIndexedVersion(t, bob.BaseDir, fileName, 1)
+
+		// Unchanged on the next sync
+		if summary := syncClient(t, alice); len(summary.Uploaded) != 0 {
+			t.Fatalf("uploaded %v again", summary.Uploaded)
+		}
+	})
+}
+
+func TestMigrateLocalIndex(t *testing.T) {
+	backends := surfstore.LocalIndexBackends()
+	if len(backends) < 2 {
+		t.Skip("only", backends, "compiled in")
+	}
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	client := newIndexTestClient(t, cluster, backends[0])
+	writeTestFile(t, client, "a.txt", testContent(1, 3*TEST_BLOCK_SIZE))
+	syncClient(t, client)
+
+	for _, backend := range append(backends[1:], backends[0]) {
+		if err := surfstore.MigrateLocalIndex(client.BaseDir, backend); err != nil {
+			t.Fatal(err)
+		}
+		index, err := surfstore.OpenLocalIndex(client.BaseDir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index.Backend() != backend {
+			t.Fatalf("index uses %s after migrating to %s", index.Backend(), backend)
+		}
+		checkIndexedVersion(t, client.BaseDir, "a.txt", 1)
+		client.IndexBackend = backend
+		if summary := syncClient(t, client); len(summary.Uploaded)+len(summary.Downloaded) != 0 {
+			t.Fatalf("sync after migrating to %s uploaded %v, downloaded %v", backend, summary.Uploaded, summary.Downloaded)
+		}
+	}
+
+	// The client refuses to sync a base directory whose index has another backend
+	client.IndexBackend = backends[1]
+	if summary := surfstore.ClientSync(client); !summary.Failed() {
+		t.Fatalf("synced a %s index with the %s backend", backends[0], backends[1])
+	}
+}
+
+func TestMigrateWithoutLocalIndex(t *testing.T) {
+	if err := surfstore.MigrateLocalIndex(t.TempDir(), surfstore.INDEX_BACKEND_LOG); err == nil {
+		t.Fatal("migrated a base directory without local index")
+	}
+}
+
+// A record cut short by a crash is dropped, and overwritten by the next one
+func TestIndexLogDropsTornRecord(t *testing.T) {
+	baseDir := t.TempDir()
+	index, err := surfstore.OpenLocalIndex(baseDir, surfstore.INDEX_BACKEND_LOG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileMetas := map[string]*surfstore.FileMetaData{
+		"a.txt": {Filename: "a.txt", Version: 1, BlockHashList: []string{"sha256:aa"}},
+	}
+	if err := index.WriteMeta(fileMetas); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(baseDir, surfstore.INDEX_LOG_FILENAME)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile.WriteString(`{"files":{"b.txt":{"version":1,"blockHa`)
+	logFile.Close()
+
+	localIndex, err := surfstore.LoadMetaFromMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := localIndex["b.txt"]; exists || len(localIndex) != 1 {
+		t.Fatalf("torn record loaded: %v", localIndex)
+	}
+
+	fileMetas["c.txt"] = &surfstore.FileMetaData{Filename: "c.txt", Version: 2, BlockHashList: []string{"-1"}}
+	if err := surfstore.WriteMetaFile(fileMetas, baseDir); err != nil {
+		t.Fatal(err)
+	}
+	checkIndexedVersion(t, baseDir, "a.txt", 1)
+	checkIndexedVersion(t, baseDir, "c.txt", 2)
+}
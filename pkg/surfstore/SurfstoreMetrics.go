@@ -0,0 +1,216 @@
+package surfstore
+
+import (
+	"bytes"
+	context "context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	Server Metrics Related
+
+	Metrics collects the request counts and latencies of the RPCs a server handles, through gRPC
+	interceptors, and the size of its MetaStore and BlockStore. It serves them in the Prometheus
+	text exposition format, for a /metrics endpoint.
+*/
+
+// Upper bounds in seconds of the buckets of the RPC latency histograms
+var METRICS_LATENCY_BUCKETS = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const METRICS_CONTENT_TYPE string = "text/plain; version=0.0.4; charset=utf-8"
+
+type rpcMethod struct {
+	service string
+	method  string
+}
+
+type rpcResult struct {
+	rpcMethod
+	code string
+}
+
+type histogram struct {
+	// Observations in each bucket of METRICS_LATENCY_BUCKETS, not cumulative, the last one
+	// counting the observations above every bound
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type Metrics struct {
+	mutex     sync.Mutex
+	requests  map[rpcResult]uint64
+	latencies map[rpcMethod]*histogram
+
+	metaStore  *MetaStore
+	blockStore *BlockStore
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[rpcResult]uint64),
+		latencies: make(map[rpcMethod]*histogram),
+	}
+}
+
+// WatchMetaStore adds the number of files and the update conflicts of the MetaStore to the metrics
+func (m *Metrics) WatchMetaStore(metaStore *MetaStore) {
+	m.mutex.Lock()
+	m.metaStore = metaStore
+	m.mutex.Unlock()
+}
+
+// WatchBlockStore adds the number and total size of the blocks of the BlockStore to the metrics
+func (m *Metrics) WatchBlockStore(blockStore *BlockStore) {
+	m.mutex.Lock()
+	m.blockStore = blockStore
+	m.mutex.Unlock()
+}
+
+// Splits "/surfstore.MetaStore/UpdateFile" into its service and method
+func parseFullMethod(fullMethod string) rpcMethod {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if idx := strings.LastIndex(fullMethod, "/"); idx >= 0 {
+		return rpcMethod{service: fullMethod[:idx], method: fullMethod[idx+1:]}
+	}
+	return rpcMethod{service: "unknown", method: fullMethod}
+}
+
+// Records an RPC which took elapsed and returned err
+func (m *Metrics) observe(fullMethod string, elapsed time.Duration, err error) {
+	method := parseFullMethod(fullMethod)
+	seconds := elapsed.Seconds()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.requests[rpcResult{method, status.Code(err).String()}]++
+	h, exists := m.latencies[method]
+	if !exists {
+		h = &histogram{buckets: make([]uint64, len(METRICS_LATENCY_BUCKETS)+1)}
+		m.latencies[method] = h
+	}
+	bucket := sort.SearchFloat64s(METRICS_LATENCY_BUCKETS, seconds)
+	h.buckets[bucket]++
+	h.sum += seconds
+	h.count++
+}
+
+// UnaryServerInterceptor records the unary RPCs of a server
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.observe(info.FullMethod, time.Since(start), err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records the streaming RPCs of a server, from the start of the stream
+// to its end
+func (m *Metrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, stream)
+		m.observe(info.FullMethod, time.Since(start), err)
+		return err
+	}
+}
+
+// Escapes a label value of the text format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// Writes the metrics in the Prometheus text exposition format
+func (m *Metrics) writeText(buf *bytes.Buffer) {
+	m.mutex.Lock()
+	results := make([]rpcResult, 0, len(m.requests))
+	for result := range m.requests {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	writeMetricHeader(buf, "surfstore_rpc_requests_total", "counter", "RPCs handled, by service, method and status code.")
+	for _, result := range results {
+		fmt.Fprintf(buf, "surfstore_rpc_requests_total{service=\"%s\",method=\"%s\",code=\"%s\"} %d\n",
+			escapeLabelValue(result.service), escapeLabelValue(result.method), result.code, m.requests[result])
+	}
+
+	methods := make([]rpcMethod, 0, len(m.latencies))
+	for method := range m.latencies {
+		methods = append(methods, method)
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		if methods[i].service != methods[j].service {
+			return methods[i].service < methods[j].service
+		}
+		return methods[i].method < methods[j].method
+	})
+	writeMetricHeader(buf, "surfstore_rpc_duration_seconds", "histogram", "Time taken to handle RPCs, by service and method.")
+	for _, method := range methods {
+		h := m.latencies[method]
+		labels := fmt.Sprintf("service=\"%s\",method=\"%s\"", escapeLabelValue(method.service), escapeLabelValue(method.method))
+		var cumulative uint64
+		for i, bound := range METRICS_LATENCY_BUCKETS {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(buf, "surfstore_rpc_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(buf, "surfstore_rpc_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(buf, "surfstore_rpc_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(buf, "surfstore_rpc_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+	metaStore, blockStore := m.metaStore, m.blockStore
+	m.mutex.Unlock()
+
+	if metaStore != nil {
+		files, conflicts := metaStore.Stats()
+		writeMetricHeader(buf, "surfstore_metastore_files", "gauge", "Files in the FileMetaMap of the MetaStore, deleted ones included.")
+		fmt.Fprintf(buf, "surfstore_metastore_files %d\n", files)
+		writeMetricHeader(buf, "surfstore_metastore_update_conflicts_total", "counter", "UpdateFile calls rejected because of an outdated version.")
+		fmt.Fprintf(buf, "surfstore_metastore_update_conflicts_total %d\n", conflicts)
+	}
+	if blockStore != nil {
+		blocks, blockBytes := blockStore.Stats()
+		writeMetricHeader(buf, "surfstore_blockstore_blocks", "gauge", "Blocks in the BlockMap of the BlockStore.")
+		fmt.Fprintf(buf, "surfstore_blockstore_blocks %d\n", blocks)
+		writeMetricHeader(buf, "surfstore_blockstore_bytes", "gauge", "Total size of the blocks in the BlockMap of the BlockStore.")
+		fmt.Fprintf(buf, "surfstore_blockstore_bytes %d\n", blockBytes)
+	}
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	m.writeText(&buf)
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	w.Write(buf.Bytes())
+}
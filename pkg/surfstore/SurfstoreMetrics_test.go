@@ -0,0 +1,73 @@
+package surfstore_test
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func scrapeMetrics(t *testing.T, metrics *surfstore.Metrics) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != surfstore.METRICS_CONTENT_TYPE {
+		t.Fatalf("content type %q", contentType)
+	}
+	body, err := ioutil.ReadAll(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := surfstore.NewMetrics()
+	metaStore := surfstore.NewMetaStore(nil)
+	blockStore := surfstore.NewBlockStore()
+	metrics.WatchMetaStore(metaStore)
+	metrics.WatchBlockStore(blockStore)
+	intercept := metrics.UnaryServerInterceptor()
+	ctx := context.Background()
+
+	updateFile := &grpc.UnaryServerInfo{FullMethod: "/surfstore.MetaStore/UpdateFile"}
+	update := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return metaStore.UpdateFile(ctx, req.(*surfstore.FileMetaData))
+	}
+	for _, version := range []int32{1, 2, 2} {
+		fileMetaData := &surfstore.FileMetaData{Filename: "a.txt", Version: version, BlockHashList: []string{"-1"}}
+		if _, err := intercept(ctx, fileMetaData, updateFile, update); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getBlock := &grpc.UnaryServerInfo{FullMethod: "/surfstore.BlockStore/GetBlock"}
+	intercept(ctx, nil, getBlock, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "missing")
+	})
+	for i := 0; i < 2; i++ {
+		blockStore.PutBlock(ctx, &surfstore.Block{BlockData: []byte("hello"), BlockSize: 5, HashAlgorithm: surfstore.HASH_ALGORITHM_SHA256})
+	}
+
+	body := scrapeMetrics(t, metrics)
+	for _, expected := range []string{
+		`surfstore_rpc_requests_total{service="surfstore.MetaStore",method="UpdateFile",code="OK"} 3`,
+		`surfstore_rpc_requests_total{service="surfstore.BlockStore",method="GetBlock",code="NotFound"} 1`,
+		`surfstore_rpc_duration_seconds_bucket{service="surfstore.MetaStore",method="UpdateFile",le="+Inf"} 3`,
+		`surfstore_rpc_duration_seconds_count{service="surfstore.MetaStore",method="UpdateFile"} 3`,
+		"# TYPE surfstore_rpc_duration_seconds histogram",
+		"surfstore_metastore_files 1",
+		"surfstore_metastore_update_conflicts_total 1",
+		"surfstore_blockstore_blocks 1",
+		"surfstore_blockstore_bytes 5",
+	} {
+		if !strings.Contains(body, expected+"\n") {
+			t.Errorf("metrics lack %q:\n%s", expected, body)
+		}
+	}
+}
@@ -2,12 +2,14 @@ package surfstore
 
 import (
 	context "context"
-	"database/sql"
+	"io"
 	"log"
-	"os"
+	"strconv"
 	"time"
 
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -15,145 +17,399 @@ type RPCClient struct {
 	MetaStoreAddr string
 	BaseDir       string
 	BlockSize     int
+	// Algorithm of the block hashes, negotiated with the MetaStore by ClientSync
+	HashAlgorithm string
+	// Backend of the local index of a new base directory, DefaultLocalIndexBackend if empty.
+	// Existing indexes keep their backend, see MigrateLocalIndex.
+	IndexBackend string
+
+	// Limit the combined rate of PutBlock and GetBlock transfers, nil means unlimited
+	UploadLimiter   *RateLimiter
+	DownloadLimiter *RateLimiter
+
+	// Deadline of each attempt of an RPC, by RPC name (e.g. "GetBlock"), falling back to
+	// Timeout and then to DEFAULT_RPC_TIMEOUT
+	Timeout    time.Duration
+	OpTimeouts map[string]time.Duration
+	// Retries of failed RPCs, the zero value makes a single attempt
+	RetryPolicy RetryPolicy
+
+	// Size limits of the messages of an RPC, 0 keeps gRPC's defaults (4 MiB received, unlimited sent)
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+	// Blocks larger than ChunkSize bytes are transferred in chunks of that size, 0 means BLOCK_CHUNK_SIZE
+	ChunkSize int
+	// Largest block downloaded in chunks, 0 means DEFAULT_MAX_BLOCK_SIZE
+	MaxBlockSize int
+
+	// Extra options of the connections to the servers, such as a custom dialer
+	DialOptions []grpc.DialOption
+
+	// Records a span for every RPC, nil disables tracing
+	Tracer *Tracer
+
+	// Connections shared by every copy of the client, nil dials a connection per call
+	pool *ConnPool
 }
 
-func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
-	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+// Returns a connection to the server and the function to call with the outcome of the RPC made
+// on it. Connections of the pool are kept open unless the server was unavailable.
+func (surfClient *RPCClient) getConn(addr string) (*grpc.ClientConn, func(error), error) {
+	if surfClient.pool == nil {
+		conn, err := connectToGrpcServer(addr, surfClient.DialOptions...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, func(error) { conn.Close() }, nil
+	}
+	conn, err := surfClient.pool.Get(addr, surfClient.DialOptions...)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	return conn, func(err error) {
+		if status.Code(err) == codes.Unavailable {
+			surfClient.pool.Discard(addr, conn)
+		}
+	}, nil
+}
+
+// Close closes the pooled connections of the client and of all its copies
+func (surfClient *RPCClient) Close() error {
+	if surfClient.pool == nil {
+		return nil
+	}
+	return surfClient.pool.Close()
+}
+
+func (surfClient *RPCClient) callOptions() []grpc.CallOption {
+	opts := make([]grpc.CallOption, 0, 2)
+	if surfClient.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxCallRecvMsgSize(surfClient.MaxRecvMsgSize))
+	}
+	if surfClient.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxCallSendMsgSize(surfClient.MaxSendMsgSize))
 	}
-	c := NewBlockStoreClient(conn)
+	return opts
+}
 
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+func (surfClient *RPCClient) chunkSize() int {
+	if surfClient.ChunkSize > 0 {
+		return surfClient.ChunkSize
+	}
+	return BLOCK_CHUNK_SIZE
+}
+
+func (surfClient *RPCClient) timeout(rpcName string) time.Duration {
+	if timeout, exists := surfClient.OpTimeouts[rpcName]; exists && timeout > 0 {
+		return timeout
+	}
+	if surfClient.Timeout > 0 {
+		return surfClient.Timeout
+	}
+	return DEFAULT_RPC_TIMEOUT
+}
+
+// Performs the RPC on the server at addr, retrying it according to the retry policy. Each attempt
+// gets its own deadline within the one of ctx, the retries stop once ctx is done. A single span
+// covers all the attempts.
+func (surfClient *RPCClient) call(ctx context.Context, rpcName string, addr string, rpc func(ctx context.Context, conn *grpc.ClientConn) error) (err error) {
+	ctx, span := surfClient.Tracer.StartSpan(ctx, "RPCClient/"+rpcName, SPAN_KIND_CLIENT)
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.method", rpcName)
+	span.SetAttribute("server.address", addr)
+	defer func() {
+		span.SetAttribute("rpc.grpc.status_code", status.Code(err).String())
+		span.Finish(err)
+	}()
+
+	policy := surfClient.RetryPolicy
+	for attempt := 1; ; attempt++ {
+		err = surfClient.callOnce(ctx, rpcName, addr, rpc)
+		if err == nil || attempt >= policy.MaxAttempts || !policy.isRetryable(err) || ctx.Err() != nil {
+			span.SetAttribute("rpc.attempts", strconv.Itoa(attempt))
+			return err
+		}
+		backoff := policy.backoff(attempt)
+		log.Println("Retrying", rpcName, "on", addr, "in", backoff, "after", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (surfClient *RPCClient) callOnce(ctx context.Context, rpcName string, addr string, rpc func(ctx context.Context, conn *grpc.ClientConn) error) error {
+	conn, release, err := surfClient.getConn(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(injectTraceparent(ctx), surfClient.timeout(rpcName))
 	defer cancel()
-	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash})
+	err = rpc(ctx, conn)
+	release(err)
+	return err
+}
+
+func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
+	return surfClient.GetBlockContext(context.Background(), blockHash, blockStoreAddr, block)
+}
+
+func (surfClient *RPCClient) GetBlockContext(ctx context.Context, blockHash string, blockStoreAddr string, block *Block) error {
+	var b *Block
+	// Every attempt is charged to the limiter before it receives, the size of a whole block until
+	// the block is in
+	err := surfClient.call(ctx, "GetBlock", blockStoreAddr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		if surfClient.BlockSize <= surfClient.chunkSize() {
+			if err := surfClient.DownloadLimiter.Wait(ctx, surfClient.BlockSize); err != nil {
+				return err
+			}
+			b, err = NewBlockStoreClient(conn).GetBlock(ctx, &BlockHash{Hash: blockHash}, surfClient.callOptions()...)
+			if err == nil {
+				surfClient.DownloadLimiter.refund(surfClient.BlockSize - len(b.BlockData))
+			}
+			if status.Code(err) != codes.ResourceExhausted {
+				return err
+			}
+			// The block was stored by a client using larger blocks
+			surfClient.DownloadLimiter.refund(surfClient.BlockSize)
+		}
+		b, err = surfClient.getBlockChunks(ctx, conn, blockHash)
+		return err
+	})
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	block.BlockData = b.BlockData
 	block.BlockSize = b.BlockSize
-
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
 func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ *bool) error {
-	conn, err := connectToGrpcServer(blockStoreAddr)
-	if err != nil {
+	return surfClient.PutBlockContext(context.Background(), block, blockStoreAddr, succ)
+}
+
+func (surfClient *RPCClient) PutBlockContext(ctx context.Context, block *Block, blockStoreAddr string, succ *bool) error {
+	// Storing a block is idempotent. Every attempt is charged to the limiter before it sends.
+	var success *Success
+	err := surfClient.call(ctx, "PutBlock", blockStoreAddr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		if len(block.BlockData) > surfClient.chunkSize() {
+			success, err = surfClient.putBlockChunks(ctx, conn, block)
+		} else {
+			if err := surfClient.UploadLimiter.Wait(ctx, len(block.BlockData)); err != nil {
+				return err
+			}
+			success, err = NewBlockStoreClient(conn).PutBlock(ctx, block, surfClient.callOptions()...)
+		}
 		return err
-	}
-	rpcClient := NewBlockStoreClient(conn)
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	success, err := rpcClient.PutBlock(ctx, block)
+	})
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	*succ = success.Flag
+	return nil
+}
 
-	// close the connection
-	return conn.Close()
+func (surfClient *RPCClient) getBlockChunks(ctx context.Context, conn *grpc.ClientConn, blockHash string) (*Block, error) {
+	stream, err := NewBlockStoreClient(conn).GetBlockChunks(ctx, &BlockHash{Hash: blockHash}, surfClient.callOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	var block *Block
+	// Each chunk is charged before it is received, at the size of the first chunk (the chunk size
+	// of the client until then). The part of a chunk larger than charged is paid for at once.
+	expected := surfClient.chunkSize()
+	for {
+		charged := 0
+		if block == nil {
+			charged = expected
+		} else if remaining := int(block.BlockSize) - len(block.BlockData); remaining > 0 {
+			charged = expected
+			if remaining < charged {
+				charged = remaining
+			}
+		}
+		if err := surfClient.DownloadLimiter.Wait(ctx, charged); err != nil {
+			return nil, err
+		}
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			surfClient.DownloadLimiter.refund(charged)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if received := len(chunk.ChunkData); received < charged {
+			surfClient.DownloadLimiter.refund(charged - received)
+		} else if err := surfClient.DownloadLimiter.Wait(ctx, received-charged); err != nil {
+			return nil, err
+		}
+		if block == nil {
+			expected = len(chunk.ChunkData)
+		}
+		if block == nil {
+			if err := checkChunkedBlockSize(chunk.BlockSize, surfClient.MaxBlockSize); err != nil {
+				return nil, err
+			}
+			block = &Block{BlockData: make([]byte, 0, chunk.BlockSize), BlockSize: chunk.BlockSize}
+		}
+		if len(block.BlockData)+len(chunk.ChunkData) > int(block.BlockSize) {
+			return nil, status.Errorf(codes.DataLoss, "received more than the %d bytes of block %s", block.BlockSize, blockHash)
+		}
+		block.BlockData = append(block.BlockData, chunk.ChunkData...)
+	}
+	if block == nil || int(block.BlockSize) != len(block.BlockData) {
+		return nil, status.Errorf(codes.DataLoss, "incomplete block %s", blockHash)
+	}
+	return block, nil
 }
 
-func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
-	conn, err := connectToGrpcServer(blockStoreAddr)
+func (surfClient *RPCClient) putBlockChunks(ctx context.Context, conn *grpc.ClientConn, block *Block) (*Success, error) {
+	stream, err := NewBlockStoreClient(conn).PutBlockChunks(ctx, surfClient.callOptions()...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	rpcClient := NewBlockStoreClient(conn)
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	blockHashes, err := rpcClient.HasBlocks(ctx, &BlockHashes{Hashes: blockHashesIn})
+	blockData := block.BlockData
+	chunk := &BlockChunk{BlockSize: int32(len(blockData)), HashAlgorithm: block.HashAlgorithm}
+	for {
+		chunkSize := len(blockData)
+		if chunkSize > surfClient.chunkSize() {
+			chunkSize = surfClient.chunkSize()
+		}
+		chunk.ChunkData = blockData[:chunkSize]
+		if err := surfClient.UploadLimiter.Wait(ctx, chunkSize); err != nil {
+			stream.CloseSend()
+			return nil, err
+		}
+		if err := stream.Send(chunk); err != nil {
+			// The reason of the failure is returned by CloseAndRecv
+			break
+		}
+		blockData = blockData[chunkSize:]
+		if len(blockData) == 0 {
+			break
+		}
+		chunk = &BlockChunk{}
+	}
+	return stream.CloseAndRecv()
+}
+
+func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
+	return surfClient.HasBlocksContext(context.Background(), blockHashesIn, blockStoreAddr, blockHashesOut)
+}
+
+func (surfClient *RPCClient) HasBlocksContext(ctx context.Context, blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
+	var blockHashes *BlockHashes
+	err := surfClient.call(ctx, "HasBlocks", blockStoreAddr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		blockHashes, err = NewBlockStoreClient(conn).HasBlocks(ctx, &BlockHashes{Hashes: blockHashesIn}, surfClient.callOptions()...)
+		return err
+	})
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	*blockHashesOut = blockHashes.Hashes
-
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
 func (surfClient *RPCClient) GetBlockHashes(blockStoreAddr string, blockHashes *[]string) error {
-	conn, err := connectToGrpcServer(blockStoreAddr)
-	if err != nil {
+	return surfClient.GetBlockHashesContext(context.Background(), blockStoreAddr, blockHashes)
+}
+
+func (surfClient *RPCClient) GetBlockHashesContext(ctx context.Context, blockStoreAddr string, blockHashes *[]string) error {
+	var retBlockHashes *BlockHashes
+	err := surfClient.call(ctx, "GetBlockHashes", blockStoreAddr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		retBlockHashes, err = NewBlockStoreClient(conn).GetBlockHashes(ctx, &emptypb.Empty{}, surfClient.callOptions()...)
 		return err
-	}
-	rpcClient := NewBlockStoreClient(conn)
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	retBlockHashes, err := rpcClient.GetBlockHashes(ctx, &emptypb.Empty{})
+	})
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	*blockHashes = append(*blockHashes, retBlockHashes.Hashes...)
-
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
 func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
-	conn, err := connectToGrpcServer(surfClient.MetaStoreAddr)
-	if err != nil {
+	return surfClient.GetFileInfoMapContext(context.Background(), serverFileInfoMap)
+}
+
+func (surfClient *RPCClient) GetFileInfoMapContext(ctx context.Context, serverFileInfoMap *map[string]*FileMetaData) error {
+	var fileInfoMap *FileInfoMap
+	err := surfClient.call(ctx, "GetFileInfoMap", surfClient.MetaStoreAddr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		fileInfoMap, err = NewMetaStoreClient(conn).GetFileInfoMap(ctx, &emptypb.Empty{}, surfClient.callOptions()...)
 		return err
-	}
-	rpcClient := NewMetaStoreClient(conn)
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	fileInfoMap, err := rpcClient.GetFileInfoMap(ctx, &emptypb.Empty{})
+	})
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	*serverFileInfoMap = fileInfoMap.FileInfoMap
-
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
+// UpdateFile is not idempotent: an attempt which failed with DeadlineExceeded or Unavailable may
+// still have been applied, and its retry is then rejected with version -1. In that case the
+// version is accepted if the server's metadata is the one that was sent. Any other status means
+// the server refused the attempt.
 func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
-	conn, err := connectToGrpcServer(surfClient.MetaStoreAddr)
-	if err != nil {
+	return surfClient.UpdateFileContext(context.Background(), fileMetaData, latestVersion)
+}
+
+func (surfClient *RPCClient) UpdateFileContext(ctx context.Context, fileMetaData *FileMetaData, latestVersion *int32) error {
+	var version *Version
+	maybeApplied := false
+	err := surfClient.call(ctx, "UpdateFile", surfClient.MetaStoreAddr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		version, err = NewMetaStoreClient(conn).UpdateFile(ctx, fileMetaData, surfClient.callOptions()...)
+		if code := status.Code(err); code == codes.DeadlineExceeded || code == codes.Unavailable {
+			maybeApplied = true
+		}
 		return err
-	}
-	rpcClient := NewMetaStoreClient(conn)
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	version, err := rpcClient.UpdateFile(ctx, fileMetaData)
+	})
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	*latestVersion = version.Version
+	if version.Version == -1 && maybeApplied {
+		var remoteIndex map[string]*FileMetaData
+		if err := surfClient.GetFileInfoMapContext(ctx, &remoteIndex); err != nil {
+			return err
+		}
+		if remoteMeta, exists := remoteIndex[fileMetaData.Filename]; exists && isSameFileVersion(remoteMeta, fileMetaData) {
+			log.Println("Earlier attempt of UpdateFile of", fileMetaData.Filename, "was applied")
+			*latestVersion = fileMetaData.Version
+		}
+	}
+	return nil
+}
 
-	// close the connection
-	return conn.Close()
+// Reports whether both metadata describe the same version of a file
+func isSameFileVersion(first, second *FileMetaData) bool {
+	return first.Version == second.Version && areEqualHashLists(first.BlockHashList, second.BlockHashList) &&
+		first.FileType == second.FileType && first.SymlinkTarget == second.SymlinkTarget &&
+		first.Mode == second.Mode && first.Mtime == second.Mtime
 }
 
 func (surfClient *RPCClient) GetBlockStoreMap(blockHashesIn []string, blockStoreMap *map[string][]string) error {
-	conn, err := connectToGrpcServer(surfClient.MetaStoreAddr)
-	if err != nil {
-		return err
-	}
-	rpcClient := NewMetaStoreClient(conn)
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+	return surfClient.GetBlockStoreMapContext(context.Background(), blockHashesIn, blockStoreMap)
+}
+
+func (surfClient *RPCClient) GetBlockStoreMapContext(ctx context.Context, blockHashesIn []string, blockStoreMap *map[string][]string) error {
 	// log.Println("SurfRPClient blockHashesIn length", len(blockHashesIn))
-	var blockHashes *BlockHashes = &BlockHashes{Hashes: blockHashesIn}
-	retBlockStoreMap, err := rpcClient.GetBlockStoreMap(ctx, blockHashes)
+	var retBlockStoreMap *BlockStoreMap
+	err := surfClient.call(ctx, "GetBlockStoreMap", surfClient.MetaStoreAddr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		var blockHashes *BlockHashes = &BlockHashes{Hashes: blockHashesIn}
+		retBlockStoreMap, err = NewMetaStoreClient(conn).GetBlockStoreMap(ctx, blockHashes, surfClient.callOptions()...)
+		return err
+	})
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	(*blockStoreMap) = make(map[string][]string)
@@ -166,79 +422,65 @@ func (surfClient *RPCClient) GetBlockStoreMap(blockHashesIn []string, blockStore
 		}
 	}
 	// log.Println("rpcClient blockStoreMap", blockStoreMap)
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
 func (surfClient *RPCClient) GetBlockStoreAddrs(blockStoreAddrs *[]string) error {
-	conn, err := connectToGrpcServer(surfClient.MetaStoreAddr)
-	if err != nil {
+	return surfClient.GetBlockStoreAddrsContext(context.Background(), blockStoreAddrs)
+}
+
+func (surfClient *RPCClient) GetBlockStoreAddrsContext(ctx context.Context, blockStoreAddrs *[]string) error {
+	var retBlockStoreAddr *BlockStoreAddrs
+	err := surfClient.call(ctx, "GetBlockStoreAddrs", surfClient.MetaStoreAddr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		retBlockStoreAddr, err = NewMetaStoreClient(conn).GetBlockStoreAddrs(ctx, &emptypb.Empty{}, surfClient.callOptions()...)
 		return err
-	}
-	rpcClient := NewMetaStoreClient(conn)
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	retBlockStoreAddr, err := rpcClient.GetBlockStoreAddrs(ctx, &emptypb.Empty{})
+	})
 	// log.Println("retBlockStoreAddr", retBlockStoreAddr)
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	*blockStoreAddrs = append(*blockStoreAddrs, retBlockStoreAddr.BlockStoreAddrs...)
 	// log.Println("blockStoreAddrs", blockStoreAddrs)
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
-// This line guarantees all method for RPCClient are implemented
-var _ ClientInterface = new(RPCClient)
+func (surfClient *RPCClient) NegotiateHashAlgorithm(supported []string, algorithm *string) error {
+	return surfClient.NegotiateHashAlgorithmContext(context.Background(), supported, algorithm)
+}
 
-func createIndexDbFile(path string) error {
-	indexFile, e := os.Create(path)
-	if e != nil {
-		log.Fatal("Error During creating file", e)
-		return e
-	}
-	// log.Println("index db created")
-	indexFile.Close()
-	db, err := sql.Open("sqlite3", path)
-	defer db.Close()
-	if err != nil {
-		log.Fatal("Error during opening index.db file", err)
+func (surfClient *RPCClient) NegotiateHashAlgorithmContext(ctx context.Context, supported []string, algorithm *string) error {
+	var hashAlgorithm *HashAlgorithm
+	err := surfClient.call(ctx, "NegotiateHashAlgorithm", surfClient.MetaStoreAddr, func(ctx context.Context, conn *grpc.ClientConn) error {
+		var err error
+		hashAlgorithm, err = NewMetaStoreClient(conn).NegotiateHashAlgorithm(ctx, &HashAlgorithms{Algorithms: supported}, surfClient.callOptions()...)
 		return err
-	}
-	statement, err := db.Prepare(createTable)
+	})
 	if err != nil {
-		log.Fatal("Error During creating prepare statement for createTable", err)
-	}
-	_, err = statement.Exec()
-	if err != nil {
-		log.Fatal("Error while executing the statement", err)
 		return err
 	}
-	statement.Close()
-	// log.Println("table created")
+	*algorithm = hashAlgorithm.Algorithm
 	return nil
 }
 
+// This line guarantees all method for RPCClient are implemented
+var _ ClientInterface = new(RPCClient)
+var _ ClientContextInterface = new(RPCClient)
+
 // Create an Surfstore RPC client
+// The local index is created on the first sync, so that a dry run
+// leaves the base directory untouched.
 func NewSurfstoreRPCClient(hostPort, baseDir string, blockSize int) RPCClient {
-	outputMetaPath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
-	if _, err := os.Stat(outputMetaPath); os.IsNotExist(err) {
-		err := createIndexDbFile(outputMetaPath)
-		if err != nil {
-			log.Fatal("Error while creating index db file", err)
-		}
-	}
 	return RPCClient{
 		MetaStoreAddr: hostPort,
 		BaseDir:       baseDir,
 		BlockSize:     blockSize,
+		RetryPolicy:   DefaultRetryPolicy(),
+		pool:          NewConnPool(),
 	}
 }
 
-func connectToGrpcServer(storeAddr string) (*grpc.ClientConn, error) {
-	conn, err := grpc.Dial(storeAddr, grpc.WithInsecure())
+func connectToGrpcServer(storeAddr string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	conn, err := grpc.Dial(storeAddr, append([]grpc.DialOption{grpc.WithInsecure()}, opts...)...)
 	return conn, err
 }
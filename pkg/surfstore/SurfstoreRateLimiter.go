@@ -0,0 +1,100 @@
+package surfstore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits a byte stream to a fixed rate. It is safe for concurrent use, so a single
+// limiter caps the combined rate of all transfers sharing it. A nil *RateLimiter never waits.
+type RateLimiter struct {
+	bytesPerSec float64
+	clock       Clock
+
+	mutex sync.Mutex
+	// Point in time at which all bytes admitted so far have been paid for
+	next time.Time
+}
+
+// Clock is the time source of a RateLimiter, replaced in tests
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d, or returns ctx.Err() once the context is done
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns a limiter for the given rate, or nil (unlimited) if the rate is not positive
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return NewRateLimiterWithClock(bytesPerSec, systemClock{})
+}
+
+// Returns a limiter for the given rate measured with the clock
+func NewRateLimiterWithClock(bytesPerSec int64, clock Clock) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &RateLimiter{bytesPerSec: float64(bytesPerSec), clock: clock}
+}
+
+// Wait blocks until the bytes admitted before have been paid for at the configured rate, then
+// admits n more bytes, which delay the following callers accordingly. Idle time isn't saved up:
+// after a pause a single call of any size goes through at once. It returns ctx.Err() if the
+// context is done first, the n bytes are then given back unless later callers were admitted.
+func (limiter *RateLimiter) Wait(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if limiter == nil || n <= 0 {
+		return nil
+	}
+	limiter.mutex.Lock()
+	now := limiter.clock.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	start := limiter.next
+	end := start.Add(time.Duration(float64(n) / limiter.bytesPerSec * float64(time.Second)))
+	limiter.next = end
+	limiter.mutex.Unlock()
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	if err := limiter.clock.Sleep(ctx, delay); err != nil {
+		limiter.mutex.Lock()
+		if limiter.next.Equal(end) {
+			limiter.next = start
+		}
+		limiter.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Gives back n bytes admitted by Wait which were not transferred after all
+func (limiter *RateLimiter) refund(n int) {
+	if limiter == nil || n <= 0 {
+		return
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.next = limiter.next.Add(-time.Duration(float64(n) / limiter.bytesPerSec * float64(time.Second)))
+}
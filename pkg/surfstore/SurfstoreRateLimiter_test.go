@@ -0,0 +1,248 @@
+package surfstore_test
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A clock whose sleeps return at once, moving it forward
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+	// Sleeps in call order
+	slept []time.Duration
+	// Called by the next sleep, before it checks its context
+	onSleep func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.mutex.Lock()
+	onSleep := c.onSleep
+	c.onSleep = nil
+	c.mutex.Unlock()
+	if onSleep != nil {
+		onSleep()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	c.slept = append(c.slept, d)
+	return nil
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Returns the sleeps since the last call
+func (c *fakeClock) takeSleeps() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	slept := fmt.Sprint(c.slept)
+	c.slept = nil
+	return slept
+}
+
+func TestRateLimiterRateAndBurst(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	limiter := surfstore.NewRateLimiterWithClock(1000, clock)
+	wait := func(n int) {
+		t.Helper()
+		if err := limiter.Wait(context.Background(), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first call goes through, each following one waits for the bytes admitted before it
+	for _, n := range []int{500, 500, 1000, 250} {
+		wait(n)
+	}
+	if slept := clock.takeSleeps(); slept != "[500ms 500ms 1s]" {
+		t.Fatalf("slept %s", slept)
+	}
+
+	// Bytes which were paid for while waiting don't delay the next call
+	clock.advance(250 * time.Millisecond)
+	wait(2000)
+	if slept := clock.takeSleeps(); slept != "[]" {
+		t.Fatalf("slept %s", slept)
+	}
+
+	// Idle time isn't saved up: a burst after a pause only lets its first call through
+	clock.advance(time.Hour)
+	for _, n := range []int{4000, 100, 100} {
+		wait(n)
+	}
+	if slept := clock.takeSleeps(); slept != "[4s 100ms]" {
+		t.Fatalf("slept %s", slept)
+	}
+
+	var unlimited *surfstore.RateLimiter
+	if surfstore.NewRateLimiterWithClock(0, clock) != nil || unlimited.Wait(context.Background(), 1<<30) != nil {
+		t.Fatal("unlimited limiter waited")
+	}
+}
+
+// A canceled wait gives its bytes back
+func TestRateLimiterCancelRefunds(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	limiter := surfstore.NewRateLimiterWithClock(1000, clock)
+	if err := limiter.Wait(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	clock.onSleep = cancel
+	if err := limiter.Wait(ctx, 5000); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Wait returned %v", err)
+	}
+	if err := limiter.Wait(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if slept := clock.takeSleeps(); slept != "[1s]" {
+		t.Fatalf("slept %s", slept)
+	}
+}
+
+// A done context interrupts the wait, and the transfers waiting on the limiter fail with its error
+func TestRateLimiterWaitIsCancelable(t *testing.T) {
+	limiter := surfstore.NewRateLimiter(1)
+	if err := limiter.Wait(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := limiter.Wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Wait returned after %v", elapsed)
+	}
+
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	client := newTestClient(t, cluster)
+	client.UploadLimiter = surfstore.NewRateLimiter(1)
+	client.DownloadLimiter = surfstore.NewRateLimiter(1)
+	blockStoreAddr := cluster.BlockStoreAddrs[0]
+	blockData := testContent(1, TEST_BLOCK_SIZE)
+	blockHash, err := surfstore.GetTaggedBlockHash(surfstore.HASH_ALGORITHM_SHA256, blockData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &surfstore.Block{BlockData: blockData, BlockSize: int32(len(blockData)), HashAlgorithm: surfstore.HASH_ALGORITHM_SHA256}
+	var success bool
+	// The first transfer in each direction is admitted at once and delays the next one
+	if err := client.PutBlockContext(context.Background(), block, blockStoreAddr, &success); err != nil || !success {
+		t.Fatalf("PutBlock returned %v", err)
+	}
+	if err := client.GetBlockContext(context.Background(), blockHash, blockStoreAddr, &surfstore.Block{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.PutBlockContext(ctx, block, blockStoreAddr, &success); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("PutBlock returned %v", err)
+	}
+	var downloaded surfstore.Block
+	if err := client.GetBlockContext(ctx, blockHash, blockStoreAddr, &downloaded); err == nil || len(downloaded.BlockData) > 0 {
+		t.Fatalf("GetBlock returned %v", err)
+	}
+}
+
+// Each attempt and each chunk is charged before it is sent or received
+func TestTransfersChargedBeforeEachAttempt(t *testing.T) {
+	var putBlocks, getBlocks int32
+	failFirstPutBlock := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		switch info.FullMethod {
+		case "/surfstore.BlockStore/PutBlock":
+			if atomic.AddInt32(&putBlocks, 1) == 1 {
+				return nil, status.Error(codes.Unavailable, "injected failure")
+			}
+		case "/surfstore.BlockStore/GetBlock":
+			atomic.AddInt32(&getBlocks, 1)
+		}
+		return handler(ctx, req)
+	}
+	cluster := surfstoretest.NewCluster(1, grpc.ChainUnaryInterceptor(failFirstPutBlock))
+	defer cluster.Close()
+	client := newTestClient(t, cluster)
+	blockStoreAddr := cluster.BlockStoreAddrs[0]
+	blockData := testContent(1, TEST_BLOCK_SIZE)
+	blockHash, err := surfstore.GetTaggedBlockHash(surfstore.HASH_ALGORITHM_SHA256, blockData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &surfstore.Block{BlockData: blockData, BlockSize: int32(len(blockData)), HashAlgorithm: surfstore.HASH_ALGORITHM_SHA256}
+
+	// The retry of a failed upload pays for its bytes again
+	uploadClock := &fakeClock{now: time.Unix(1000, 0)}
+	client.UploadLimiter = surfstore.NewRateLimiterWithClock(1000, uploadClock)
+	var success bool
+	if err := client.PutBlockContext(context.Background(), block, blockStoreAddr, &success); err != nil || !success {
+		t.Fatalf("PutBlock returned %v", err)
+	}
+	if slept := uploadClock.takeSleeps(); slept != "[1.024s]" {
+		t.Fatalf("upload slept %s", slept)
+	}
+
+	// A download waits before it asks for the block
+	downloadClock := &fakeClock{now: time.Unix(1000, 0)}
+	client.DownloadLimiter = surfstore.NewRateLimiterWithClock(1000, downloadClock)
+	for i := 0; i < 2; i++ {
+		var requested int32 = -1
+		downloadClock.onSleep = func() { requested = atomic.LoadInt32(&getBlocks) }
+		if err := client.GetBlockContext(context.Background(), blockHash, blockStoreAddr, &surfstore.Block{}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && requested != 1 {
+			t.Fatalf("second download waited after %d GetBlock calls", requested)
+		}
+	}
+	if slept := downloadClock.takeSleeps(); slept != "[1.024s]" {
+		t.Fatalf("download slept %s", slept)
+	}
+
+	// Chunked transfers pay for every chunk
+	client.ChunkSize = TEST_BLOCK_SIZE / 4
+	cluster.BlockStore(blockStoreAddr).ChunkSize = TEST_BLOCK_SIZE / 4
+	uploadClock = &fakeClock{now: time.Unix(1000, 0)}
+	client.UploadLimiter = surfstore.NewRateLimiterWithClock(1000, uploadClock)
+	downloadClock = &fakeClock{now: time.Unix(1000, 0)}
+	client.DownloadLimiter = surfstore.NewRateLimiterWithClock(1000, downloadClock)
+	if err := client.PutBlockContext(context.Background(), block, blockStoreAddr, &success); err != nil || !success {
+		t.Fatalf("PutBlock returned %v", err)
+	}
+	var downloaded surfstore.Block
+	if err := client.GetBlockContext(context.Background(), blockHash, blockStoreAddr, &downloaded); err != nil {
+		t.Fatal(err)
+	}
+	for _, clock := range []*fakeClock{uploadClock, downloadClock} {
+		if slept := clock.takeSleeps(); slept != "[256ms 256ms 256ms]" {
+			t.Fatalf("chunked transfer slept %s", slept)
+		}
+	}
+}
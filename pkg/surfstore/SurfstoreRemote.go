@@ -0,0 +1,307 @@
+package surfstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+	Remote File Operations
+
+	Whole-file operations which work directly against the MetaStore and the BlockStores, without a
+	base directory or a local index. Files are split into blocks and reassembled on the caller's side,
+	blocks are routed to the BlockStores by the MetaStore's consistent hash ring.
+*/
+
+// Number of blocks written to the BlockStores at once by WriteRemoteFile
+const REMOTE_BLOCK_BATCH int = 64
+
+var ErrRemoteFileNotFound = errors.New("file not found on server")
+
+var ErrVersionConflict = errors.New("server has a different version of the file")
+
+// ListRemoteFiles returns the metadata of every file on the server which is not deleted, sorted by name
+func ListRemoteFiles(client RPCClient) ([]*FileMetaData, error) {
+	var remoteIndex map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remoteIndex); err != nil {
+		return nil, err
+	}
+	files := make([]*FileMetaData, 0, len(remoteIndex))
+	for _, fileMetaData := range remoteIndex {
+		if !isFileDeleted(fileMetaData) {
+			files = append(files, fileMetaData)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Filename < files[j].Filename
+	})
+	return files, nil
+}
+
+// GetRemoteFileMeta returns the metadata of a file on the server, including deleted files
+// (tombstones). ErrRemoteFileNotFound is returned for files the server has never seen.
+func GetRemoteFileMeta(client RPCClient, fileName string) (*FileMetaData, error) {
+	var remoteIndex map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remoteIndex); err != nil {
+		return nil, err
+	}
+	fileMetaData, exists := remoteIndex[fileName]
+	if !exists {
+		return nil, ErrRemoteFileNotFound
+	}
+	return fileMetaData, nil
+}
+
+// IsRemoteFileDeleted reports whether the metadata is the tombstone of a deleted file
+func IsRemoteFileDeleted(fileMetaData *FileMetaData) bool {
+	return isFileDeleted(fileMetaData)
+}
+
+// NextRemoteVersion returns the version which replaces the given file, 1 for a new file
+func NextRemoteVersion(fileMetaData *FileMetaData) int32 {
+	if fileMetaData == nil {
+		return 1
+	}
+	return fileMetaData.Version + 1
+}
+
+// ReadRemoteFile fetches the blocks of a regular file, verifies them and writes them to w in order.
+// Returns the number of bytes written.
+func ReadRemoteFile(client RPCClient, fileMetaData *FileMetaData, w io.Writer) (int64, error) {
+	if isFileDeleted(fileMetaData) {
+		return 0, ErrRemoteFileNotFound
+	}
+	if fileMetaData.FileType == FileType_SYMLINK {
+		return 0, fmt.Errorf("%s is a symlink to %s", fileMetaData.Filename, fileMetaData.SymlinkTarget)
+	}
+	hashList := fileMetaData.BlockHashList
+	if len(hashList) == 1 && hashList[0] == EMPTYFILE_HASHVALUE {
+		return 0, nil
+	}
+	var blockStoreMap map[string][]string
+	if err := client.GetBlockStoreMap(hashList, &blockStoreMap); err != nil {
+		return 0, err
+	}
+	revBlockStoreMap := reverseBlockStoreMap(blockStoreMap)
+	var written int64
+	for _, blockHash := range hashList {
+		blockData, err := fetchBlock(context.Background(), client, blockHash, revBlockStoreMap, nil, nil)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(blockData)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// WriteRemoteFile splits the content read from r into blocks of client.BlockSize, stores the
+// blocks the BlockStores don't have yet and publishes fileMetaData (name, version and attributes)
+// with the resulting hash list. The content of a symlink is not read. ErrVersionConflict is
+// returned when the server rejects the version.
+func WriteRemoteFile(client RPCClient, fileMetaData *FileMetaData, r io.Reader) (int32, error) {
+	if err := ValidateFileName(fileMetaData.Filename); err != nil {
+		return -1, err
+	}
+	algorithm, err := negotiateHashAlgorithm(context.Background(), client)
+	if err != nil {
+		return -1, err
+	}
+	hashList := make([]string, 0)
+	var fileSize int64
+	if fileMetaData.FileType == FileType_REGULAR {
+		pendingBlocks := make(map[string][]byte)
+		for {
+			blockData := make([]byte, client.BlockSize)
+			bytesRead, err := io.ReadFull(r, blockData)
+			if bytesRead > 0 {
+				blockData = blockData[:bytesRead]
+				fileSize += int64(bytesRead)
+				blockHash, err := GetTaggedBlockHash(algorithm, blockData)
+				if err != nil {
+					return -1, err
+				}
+				hashList = append(hashList, blockHash)
+				pendingBlocks[blockHash] = blockData
+			}
+			if len(pendingBlocks) >= REMOTE_BLOCK_BATCH {
+				if err := storeBlocks(client, pendingBlocks); err != nil {
+					return -1, err
+				}
+				pendingBlocks = make(map[string][]byte)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return -1, err
+			}
+		}
+		if err := storeBlocks(client, pendingBlocks); err != nil {
+			return -1, err
+		}
+	}
+	if len(hashList) == 0 {
+		hashList = append(hashList, EMPTYFILE_HASHVALUE)
+	}
+	fileMetaData.BlockHashList = hashList
+	fileMetaData.Size = fileSize
+	var returnedVersion int32
+	if err := client.UpdateFile(fileMetaData, &returnedVersion); err != nil {
+		return -1, err
+	}
+	if returnedVersion != fileMetaData.Version {
+		return -1, ErrVersionConflict
+	}
+	return returnedVersion, nil
+}
+
+// Stores the blocks which are not on their BlockStore yet
+func storeBlocks(client RPCClient, blocks map[string][]byte) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	hashes := make([]string, 0, len(blocks))
+	for blockHash := range blocks {
+		hashes = append(hashes, blockHash)
+	}
+	var blockStoreMap map[string][]string
+	if err := client.GetBlockStoreMap(hashes, &blockStoreMap); err != nil {
+		return err
+	}
+	if err := checkBlockStoreMap(hashes, blockStoreMap); err != nil {
+		return err
+	}
+	storedBlocks := findStoredBlocks(context.Background(), client, blockStoreMap, nil)
+	for blockStoreAddr, blockHashes := range blockStoreMap {
+		for _, blockHash := range blockHashes {
+			if storedBlocks[blockHash] {
+				continue
+			}
+			blockData := blocks[blockHash]
+			algorithm, _ := ParseBlockHash(blockHash)
+			block := &Block{BlockData: blockData, BlockSize: int32(len(blockData)), HashAlgorithm: algorithm}
+			var success bool
+			if err := client.PutBlock(block, blockStoreAddr, &success); err != nil {
+				return err
+			}
+			if !success {
+				return fmt.Errorf("storing block %s on %s failed", blockHash, blockStoreAddr)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteRemoteFile replaces the file with a tombstone of the given version
+func DeleteRemoteFile(client RPCClient, fileName string, version int32) (int32, error) {
+	if err := ValidateFileName(fileName); err != nil {
+		return -1, err
+	}
+	tombstone := &FileMetaData{Filename: fileName, Version: version, BlockHashList: []string{TOMBSTONE_HASHVALUE}}
+	var returnedVersion int32
+	if err := client.UpdateFile(tombstone, &returnedVersion); err != nil {
+		return -1, err
+	}
+	if returnedVersion != version {
+		return -1, ErrVersionConflict
+	}
+	return returnedVersion, nil
+}
+
+// UploadLocalFile publishes a local regular file or symlink as the next version of fileName on the
+// server, together with its mode and modification time
+func UploadLocalFile(client RPCClient, localPath string, fileName string) (int32, error) {
+	if err := ValidateFileName(fileName); err != nil {
+		return -1, err
+	}
+	fileStats, err := os.Lstat(localPath)
+	if err != nil {
+		return -1, err
+	}
+	fileMetaData, err := newLocalFileMetaData(filepath.Dir(localPath), fileStats)
+	if err != nil {
+		return -1, err
+	}
+	fileMetaData.Filename = fileName
+	remoteMeta, err := GetRemoteFileMeta(client, fileName)
+	if err != nil && err != ErrRemoteFileNotFound {
+		return -1, err
+	}
+	fileMetaData.Version = NextRemoteVersion(remoteMeta)
+	if fileMetaData.FileType == FileType_SYMLINK {
+		return WriteRemoteFile(client, fileMetaData, nil)
+	}
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return -1, err
+	}
+	defer localFile.Close()
+	return WriteRemoteFile(client, fileMetaData, localFile)
+}
+
+// DownloadRemoteFile writes the latest version of fileName to localPath, restoring its mode,
+// modification time or symlink target. The local file is only replaced once it is complete.
+func DownloadRemoteFile(client RPCClient, fileName string, localPath string) error {
+	remoteMeta, err := GetRemoteFileMeta(client, fileName)
+	if err != nil {
+		return err
+	}
+	if isFileDeleted(remoteMeta) {
+		return ErrRemoteFileNotFound
+	}
+	dir, base := filepath.Split(localPath)
+	if len(dir) == 0 {
+		dir = "."
+	}
+	if remoteMeta.FileType == FileType_SYMLINK {
+		tempPath, err := createTempSymlink(dir, base, remoteMeta.SymlinkTarget)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tempPath, localPath); err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+		return nil
+	}
+	tempFile, err := createTempFile(dir, base)
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	if _, err := ReadRemoteFile(client, remoteMeta, tempFile); err != nil {
+		tempFile.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if remoteMeta.Mode != 0 {
+		if err := tempFile.Chmod(os.FileMode(remoteMeta.Mode).Perm()); err != nil {
+			tempFile.Close()
+			os.Remove(tempPath)
+			return err
+		}
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if remoteMeta.Mtime != 0 {
+		mtime := time.Unix(0, remoteMeta.Mtime)
+		os.Chtimes(tempPath, mtime, mtime)
+	}
+	if err := os.Rename(tempPath, localPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package surfstore_test
+
+import (
+	"bytes"
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestValidateFileName(t *testing.T) {
+	for _, fileName := range []string{"a.txt", ".hidden", "..a", "a..b", "it's \"quoted\".txt"} {
+		if err := surfstore.ValidateFileName(fileName); err != nil {
+			t.Errorf("%q rejected: %v", fileName, err)
+		}
+	}
+	for _, fileName := range []string{"", ".", "..", "x/../../evil", "../evil", "/etc/passwd", `..\evil`, "a\x00b"} {
+		if err := surfstore.ValidateFileName(fileName); !errors.Is(err, surfstore.ErrInvalidFileName) {
+			t.Errorf("%q accepted", fileName)
+		}
+	}
+}
+
+func TestRemoteOperationsRejectInvalidNames(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	client := newTestClient(t, cluster)
+
+	fileMetaData := &surfstore.FileMetaData{Filename: "x/../../evil", Version: 1}
+	if _, err := surfstore.WriteRemoteFile(client, fileMetaData, bytes.NewReader([]byte("evil"))); !errors.Is(err, surfstore.ErrInvalidFileName) {
+		t.Fatalf("WriteRemoteFile returned %v", err)
+	}
+	if _, err := surfstore.DeleteRemoteFile(client, "..", 1); !errors.Is(err, surfstore.ErrInvalidFileName) {
+		t.Fatalf("DeleteRemoteFile returned %v", err)
+	}
+	localPath := filepath.Join(t.TempDir(), "evil")
+	if err := os.WriteFile(localPath, []byte("evil"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := surfstore.UploadLocalFile(client, localPath, "../evil"); !errors.Is(err, surfstore.ErrInvalidFileName) {
+		t.Fatalf("UploadLocalFile returned %v", err)
+	}
+
+	// The MetaStore refuses them from any client
+	invalid := &surfstore.FileMetaData{Filename: "../evil", Version: 1, BlockHashList: []string{surfstore.EMPTYFILE_HASHVALUE}}
+	if _, err := cluster.MetaStore().UpdateFile(context.Background(), invalid); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("UpdateFile returned %v", err)
+	}
+	if files, _ := cluster.MetaStore().Stats(); files != 0 {
+		t.Fatalf("%d files on the server", files)
+	}
+}
+
+// A remote entry whose name escapes the base directory is skipped by the sync
+func TestSyncSkipsInvalidRemoteNames(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice := newTestClient(t, cluster)
+	writeTestFile(t, alice, "a.txt", testContent(1, TEST_BLOCK_SIZE))
+	syncClient(t, alice)
+
+	// Planted as an older server would have accepted it
+	metaStore := cluster.MetaStore()
+	evil := proto.Clone(metaStore.FileMetaMap["a.txt"]).(*surfstore.FileMetaData)
+	evil.Filename = "x/../../evil"
+	metaStore.FileMetaMap[evil.Filename] = evil
+
+	parent := t.TempDir()
+	bob := cluster.NewClient(filepath.Join(parent, "base", "dir"), TEST_BLOCK_SIZE)
+	defer bob.Close()
+	if err := os.MkdirAll(bob.BaseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	syncClient(t, bob)
+	checkTestFile(t, bob, "a.txt", testContent(1, TEST_BLOCK_SIZE))
+	if _, err := os.Stat(filepath.Join(parent, "base", "evil")); !os.IsNotExist(err) {
+		t.Fatalf("file written outside the base directory: %v", err)
+	}
+}
+
+// A remote write whose blocks weren't all assigned a BlockStore fails instead of publishing the file
+func TestWriteRemoteFileChecksBlockStoreMap(t *testing.T) {
+	dropFirstHash := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if info.FullMethod == "/surfstore.MetaStore/GetBlockStoreMap" && err == nil {
+			for _, blockHashes := range resp.(*surfstore.BlockStoreMap).BlockStoreMap {
+				blockHashes.Hashes = blockHashes.Hashes[1:]
+			}
+		}
+		return resp, err
+	}
+	cluster := surfstoretest.NewCluster(1, grpc.ChainUnaryInterceptor(dropFirstHash))
+	defer cluster.Close()
+	client := newTestClient(t, cluster)
+
+	fileMetaData := &surfstore.FileMetaData{Filename: "a.txt", Version: 1}
+	if _, err := surfstore.WriteRemoteFile(client, fileMetaData, bytes.NewReader(testContent(1, 3*TEST_BLOCK_SIZE))); err == nil {
+		t.Fatal("WriteRemoteFile succeeded")
+	}
+	if meta := remoteMeta(t, cluster, "a.txt"); meta != nil {
+		t.Fatalf("a.txt published as %v", meta)
+	}
+}
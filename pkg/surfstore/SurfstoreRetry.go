@@ -0,0 +1,138 @@
+package surfstore
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Deadline of an RPC without a configured timeout
+const DEFAULT_RPC_TIMEOUT time.Duration = time.Second
+
+// Names of the RPCs of ClientInterface, as used in RPCClient.OpTimeouts
+var RPC_NAMES = []string{
+	"GetFileInfoMap", "UpdateFile", "GetBlockStoreMap", "GetBlockStoreAddrs", "NegotiateHashAlgorithm",
+	"GetBlock", "PutBlock", "HasBlocks", "GetBlockHashes",
+}
+
+// RetryPolicy controls how RPCClient retries a failed RPC
+type RetryPolicy struct {
+	// Number of attempts including the first one, values below 1 mean a single attempt
+	MaxAttempts int
+	// Wait before the first retry, multiplied by BackoffMultiplier after each attempt
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// Fraction of the backoff by which each wait is randomly shortened or lengthened
+	Jitter float64
+	// Status codes of the errors worth retrying
+	RetryableCodes []codes.Code
+}
+
+// DefaultRetryPolicy retries transient failures, such as a BlockStore being restarted, for about a
+// second. ResourceExhausted isn't retried: it reports a message or a block over a size limit,
+// which a retry would exceed again.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       4,
+		InitialBackoff:    100 * time.Millisecond,
+		MaxBackoff:        2 * time.Second,
+		BackoffMultiplier: 2,
+		Jitter:            0.2,
+		RetryableCodes:    []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.Aborted},
+	}
+}
+
+func (policy RetryPolicy) isRetryable(err error) bool {
+	code := status.Code(err)
+	for _, retryableCode := range policy.RetryableCodes {
+		if code == retryableCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the wait before the given retry (1 for the first one)
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	backoff := float64(policy.InitialBackoff)
+	for i := 1; i < retry; i++ {
+		backoff *= policy.BackoffMultiplier
+	}
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	backoff *= 1 + policy.Jitter*(2*rand.Float64()-1)
+	if backoff < 0 {
+		return 0
+	}
+	return time.Duration(backoff)
+}
+
+// ParseRetryCodes parses a comma separated list of status code names, such as "Unavailable,DeadlineExceeded"
+func ParseRetryCodes(names string) ([]codes.Code, error) {
+	codesByName := make(map[string]codes.Code)
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		codesByName[strings.ToLower(code.String())] = code
+	}
+	retryableCodes := make([]codes.Code, 0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		code, exists := codesByName[strings.ToLower(name)]
+		if !exists {
+			return nil, fmt.Errorf("unknown status code %q", name)
+		}
+		retryableCodes = append(retryableCodes, code)
+	}
+	return retryableCodes, nil
+}
+
+// FormatRetryCodes is the inverse of ParseRetryCodes
+func FormatRetryCodes(retryableCodes []codes.Code) string {
+	names := make([]string, 0, len(retryableCodes))
+	for _, code := range retryableCodes {
+		names = append(names, code.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseOpTimeouts parses a comma separated list of per-RPC timeouts, such as "GetBlock=30s,PutBlock=30s"
+func ParseOpTimeouts(timeouts string) (map[string]time.Duration, error) {
+	opTimeouts := make(map[string]time.Duration)
+	for _, entry := range strings.Split(timeouts, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid timeout %q, expected <rpc>=<duration>", entry)
+		}
+		rpcName := strings.TrimSpace(parts[0])
+		if !isRPCName(rpcName) {
+			return nil, fmt.Errorf("unknown RPC %q", rpcName)
+		}
+		timeout, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		opTimeouts[rpcName] = timeout
+	}
+	return opTimeouts, nil
+}
+
+func isRPCName(name string) bool {
+	for _, rpcName := range RPC_NAMES {
+		if rpcName == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package surfstore_test
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Applies the first UpdateFile, then fails it with the given status as if the response was lost
+func failFirstUpdateFile(code codes.Code) grpc.UnaryServerInterceptor {
+	var calls int32
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if info.FullMethod == "/surfstore.MetaStore/UpdateFile" && atomic.AddInt32(&calls, 1) == 1 {
+			return nil, status.Error(code, "injected failure")
+		}
+		return resp, err
+	}
+}
+
+func TestUpdateFileRetries(t *testing.T) {
+	for _, test := range []struct {
+		code     codes.Code
+		expected int32
+	}{
+		// The attempt may have been applied, the retry finds it was
+		{codes.DeadlineExceeded, 1},
+		{codes.Unavailable, 1},
+		// The server refused the attempt, an identical version published meanwhile is a conflict
+		{codes.Aborted, -1},
+	} {
+		t.Run(test.code.String(), func(t *testing.T) {
+			cluster := surfstoretest.NewCluster(1, grpc.ChainUnaryInterceptor(failFirstUpdateFile(test.code)))
+			defer cluster.Close()
+			client := newTestClient(t, cluster)
+			fileMetaData := &surfstore.FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{surfstore.EMPTYFILE_HASHVALUE}}
+			var version int32
+			if err := client.UpdateFile(fileMetaData, &version); err != nil {
+				t.Fatal(err)
+			}
+			if version != test.expected {
+				t.Fatalf("UpdateFile returned version %d, expected %d", version, test.expected)
+			}
+		})
+	}
+}
+
+func TestDefaultRetryPolicySkipsResourceExhausted(t *testing.T) {
+	for _, code := range surfstore.DefaultRetryPolicy().RetryableCodes {
+		if code == codes.ResourceExhausted {
+			t.Fatal("ResourceExhausted is retried")
+		}
+	}
+	var calls int32
+	countCalls := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/surfstore.MetaStore/GetFileInfoMap" {
+			atomic.AddInt32(&calls, 1)
+			return nil, status.Error(codes.ResourceExhausted, "injected failure")
+		}
+		return handler(ctx, req)
+	}
+	cluster := surfstoretest.NewCluster(1, grpc.ChainUnaryInterceptor(countCalls))
+	defer cluster.Close()
+	client := newTestClient(t, cluster)
+	var remoteIndex map[string]*surfstore.FileMetaData
+	if err := client.GetFileInfoMap(&remoteIndex); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("GetFileInfoMap returned %v", err)
+	}
+	if attempts := atomic.LoadInt32(&calls); attempts != 1 {
+		t.Fatalf("%d attempts", attempts)
+	}
+}
@@ -0,0 +1,49 @@
+package surfstore
+
+import (
+	"os"
+	"time"
+)
+
+/*
+	Stat Cache Related
+
+	Hashing every file on every sync is expensive for large base directories. The stat cache keeps
+	the size, modification time and inode a file had when it was last hashed, together with its hash
+	list, so that a file whose stat fields are unchanged is not read again.
+*/
+
+// Files modified this close to the scan are not cached, since a later write within the same
+// timestamp granularity would go unnoticed
+const statCacheRacyWindow = 2 * time.Second
+
+// Stat fields and hash list of a local file at the time it was hashed
+type statCacheEntry struct {
+	size      int64
+	mtime     int64
+	inode     uint64
+	blockSize int
+	hashList  []string
+}
+
+// Builds the cache entry of a regular file from its file info
+func newStatCacheEntry(fileInfo os.FileInfo, blockSize int, hashList []string) *statCacheEntry {
+	return &statCacheEntry{
+		size:      fileInfo.Size(),
+		mtime:     fileInfo.ModTime().UnixNano(),
+		inode:     fileInode(fileInfo),
+		blockSize: blockSize,
+		hashList:  hashList,
+	}
+}
+
+// Reports whether the cached hash list is still valid for the file
+func (entry *statCacheEntry) matches(other *statCacheEntry) bool {
+	return entry.size == other.size && entry.mtime == other.mtime && entry.inode == other.inode &&
+		entry.blockSize == other.blockSize
+}
+
+// Reports whether both entries store the same stat fields and hash list
+func (entry *statCacheEntry) equals(other *statCacheEntry) bool {
+	return entry.matches(other) && joinHashes(entry.hashList) == joinHashes(other.hashList)
+}
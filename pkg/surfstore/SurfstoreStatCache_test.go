@@ -0,0 +1,89 @@
+package surfstore_test
+
+import (
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Well outside the racy window of any scan
+var statTestMtime = time.Unix(1600000000, 0)
+
+func writeStatTestFile(t *testing.T, client surfstore.RPCClient, fileName string, content []byte, mtime time.Time) {
+	t.Helper()
+	writeTestFile(t, client, fileName, content)
+	if err := os.Chtimes(filepath.Join(client.BaseDir, fileName), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Each change is made after a sync cached a.txt, the cache is trusted unless a stat field changed
+func TestStatCache(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		change   func(t *testing.T, client surfstore.RPCClient)
+		opts     surfstore.SyncOptions
+		uploaded bool
+	}{
+		{"hit", func(t *testing.T, client surfstore.RPCClient) {
+			// New content behind the same size, mtime and inode isn't read
+			writeStatTestFile(t, client, "a.txt", testContent(2, 2*TEST_BLOCK_SIZE), statTestMtime)
+		}, surfstore.SyncOptions{}, false},
+		{"size", func(t *testing.T, client surfstore.RPCClient) {
+			writeStatTestFile(t, client, "a.txt", testContent(2, 2*TEST_BLOCK_SIZE+1), statTestMtime)
+		}, surfstore.SyncOptions{}, true},
+		{"mtime", func(t *testing.T, client surfstore.RPCClient) {
+			writeStatTestFile(t, client, "a.txt", testContent(2, 2*TEST_BLOCK_SIZE), statTestMtime.Add(time.Second))
+		}, surfstore.SyncOptions{}, true},
+		{"inode", func(t *testing.T, client surfstore.RPCClient) {
+			writeStatTestFile(t, client, "b.txt", testContent(2, 2*TEST_BLOCK_SIZE), statTestMtime)
+			if err := os.Rename(filepath.Join(client.BaseDir, "b.txt"), filepath.Join(client.BaseDir, "a.txt")); err != nil {
+				t.Fatal(err)
+			}
+		}, surfstore.SyncOptions{}, true},
+		{"full rescan", func(t *testing.T, client surfstore.RPCClient) {
+			writeStatTestFile(t, client, "a.txt", testContent(2, 2*TEST_BLOCK_SIZE), statTestMtime)
+		}, surfstore.SyncOptions{FullRescan: true}, true},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cluster := surfstoretest.NewCluster(1)
+			defer cluster.Close()
+			client := newTestClient(t, cluster)
+			writeStatTestFile(t, client, "a.txt", testContent(1, 2*TEST_BLOCK_SIZE), statTestMtime)
+			syncClient(t, client)
+
+			test.change(t, client)
+			summary := surfstore.ClientSyncWithOptions(client, test.opts)
+			if summary.Failed() {
+				t.Fatal(summary.Errors)
+			}
+			if uploaded := len(summary.Uploaded) == 1; uploaded != test.uploaded {
+				t.Fatalf("uploaded %v, expected an upload: %v", summary.Uploaded, test.uploaded)
+			}
+			if test.uploaded {
+				checkRemoteVersion(t, cluster, "a.txt", 2, false)
+			}
+		})
+	}
+}
+
+// A file modified just before the scan isn't cached, so that a same-size edit within the same
+// timestamp is still found by the next sync
+func TestStatCacheRacyWindow(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	client := newTestClient(t, cluster)
+	mtime := time.Now()
+	writeStatTestFile(t, client, "a.txt", testContent(1, 2*TEST_BLOCK_SIZE), mtime)
+	syncClient(t, client)
+
+	writeStatTestFile(t, client, "a.txt", testContent(2, 2*TEST_BLOCK_SIZE), mtime)
+	if summary := syncClient(t, client); len(summary.Uploaded) != 1 {
+		t.Fatalf("same-size edit within the racy window not uploaded: %v", summary.Uploaded)
+	}
+	checkRemoteVersion(t, cluster, "a.txt", 2, false)
+}
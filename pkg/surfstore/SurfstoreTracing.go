@@ -0,0 +1,365 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	Tracing Related
+
+	A Tracer records spans around the RPCs of a client and the handlers of a server. The trace
+	context travels between them in the W3C "traceparent" gRPC metadata, so the spans of a sync
+	and of the server handlers it called form a single trace. Finished spans go to a SpanExporter;
+	FileSpanExporter writes them to a file in the OTLP/JSON format of OpenTelemetry.
+
+	Every method of a nil *Tracer and a nil *Span does nothing, so code paths can be traced
+	unconditionally.
+*/
+
+// gRPC metadata key of the trace context
+const TRACEPARENT_HEADER string = "traceparent"
+
+type SpanKind int
+
+// Values of the OTLP span kinds
+const (
+	SPAN_KIND_INTERNAL SpanKind = 1
+	SPAN_KIND_SERVER   SpanKind = 2
+	SPAN_KIND_CLIENT   SpanKind = 3
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type SpanAttribute struct {
+	Key   string
+	Value string
+}
+
+type Span struct {
+	ServiceName  string
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   []SpanAttribute
+	// Error the span ended with, nil if it succeeded
+	Err error
+
+	mutex  sync.Mutex
+	tracer *Tracer
+}
+
+// SpanExporter receives the spans of a Tracer once they have ended
+type SpanExporter interface {
+	ExportSpan(span *Span) error
+}
+
+type Tracer struct {
+	ServiceName string
+	exporter    SpanExporter
+}
+
+func NewTracer(serviceName string, exporter SpanExporter) *Tracer {
+	return &Tracer{ServiceName: serviceName, exporter: exporter}
+}
+
+type spanContextKey struct{}
+
+// The trace context received from the caller of a server handler
+type remoteSpanContextKey struct{}
+
+type remoteSpanContext struct {
+	traceID TraceID
+	spanID  SpanID
+}
+
+// SpanFromContext returns the span of the context, nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a span, the child of the span of ctx or of the remote caller's span, and
+// returns a context carrying it. The span must be ended with Finish.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{ServiceName: t.ServiceName, Name: name, Kind: kind, Start: time.Now(), tracer: t}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID, span.ParentSpanID = parent.TraceID, parent.SpanID
+	} else if remote, exists := ctx.Value(remoteSpanContextKey{}).(remoteSpanContext); exists {
+		span.TraceID, span.ParentSpanID = remote.traceID, remote.spanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Attributes = append(s.Attributes, SpanAttribute{key, value})
+	s.mutex.Unlock()
+}
+
+// Finish ends the span with the error of the operation, nil if it succeeded, and exports it
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.End, s.Err = time.Now(), err
+	s.mutex.Unlock()
+	if s.tracer.exporter != nil {
+		if err := s.tracer.exporter.ExportSpan(s); err != nil {
+			log.Println("Error while exporting span", s.Name, err)
+		}
+	}
+}
+
+// Formats the trace context of the span as a W3C traceparent, always sampled
+func (s *Span) traceparent() string {
+	return "00-" + s.TraceID.String() + "-" + s.SpanID.String() + "-01"
+}
+
+// Parses a W3C traceparent, "00-<trace id>-<parent id>-<flags>"
+func parseTraceparent(traceparent string) (remoteSpanContext, bool) {
+	var remote remoteSpanContext
+	fields := strings.Split(traceparent, "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return remote, false
+	}
+	traceID, err := hex.DecodeString(fields[1])
+	if err != nil || len(traceID) != len(remote.traceID) || strings.Trim(fields[1], "0") == "" {
+		return remote, false
+	}
+	spanID, err := hex.DecodeString(fields[2])
+	if err != nil || len(spanID) != len(remote.spanID) || strings.Trim(fields[2], "0") == "" {
+		return remote, false
+	}
+	copy(remote.traceID[:], traceID)
+	copy(remote.spanID[:], spanID)
+	return remote, true
+}
+
+// Adds the trace context of the span of ctx to the outgoing gRPC metadata
+func injectTraceparent(ctx context.Context) context.Context {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, TRACEPARENT_HEADER, span.traceparent())
+}
+
+// Records the trace context received in the incoming gRPC metadata in ctx
+func extractTraceparent(ctx context.Context) context.Context {
+	md, exists := metadata.FromIncomingContext(ctx)
+	if !exists {
+		return ctx
+	}
+	values := md.Get(TRACEPARENT_HEADER)
+	if len(values) == 0 {
+		return ctx
+	}
+	remote, valid := parseTraceparent(values[0])
+	if !valid {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteSpanContextKey{}, remote)
+}
+
+// Starts the span of a server handler, named after its method, e.g. "surfstore.MetaStore/UpdateFile"
+func (t *Tracer) startServerSpan(ctx context.Context, fullMethod string) (context.Context, *Span) {
+	method := parseFullMethod(fullMethod)
+	ctx, span := t.StartSpan(extractTraceparent(ctx), method.service+"/"+method.method, SPAN_KIND_SERVER)
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.service", method.service)
+	span.SetAttribute("rpc.method", method.method)
+	return ctx, span
+}
+
+// UnaryServerInterceptor traces the unary RPCs of a server
+func (t *Tracer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := t.startServerSpan(ctx, info.FullMethod)
+		resp, err := handler(ctx, req)
+		span.SetAttribute("rpc.grpc.status_code", status.Code(err).String())
+		span.Finish(err)
+		return resp, err
+	}
+}
+
+// A server stream whose context carries the span of the handler
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *tracedServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+// StreamServerInterceptor traces the streaming RPCs of a server
+func (t *Tracer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := t.startServerSpan(stream.Context(), info.FullMethod)
+		err := handler(srv, &tracedServerStream{ServerStream: stream, ctx: ctx})
+		span.SetAttribute("rpc.grpc.status_code", status.Code(err).String())
+		span.Finish(err)
+		return err
+	}
+}
+
+/*
+	OTLP/JSON File Exporter
+*/
+
+// FileSpanExporter appends every span to a file as a line of OTLP/JSON, an OpenTelemetry
+// ExportTraceServiceRequest holding the single span. The file can be read by the OpenTelemetry
+// Collector's otlpjsonfile receiver and by trace viewers which import OTLP/JSON.
+type FileSpanExporter struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func NewFileSpanExporter(path string) (*FileSpanExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSpanExporter{file: file}, nil
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLP status codes
+const (
+	otlpStatusOk    int = 1
+	otlpStatusError int = 2
+)
+
+func toOtlpSpan(span *Span) otlpSpan {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	converted := otlpSpan{
+		TraceID:           span.TraceID.String(),
+		SpanID:            span.SpanID.String(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusOk},
+	}
+	if span.ParentSpanID != (SpanID{}) {
+		converted.ParentSpanID = span.ParentSpanID.String()
+	}
+	for _, attribute := range span.Attributes {
+		converted.Attributes = append(converted.Attributes, otlpAttribute{attribute.Key, otlpValue{attribute.Value}})
+	}
+	if span.Err != nil {
+		converted.Status = otlpStatus{Code: otlpStatusError, Message: span.Err.Error()}
+	}
+	return converted
+}
+
+func (e *FileSpanExporter) ExportSpan(span *Span) error {
+	var resourceSpans otlpResourceSpans
+	resourceSpans.Resource.Attributes = []otlpAttribute{{"service.name", otlpValue{span.ServiceName}}}
+	scopeSpans := otlpScopeSpans{Spans: []otlpSpan{toOtlpSpan(span)}}
+	scopeSpans.Scope.Name = "surfstore"
+	resourceSpans.ScopeSpans = []otlpScopeSpans{scopeSpans}
+	line, err := json.Marshal(otlpTraceRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}})
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.file == nil {
+		return fmt.Errorf("span exporter is closed")
+	}
+	_, err = e.file.Write(append(line, '\n'))
+	return err
+}
+
+func (e *FileSpanExporter) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
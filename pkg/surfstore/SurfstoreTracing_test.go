@@ -0,0 +1,168 @@
+package surfstore_test
+
+import (
+	"bufio"
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// Keeps the spans it receives
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*surfstore.Span
+}
+
+func (e *recordingExporter) ExportSpan(span *surfstore.Span) error {
+	e.mutex.Lock()
+	e.spans = append(e.spans, span)
+	e.mutex.Unlock()
+	return nil
+}
+
+func TestTraceOfSync(t *testing.T) {
+	exporter := &recordingExporter{}
+	serverTracer := surfstore.NewTracer("server", exporter)
+	cluster := surfstoretest.NewCluster(2, grpc.ChainUnaryInterceptor(serverTracer.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(serverTracer.StreamServerInterceptor()))
+	defer cluster.Close()
+	client := newTestClient(t, cluster)
+	client.Tracer = surfstore.NewTracer("client", exporter)
+	writeTestFile(t, client, "a.txt", testContent(1, 3*TEST_BLOCK_SIZE))
+	syncClient(t, client)
+
+	var root *surfstore.Span
+	clientSpans := make(map[surfstore.SpanID]*surfstore.Span)
+	for _, span := range exporter.spans {
+		if span.Name == "ClientSync" {
+			root = span
+		} else if span.Kind == surfstore.SPAN_KIND_CLIENT {
+			clientSpans[span.SpanID] = span
+		}
+	}
+	if root == nil || root.ParentSpanID != (surfstore.SpanID{}) {
+		t.Fatalf("no root ClientSync span in %d spans", len(exporter.spans))
+	}
+	rpcs := make(map[string]bool)
+	for _, span := range clientSpans {
+		if span.ServiceName != "client" || span.TraceID != root.TraceID || span.ParentSpanID != root.SpanID {
+			t.Errorf("client span %s is not a child of ClientSync", span.Name)
+		}
+		rpcs[strings.TrimPrefix(span.Name, "RPCClient/")] = true
+	}
+	for _, rpc := range []string{"GetFileInfoMap", "GetBlockStoreMap", "UpdateFile"} {
+		if !rpcs[rpc] {
+			t.Errorf("no span of %s among %v", rpc, rpcs)
+		}
+	}
+
+	// Every RPC is handled in a server span, the child of the client span which made it
+	served := 0
+	for _, span := range exporter.spans {
+		if span.Kind != surfstore.SPAN_KIND_SERVER {
+			continue
+		}
+		served++
+		parent, exists := clientSpans[span.ParentSpanID]
+		if span.ServiceName != "server" || span.TraceID != root.TraceID || !exists {
+			t.Fatalf("server span %s is not a child of a client span", span.Name)
+		}
+		if method := span.Name[strings.LastIndex(span.Name, "/")+1:]; parent.Name != "RPCClient/"+method {
+			t.Errorf("server span %s is the child of %s", span.Name, parent.Name)
+		}
+	}
+	if served != len(clientSpans) {
+		t.Errorf("%d server spans for %d client spans", served, len(clientSpans))
+	}
+}
+
+func TestFileSpanExporter(t *testing.T) {
+	tracePath := filepath.Join(t.TempDir(), "trace.json")
+	exporter, err := surfstore.NewFileSpanExporter(tracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := surfstore.NewTracer("test", exporter)
+	ctx, parent := tracer.StartSpan(context.Background(), "parent", surfstore.SPAN_KIND_INTERNAL)
+	_, child := tracer.StartSpan(ctx, "child", surfstore.SPAN_KIND_CLIENT)
+	child.SetAttribute("rpc.method", "GetBlock")
+	child.Finish(errors.New("block not found"))
+	parent.Finish(nil)
+	exporter.Close()
+
+	file, err := os.Open(tracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	type otlpSpan struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Kind         int    `json:"kind"`
+		Attributes   []struct {
+			Key   string `json:"key"`
+			Value struct {
+				StringValue string `json:"stringValue"`
+			} `json:"value"`
+		} `json:"attributes"`
+		Status struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"status"`
+	}
+	var spans []otlpSpan
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var request struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key   string `json:"key"`
+						Value struct {
+							StringValue string `json:"stringValue"`
+						} `json:"value"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		resource := request.ResourceSpans[0].Resource.Attributes[0]
+		if resource.Key != "service.name" || resource.Value.StringValue != "test" {
+			t.Fatalf("resource %v", resource)
+		}
+		spans = append(spans, request.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("%d spans in the trace file", len(spans))
+	}
+
+	exported, exportedParent := spans[0], spans[1]
+	if exported.Name != "child" || exported.Kind != 3 || exported.Status.Code != 2 || exported.Status.Message != "block not found" {
+		t.Errorf("child span %+v", exported)
+	}
+	if len(exported.Attributes) != 1 || exported.Attributes[0].Value.StringValue != "GetBlock" {
+		t.Errorf("child attributes %+v", exported.Attributes)
+	}
+	if exported.TraceID != parent.TraceID.String() || len(exported.TraceID) != 32 || exported.ParentSpanID != exportedParent.SpanID {
+		t.Errorf("child span %+v of parent %+v", exported, exportedParent)
+	}
+	if exportedParent.ParentSpanID != "" || exportedParent.Status.Code != 1 || len(exportedParent.SpanID) != 16 {
+		t.Errorf("parent span %+v", exportedParent)
+	}
+}
@@ -1,11 +1,17 @@
 package surfstore
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 // Returns number of blocks occupied by the file
@@ -18,15 +24,135 @@ func areEqualHashLists(first, second []string) bool {
 		return false
 	}
 	for idx, value := range first {
-		if value != second[idx] {
+		if !sameBlockHash(value, second[idx]) {
 			return false
 		}
 	}
 	return true
 }
 
+// SyncMode selects in which direction changes are synced
+type SyncMode int
+
+const (
+	// Local changes are uploaded and remote changes are applied locally
+	SYNC_BIDIRECTIONAL SyncMode = iota
+	// Local changes are uploaded, overwriting concurrent remote changes, and remote changes never
+	// modify the local tree
+	SYNC_PUSH_ONLY
+	// Remote changes are applied locally and local changes are never uploaded, they are reverted
+	// to the server state instead
+	SYNC_PULL_ONLY
+)
+
+// SyncOptions controls how ClientSync reconciles the base directory with the server
+type SyncOptions struct {
+	// Mode restricts the sync to one direction, it defaults to SYNC_BIDIRECTIONAL
+	Mode SyncMode
+	// DryRun only computes the sync plan. No local file, local index or server state is changed.
+	DryRun bool
+	// FullRescan rehashes every file instead of trusting the stat cache of the local index
+	FullRescan bool
+	// BlockCache, if set, is consulted before fetching blocks and filled by downloads and uploads
+	BlockCache *BlockCache
+}
+
+// SyncPlan lists the files a sync acts on, grouped by the action taken on each of them
+type SyncPlan struct {
+	Download     []string `json:"download"`
+	Upload       []string `json:"upload"`
+	DeleteLocal  []string `json:"deleteLocal"`
+	DeleteRemote []string `json:"deleteRemote"`
+}
+
+// String renders the plan in a human-readable form
+func (plan *SyncPlan) String() string {
+	var sb strings.Builder
+	sections := []struct {
+		title string
+		files []string
+	}{
+		{"download", plan.Download},
+		{"upload", plan.Upload},
+		{"delete locally", plan.DeleteLocal},
+		{"delete on server", plan.DeleteRemote},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(&sb, "%s (%d):\n", section.title, len(section.files))
+		for _, fileName := range section.files {
+			fmt.Fprintf(&sb, "  %s\n", fileName)
+		}
+	}
+	return sb.String()
+}
+
+// SyncSummary describes what a sync did
+type SyncSummary struct {
+	Plan *SyncPlan `json:"plan"`
+	// Files whose new version was accepted by the server
+	Uploaded []string `json:"uploaded"`
+	// Files replaced by (or recorded as) the server version
+	Downloaded []string `json:"downloaded"`
+	// Files removed locally since they were deleted on the server
+	DeletedLocally []string `json:"deletedLocally"`
+	// Files deleted on the server since they were removed locally
+	DeletedRemotely []string `json:"deletedRemotely"`
+	// Files whose upload or delete was rejected since the server has a newer version
+	Conflicts []string `json:"conflicts"`
+	// Bytes of blocks sent to the BlockStores
+	BytesUploaded int64 `json:"bytesUploaded"`
+	// Bytes of blocks fetched from the BlockStores
+	BytesDownloaded int64 `json:"bytesDownloaded"`
+	// Bytes of blocks which were not sent since the BlockStores already had them
+	BytesSkipped int64    `json:"bytesSkipped"`
+	Errors       []string `json:"errors"`
+}
+
+func newSyncSummary() *SyncSummary {
+	return &SyncSummary{
+		Plan:            &SyncPlan{},
+		Uploaded:        make([]string, 0),
+		Downloaded:      make([]string, 0),
+		DeletedLocally:  make([]string, 0),
+		DeletedRemotely: make([]string, 0),
+		Conflicts:       make([]string, 0),
+		Errors:          make([]string, 0),
+	}
+}
+
+// Logs the error and records it in the summary
+func (summary *SyncSummary) addError(context string, err error) {
+	log.Println(context, err)
+	summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %v", context, err))
+}
+
+// Failed reports whether any part of the sync failed
+func (summary *SyncSummary) Failed() bool {
+	return len(summary.Errors) > 0
+}
+
+// String renders the summary in a human-readable form
+func (summary *SyncSummary) String() string {
+	return fmt.Sprintf("uploaded %d, downloaded %d, deleted %d locally and %d on server, %d conflicts, %d errors; "+
+		"uploaded %d bytes, downloaded %d bytes, saved %d bytes of blocks already stored on the BlockStores",
+		len(summary.Uploaded), len(summary.Downloaded), len(summary.DeletedLocally), len(summary.DeletedRemotely),
+		len(summary.Conflicts), len(summary.Errors), summary.BytesUploaded, summary.BytesDownloaded, summary.BytesSkipped)
+}
+
 // Implement the logic for a client syncing with the server here.
-func ClientSync(client RPCClient) {
+func ClientSync(client RPCClient) *SyncSummary {
+	return ClientSyncWithOptions(client, SyncOptions{})
+}
+
+// ClientSyncWithOptions syncs the base directory with the server and returns a summary of the sync.
+// With opts.DryRun set, the plan is computed and returned without being applied.
+func ClientSyncWithOptions(client RPCClient, opts SyncOptions) *SyncSummary {
+	return ClientSyncContext(context.Background(), client, opts)
+}
+
+// ClientSyncContext is ClientSyncWithOptions with a context for the RPCs of the sync. Once ctx is
+// done no further file is synced; files already synced stay recorded in the local index.
+func ClientSyncContext(ctx context.Context, client RPCClient, opts SyncOptions) *SyncSummary {
 	// log.Println("sync started")
 
 	/*
@@ -48,18 +174,219 @@ func ClientSync(client RPCClient) {
 		1. When file is absent locally but present in local and remote index, delete it if local index version
 		equal remote index version.
 	*/
+	summary := newSyncSummary()
+	ctx, span := client.Tracer.StartSpan(ctx, "ClientSync", SPAN_KIND_INTERNAL)
+	span.SetAttribute("surfstore.base_dir", client.BaseDir)
+	defer func() {
+		span.SetAttribute("surfstore.summary", summary.String())
+		var err error
+		if summary.Failed() {
+			err = fmt.Errorf("%s", summary.Errors[0])
+		}
+		span.Finish(err)
+	}()
+
+	// Files matching .surfignore are neither uploaded nor downloaded
+	ignore, err := LoadIgnoreFile(client.BaseDir)
+	if err != nil {
+		summary.addError("Error while reading ignore file", err)
+	}
+
+	// Blocks are hashed with the algorithm of the MetaStore's namespace
+	client.HashAlgorithm, err = negotiateHashAlgorithm(ctx, client)
+	if err != nil {
+		summary.addError("Error while negotiating the hash algorithm", err)
+		return summary
+	}
+
+	// The local index stays with the backend it was created with
+	index, err := OpenLocalIndex(client.BaseDir, client.IndexBackend)
+	if err != nil {
+		summary.addError("Error while opening local index", err)
+		return summary
+	}
+	// One connection serves the whole sync, a dry run only reads
+	if err := index.open(!opts.DryRun); err != nil {
+		summary.addError("Error while opening local index", err)
+		return summary
+	}
+	defer index.close()
+
 	// Scan each file in the base directory and compute file's hash list.
-	filesHashListMap := make(map[string][]string) // key - fileName, value - hashlist
+	// Files whose size, mtime and inode match the stat cache are not rehashed.
+	statCache, err := index.loadStatCache()
+	if err != nil {
+		log.Println("Error while loading stat cache", err)
+	}
+	if opts.FullRescan {
+		statCache = make(map[string]*statCacheEntry)
+	}
+	localFiles, statCache, err := scanBaseDir(client, ignore, statCache)
+	if err != nil {
+		// Without the list of local files every indexed file would look deleted
+		summary.addError("Error while scanning base directory", err)
+		return summary
+	}
+	// log.Println("localFiles", localFiles)
+
+	// Load local index data from local db file
+	localIndex, err := index.LoadMeta()
+	if err != nil {
+		summary.addError("Error while loading metadata from database", err)
+		return summary
+	}
+	// log.Println("localIndex", localIndex)
+
+	// Connect to server and download update FileInfoMap (remote index)
+	var remoteIndex = make(map[string]*FileMetaData)
+	if err := client.GetFileInfoMapContext(ctx, &remoteIndex); err != nil {
+		summary.addError("Error while fetching remote index", err)
+		return summary
+	}
+	for fileName := range remoteIndex {
+		if err := ValidateFileName(fileName); err != nil {
+			// Such a name would be written outside the base directory
+			log.Println("Skipping remote file:", err)
+			delete(remoteIndex, fileName)
+		} else if ignore.Match(fileName, false) {
+			delete(remoteIndex, fileName)
+		}
+	}
+	// log.Println("remoteIndex", remoteIndex)
+
+	// Finish or undo the operations of an interrupted sync before planning this one
+	uploadedBlocks := recoverJournal(client, index, localIndex, remoteIndex, localFiles, !opts.DryRun)
+
+	var plan *SyncPlan
+	switch opts.Mode {
+	case SYNC_PUSH_ONLY:
+		plan = buildPushOnlyPlan(localFiles, localIndex, remoteIndex)
+	case SYNC_PULL_ONLY:
+		plan = buildPullOnlyPlan(localFiles, localIndex, remoteIndex)
+	default:
+		plan = buildSyncPlan(localFiles, localIndex, remoteIndex)
+	}
+	summary.Plan = plan
+	if opts.DryRun {
+		return summary
+	}
+
+	// Check the blocks to be downloaded
+	for _, fileToDownload := range plan.Download {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := downloadFile(ctx, fileToDownload, client, index, remoteIndex, localIndex, opts.BlockCache, summary); err != nil {
+			summary.addError("Error while downloading file "+fileToDownload, err)
+		} else {
+			summary.Downloaded = append(summary.Downloaded, fileToDownload)
+		}
+	}
+
+	// Check the blocks to be downloaded
+	for _, fileToDeleteLocally := range plan.DeleteLocal {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := deleteLocalFile(fileToDeleteLocally, client, index, remoteIndex, localIndex); err != nil {
+			summary.addError("Error while deleting local file "+fileToDeleteLocally, err)
+		} else {
+			summary.DeletedLocally = append(summary.DeletedLocally, fileToDeleteLocally)
+		}
+	}
+
+	// Check the blocks to be deleted
+	for _, fileToDelete := range plan.DeleteRemote {
+		if ctx.Err() != nil {
+			break
+		}
+		version := nextVersion(fileToDelete, localIndex, remoteIndex, opts.Mode == SYNC_PUSH_ONLY)
+		returnedVersion, err := deleteFile(ctx, fileToDelete, version, client, index, localIndex)
+		if err != nil {
+			summary.addError("Error while deleting file "+fileToDelete+" on server", err)
+		} else if returnedVersion == -1 {
+			// Changed on the server meanwhile, the next sync downloads it again
+			summary.Conflicts = append(summary.Conflicts, fileToDelete)
+		} else {
+			summary.DeletedRemotely = append(summary.DeletedRemotely, fileToDelete)
+		}
+	}
+
+	// Upload newly added files
+	for _, fileName := range plan.Upload {
+		if ctx.Err() != nil {
+			break
+		}
+		version := nextVersion(fileName, localIndex, remoteIndex, opts.Mode == SYNC_PUSH_ONLY)
+		returnedVersion, err := uploadFile(ctx, fileName, version, client, index, localIndex, uploadedBlocks[fileName], summary, opts.BlockCache)
+		// log.Println("returnedVersion", returnedVersion)
+		if err != nil {
+			// The local change stays pending for the next sync
+			summary.addError("Error while uploading file "+fileName, err)
+		} else if returnedVersion == -1 {
+			summary.Conflicts = append(summary.Conflicts, fileName)
+			// download only if it exists in remote index
+			_, remoteExists := remoteIndex[fileName]
+			if remoteExists && opts.Mode != SYNC_PUSH_ONLY {
+				// outdated version
+				if err := downloadFile(ctx, fileName, client, index, remoteIndex, localIndex, opts.BlockCache, summary); err != nil {
+					summary.addError("Error while downloading file "+fileName, err)
+				} else {
+					summary.Downloaded = append(summary.Downloaded, fileName)
+				}
+			}
+		} else {
+			summary.Uploaded = append(summary.Uploaded, fileName)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		// The remaining files are synced by the next sync
+		summary.addError("Sync interrupted", err)
+	}
+	// log.Println("last localIndex", localIndex)
+	if err := index.writeSyncState(localIndex, statCache); err != nil {
+		summary.addError("Error while writing local index", err)
+	}
+	log.Println("sync summary:", summary)
+	return summary
+}
+
+// Returns the metadata (hash list and file attributes) of every file in the base directory,
+// keyed by file name. Versions are left unset. Hash lists are taken from the stat cache when
+// the file is unchanged; the returned stat cache covers the files which were scanned.
+func scanBaseDir(client RPCClient, ignore *IgnoreMatcher, statCache map[string]*statCacheEntry) (map[string]*FileMetaData, map[string]*statCacheEntry, error) {
+	localFiles := make(map[string]*FileMetaData) // key - fileName, value - metadata
+	newStatCache := make(map[string]*statCacheEntry)
+	scanStart := time.Now()
 	allFiles, err := ioutil.ReadDir(client.BaseDir)
 	if err != nil {
-		log.Println("Error while ReadDir call", err)
+		return localFiles, newStatCache, err
 	}
 	for _, file := range allFiles {
-		// Ignore index.db file
-		if file.Name() == DEFAULT_META_FILENAME {
+		// Ignore the local index
+		if isLocalIndexFile(file.Name()) {
+			continue
+		}
+		if ignore.Match(file.Name(), file.IsDir()) || isTempFileName(file.Name()) {
 			continue
 		}
 		fileName := file.Name()
+		fileMetaData, err := newLocalFileMetaData(client.BaseDir, file)
+		if err != nil {
+			log.Println("Skipping file", fileName, err)
+			continue
+		}
+		if fileMetaData.FileType == FileType_SYMLINK {
+			localFiles[fileName] = fileMetaData
+			continue
+		}
+		statEntry := newStatCacheEntry(file, client.BlockSize, nil)
+		if cached, exists := statCache[fileName]; exists && cached.matches(statEntry) && usesHashAlgorithm(cached.hashList, client.HashAlgorithm) {
+			fileMetaData.BlockHashList = cached.hashList
+			localFiles[fileName] = fileMetaData
+			newStatCache[fileName] = cached
+			continue
+		}
 		fileSize := file.Size()
 		numBlocks := getNumberOfBlocks(fileSize, client.BlockSize)
 		filePath := filepath.Join(client.BaseDir, fileName)
@@ -76,26 +403,71 @@ func ClientSync(client RPCClient) {
 				log.Println("Error while reading from file ", err)
 			}
 			block = block[:bytesRead]
-			blockHash := GetBlockHashString(block)
+			blockHash, err := GetTaggedBlockHash(client.HashAlgorithm, block)
+			if err != nil {
+				file.Close()
+				return localFiles, newStatCache, err
+			}
 			hashList = append(hashList, blockHash)
 		}
 		file.Close()
-		filesHashListMap[fileName] = hashList
+		// Empty file has hashvalue -1
+		if numBlocks == 0 {
+			hashList = append(hashList, EMPTYFILE_HASHVALUE)
+		}
+		fileMetaData.BlockHashList = hashList
+		localFiles[fileName] = fileMetaData
+		if scanStart.Sub(time.Unix(0, statEntry.mtime)) > statCacheRacyWindow {
+			statEntry.hashList = hashList
+			newStatCache[fileName] = statEntry
+		}
 	}
-	// log.Println("filesHashListMap", filesHashListMap)
+	return localFiles, newStatCache, nil
+}
 
-	// Load local index data from local db file
-	localIndex, err := LoadMetaFromMetaFile(client.BaseDir)
-	if err != nil {
-		log.Println("Error while loading metadata from database", err)
+// Builds the metadata of a local file from its (Lstat) file info, without the block hash list
+// of a regular file. Symlinks are recorded as links with the hash list of an empty file.
+// Directories and other special files are not synced.
+func newLocalFileMetaData(baseDir string, fileInfo os.FileInfo) (*FileMetaData, error) {
+	fileMetaData := &FileMetaData{
+		Filename: fileInfo.Name(),
+		Mode:     uint32(fileInfo.Mode().Perm()),
+		Mtime:    fileInfo.ModTime().UnixNano(),
 	}
-	// log.Println("localIndex", localIndex)
+	switch {
+	case fileInfo.Mode().IsRegular():
+		fileMetaData.FileType = FileType_REGULAR
+		fileMetaData.Size = fileInfo.Size()
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(filepath.Join(baseDir, fileInfo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		fileMetaData.FileType = FileType_SYMLINK
+		fileMetaData.SymlinkTarget = target
+		fileMetaData.BlockHashList = []string{EMPTYFILE_HASHVALUE}
+	default:
+		return nil, fmt.Errorf("unsupported file type %s", fileInfo.Mode().Type())
+	}
+	return fileMetaData, nil
+}
 
-	// Connect to server and download update FileInfoMap (remote index)
-	var remoteIndex = make(map[string]*FileMetaData)
-	client.GetFileInfoMap(&remoteIndex)
-	// log.Println("remoteIndex", remoteIndex)
+// Reports whether the content or the attributes of the local file differ from the indexed ones.
+// The modification time alone is not a change, and a missing mode (index written before modes
+// were recorded) matches any mode.
+func hasLocalChanges(localFile *FileMetaData, indexed *FileMetaData) bool {
+	if !areEqualHashLists(localFile.BlockHashList, indexed.BlockHashList) {
+		return true
+	}
+	if localFile.FileType != indexed.FileType || localFile.SymlinkTarget != indexed.SymlinkTarget {
+		return true
+	}
+	return localFile.FileType == FileType_REGULAR && indexed.Mode != 0 && localFile.Mode != indexed.Mode
+}
 
+// Compares the local files with the local and remote index and decides what has to be
+// downloaded, uploaded and deleted. It has no side effects.
+func buildSyncPlan(localFiles map[string]*FileMetaData, localIndex, remoteIndex map[string]*FileMetaData) *SyncPlan {
 	// Files which are present in remoteIndex and not in localIndex needs to be downloaded
 	filesToDownload := make(map[string]bool)
 	filesToDelete := make(map[string]bool)
@@ -108,45 +480,30 @@ func ClientSync(client RPCClient) {
 			// File exists in local but outdated version
 			if remoteIndex[fileName].Version > localIndex[fileName].Version {
 				// Check if file is deleted or not
-				if len(remoteIndex[fileName].BlockHashList) == 1 && remoteIndex[fileName].BlockHashList[0] == TOMBSTONE_HASHVALUE {
+				if isFileDeleted(remoteIndex[fileName]) {
 					filesToDeleteLocally[fileName] = true
-					deleteLocalFile(fileName, client, remoteIndex, localIndex)
 				} else {
 					filesToDownload[fileName] = true
 				}
 			}
 			if remoteIndex[fileName].Version == localIndex[fileName].Version {
 				// Check if file is already deleted
-				if len(remoteIndex[fileName].BlockHashList) == 1 && remoteIndex[fileName].BlockHashList[0] == TOMBSTONE_HASHVALUE {
+				if isFileDeleted(remoteIndex[fileName]) {
 					continue
 				}
 				// If file doesnt exist locally but is in localIndex, download it
-				_, exists := filesHashListMap[fileName]
+				_, exists := localFiles[fileName]
 				if !exists {
 					filesToDelete[fileName] = true
 				}
 			}
 		}
 	}
-	// Get BlockStoreAddr
-	var blockStoreAddrs []string
-	client.GetBlockStoreAddrs(&blockStoreAddrs)
-	log.Println("client sync blockStoreAddrs", blockStoreAddrs)
-
-	// Check the blocks to be downloaded
-	for fileToDownload := range filesToDownload {
-		downloadFile(fileToDownload, client, remoteIndex, localIndex, blockStoreAddrs)
-	}
-
-	// Check the blocks to be downloaded
-	for fileToDeleteLocally := range filesToDeleteLocally {
-		deleteLocalFile(fileToDeleteLocally, client, remoteIndex, localIndex)
-	}
 
 	// Check the files which are newly added or edited
 	newFilesAdded := make([]string, 0)
 	editedFiles := make([]string, 0)
-	for fileName := range filesHashListMap {
+	for fileName := range localFiles {
 		_, downloadExists := filesToDownload[fileName]
 		_, deleteExists := filesToDelete[fileName]
 		_, deleteLocallyExists := filesToDeleteLocally[fileName]
@@ -164,10 +521,8 @@ func ClientSync(client RPCClient) {
 			// File exists in the local index, but has been changed since then
 			// Version of the file in the local index and remote index are same
 			if localIndex[fileName].Version == remoteIndex[fileName].Version {
-				// Compare the hashList
-				curHashList := filesHashListMap[fileName]
-				prevHashList := localIndex[fileName].BlockHashList
-				if !areEqualHashLists(curHashList, prevHashList) {
+				// Compare the hashList and the file attributes
+				if hasLocalChanges(localFiles[fileName], localIndex[fileName]) {
 					editedFiles = append(editedFiles, fileName)
 				}
 			}
@@ -179,132 +534,318 @@ func ClientSync(client RPCClient) {
 	// log.Println("filesToDelete", filesToDelete)
 	// log.Println("filesToDeleteLocally", filesToDeleteLocally)
 
-	// Check the blocks to be deleted
-	for fileToDelete := range filesToDelete {
-		deleteFile(fileToDelete, client, localIndex, blockStoreAddrs)
-	}
-
 	filesToUpload := make([]string, 0)
 	filesToUpload = append(filesToUpload, newFilesAdded...)
 	filesToUpload = append(filesToUpload, editedFiles...)
-	// Upload newly added files
-	for _, fileName := range filesToUpload {
-		returnedVersion, err := uploadFile(fileName, client, localIndex, blockStoreAddrs)
-		// log.Println("returnedVersion", returnedVersion)
-		if err != nil || returnedVersion == -1 {
-			// download only if it exists in remote index
-			_, remoteExists := remoteIndex[fileName]
-			if remoteExists {
-				// outdated version
-				downloadFile(fileName, client, remoteIndex, localIndex, blockStoreAddrs)
-			}
+	sort.Strings(filesToUpload)
+	return &SyncPlan{
+		Download:     sortedKeys(filesToDownload),
+		Upload:       filesToUpload,
+		DeleteLocal:  sortedKeys(filesToDeleteLocally),
+		DeleteRemote: sortedKeys(filesToDelete),
+	}
+}
+
+// Plans a push-only sync: every file which changed since the last sync and differs from the
+// server version is uploaded (or deleted on the server) on top of the latest server version.
+// Nothing is downloaded or deleted locally.
+func buildPushOnlyPlan(localFiles map[string]*FileMetaData, localIndex, remoteIndex map[string]*FileMetaData) *SyncPlan {
+	filesToUpload := make(map[string]bool)
+	filesToDelete := make(map[string]bool)
+	for fileName, localFile := range localFiles {
+		indexed, indexedExists := localIndex[fileName]
+		if indexedExists && !hasLocalChanges(localFile, indexed) {
+			continue
 		}
-		// else {
-		// 	// Only if update is successful, update the localIndex db
-		// 	// WriteMetaFile(localIndex, client.BaseDir)
-		// }
+		remoteMeta, remoteExists := remoteIndex[fileName]
+		if remoteExists && !hasLocalChanges(localFile, remoteMeta) {
+			// Already published
+			continue
+		}
+		filesToUpload[fileName] = true
 	}
-	// log.Println("last localIndex", localIndex)
-	WriteMetaFile(localIndex, client.BaseDir)
+	for fileName, indexed := range localIndex {
+		if _, exists := localFiles[fileName]; exists || isFileDeleted(indexed) {
+			continue
+		}
+		remoteMeta, remoteExists := remoteIndex[fileName]
+		if remoteExists && !isFileDeleted(remoteMeta) {
+			filesToDelete[fileName] = true
+		}
+	}
+	return &SyncPlan{
+		Download:     []string{},
+		Upload:       sortedKeys(filesToUpload),
+		DeleteLocal:  []string{},
+		DeleteRemote: sortedKeys(filesToDelete),
+	}
+}
+
+// Plans a pull-only sync: remote changes are applied as usual, while every file the regular plan
+// would upload or delete on the server is reverted to its server version instead, or removed
+// when the server doesn't have it.
+func buildPullOnlyPlan(localFiles map[string]*FileMetaData, localIndex, remoteIndex map[string]*FileMetaData) *SyncPlan {
+	plan := buildSyncPlan(localFiles, localIndex, remoteIndex)
+	filesToDownload := make(map[string]bool)
+	filesToDeleteLocally := make(map[string]bool)
+	for _, fileName := range plan.Download {
+		filesToDownload[fileName] = true
+	}
+	for _, fileName := range plan.DeleteLocal {
+		filesToDeleteLocally[fileName] = true
+	}
+	localChanges := make([]string, 0, len(plan.Upload)+len(plan.DeleteRemote))
+	localChanges = append(localChanges, plan.Upload...)
+	localChanges = append(localChanges, plan.DeleteRemote...)
+	for _, fileName := range localChanges {
+		remoteMeta, remoteExists := remoteIndex[fileName]
+		if remoteExists && !isFileDeleted(remoteMeta) {
+			filesToDownload[fileName] = true
+		} else {
+			filesToDeleteLocally[fileName] = true
+		}
+	}
+	return &SyncPlan{
+		Download:     sortedKeys(filesToDownload),
+		Upload:       []string{},
+		DeleteLocal:  sortedKeys(filesToDeleteLocally),
+		DeleteRemote: []string{},
+	}
+}
+
+// Returns the version a new upload or delete of the file is proposed with. It is based on the
+// locally indexed version, or on the server version when the local change overwrites it.
+func nextVersion(fileName string, localIndex, remoteIndex map[string]*FileMetaData, overwrite bool) int32 {
+	var version int32
+	if indexed, exists := localIndex[fileName]; exists {
+		version = indexed.Version
+	}
+	if remoteMeta, exists := remoteIndex[fileName]; exists && overwrite && remoteMeta.Version > version {
+		version = remoteMeta.Version
+	}
+	return version + 1
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-func uploadFile(fileName string, client RPCClient, localIndex map[string]*FileMetaData, blockStoreAddrs []string) (int32, error) {
+// Uploads the blocks of the local file and publishes it as version. uploadedBlocks are the blocks
+// an interrupted upload of the file already stored, they are neither looked up nor uploaded again.
+func uploadFile(ctx context.Context, fileName string, version int32, client RPCClient, index LocalIndex, localIndex map[string]*FileMetaData, uploadedBlocks []string, summary *SyncSummary, cache *BlockCache) (int32, error) {
 	localPath := filepath.Join(client.BaseDir, fileName)
-	localFile, err := os.Open(localPath)
+	fileStats, err := os.Lstat(localPath)
 	if err != nil {
-		log.Println("Error while opening file", err)
+		return -1, err
 	}
-	defer localFile.Close()
-
-	fileStats, err := os.Stat(localPath)
+	localFileMetadata, err := newLocalFileMetaData(client.BaseDir, fileStats)
 	if err != nil {
-		log.Println("Error while fetching stats", err)
+		return -1, err
 	}
-	fileSize := fileStats.Size()
-	numBlocks := getNumberOfBlocks(fileSize, client.BlockSize)
 	hashList := make([]string, 0)
 	blockHashToBlockDataMap := make(map[string][]byte)
-	for i := 0; i < numBlocks; i++ {
-		blockData := make([]byte, client.BlockSize)
-		bytesRead, err := localFile.Read(blockData)
+	if localFileMetadata.FileType == FileType_REGULAR {
+		localFile, err := os.Open(localPath)
 		if err != nil {
-			log.Println("Error while reading the file", err)
+			return -1, err
+		}
+		defer localFile.Close()
+		fileSize := fileStats.Size()
+		numBlocks := getNumberOfBlocks(fileSize, client.BlockSize)
+		for i := 0; i < numBlocks; i++ {
+			blockData := make([]byte, client.BlockSize)
+			bytesRead, err := localFile.Read(blockData)
+			if err != nil {
+				log.Println("Error while reading the file", err)
+			}
+			blockData = blockData[:bytesRead]
+			blockHash, err := GetTaggedBlockHash(client.HashAlgorithm, blockData)
+			if err != nil {
+				return -1, err
+			}
+			hashList = append(hashList, blockHash)
+			blockHashToBlockDataMap[blockHash] = blockData
+			if err := cache.Put(blockHash, blockData); err != nil {
+				log.Println("Error while caching block", blockHash, err)
+			}
 		}
-		blockData = blockData[:bytesRead]
-		blockHash := GetBlockHashString(blockData)
-		hashList = append(hashList, blockHash)
-		blockHashToBlockDataMap[blockHash] = blockData
 	}
 	// log.Println("upload hashlist length", len(hashList), len(blockHashToBlockDataMap))
 	var blockStoreMap map[string][]string
 	// log.Println("upload hashList", hashList)
-	client.GetBlockStoreMap(hashList, &blockStoreMap)
-	// log.Println("upload blockStoreMap", blockStoreMap)
-	revBlockStoreMap := reverseBlockStoreMap(blockStoreMap)
-	// log.Println("upload revBlockStoreMap", revBlockStoreMap)
-	// log.Println("upload revBlockStoreMap length", len(revBlockStoreMap))
-	for blockHash, blockData := range blockHashToBlockDataMap {
-		blockSize := int32(len(blockData))
-		blockObject := Block{BlockData: blockData, BlockSize: blockSize}
-		// log.Println("upload blockhash", blockHash)
-		blockStoreAddr := revBlockStoreMap[blockHash]
-		// log.Println("upload blockStoreAddr", blockStoreAddr)
-		var success bool
-		err = client.PutBlock(&blockObject, blockStoreAddr, &success)
-		if err != nil {
-			log.Println("Error while putting block", err)
+	if len(hashList) > 0 {
+		if err := client.GetBlockStoreMapContext(ctx, hashList, &blockStoreMap); err != nil {
+			return -1, err
 		}
-		if !success {
-			log.Println("PutBlock method not successful")
+		// Never publish a version with blocks which no BlockStore was asked to store
+		if err := checkBlockStoreMap(hashList, blockStoreMap); err != nil {
+			return -1, err
 		}
 	}
-	// Empty file has hashvalue -1
-	if numBlocks == 0 {
+	// log.Println("upload blockStoreMap", blockStoreMap)
+	// Empty file (and symlink) has hashvalue -1
+	if len(hashList) == 0 {
 		hashList = append(hashList, EMPTYFILE_HASHVALUE)
 	}
+	localFileMetadata.Version = version
+	localFileMetadata.BlockHashList = hashList
+	entry := &journalEntry{operation: JOURNAL_UPLOAD, meta: localFileMetadata}
+	if err := index.writeJournalEntry(entry); err != nil {
+		return -1, err
+	}
+
+	storedBlocks := findStoredBlocks(ctx, client, blockStoreMap, uploadedBlocks)
+	uploadFailed := false
+	for blockStoreAddr, blockHashes := range blockStoreMap {
+		for _, blockHash := range blockHashes {
+			blockData, pending := blockHashToBlockDataMap[blockHash]
+			if !pending {
+				// Duplicate block of the file, already handled
+				continue
+			}
+			delete(blockHashToBlockDataMap, blockHash)
+			if storedBlocks[blockHash] {
+				summary.BytesSkipped += int64(len(blockData))
+				entry.uploadedBlocks = append(entry.uploadedBlocks, blockHash)
+				continue
+			}
+			blockSize := int32(len(blockData))
+			blockObject := Block{BlockData: blockData, BlockSize: blockSize, HashAlgorithm: client.HashAlgorithm}
+			var success bool
+			err = client.PutBlockContext(ctx, &blockObject, blockStoreAddr, &success)
+			if err != nil {
+				log.Println("Error while putting block", err)
+			}
+			if !success {
+				log.Println("PutBlock method not successful")
+				uploadFailed = true
+			} else {
+				summary.BytesUploaded += int64(blockSize)
+				entry.uploadedBlocks = append(entry.uploadedBlocks, blockHash)
+			}
+		}
+		// Record the progress once per BlockStore
+		if err := index.markJournalBlocksUploaded(fileName, entry.uploadedBlocks); err != nil {
+			log.Println("Error while updating sync journal", err)
+		}
+	}
 	// log.Println("All Put blocks done")
-	var version int32 = 1
-	_, localExists := localIndex[fileName]
-	if localExists {
-		version = 1 + int32(localIndex[fileName].Version)
+	if len(blockHashToBlockDataMap) > 0 {
+		log.Println(len(blockHashToBlockDataMap), "blocks of", fileName, "were not assigned a BlockStore")
+		uploadFailed = true
+	}
+	if uploadFailed {
+		// Never publish a version whose blocks are not all stored
+		index.finishJournalEntry(fileName)
+		return -1, fmt.Errorf("uploading blocks of %s failed", fileName)
 	}
 	var returnedVersion int32
-	localFileMetadata := FileMetaData{Filename: fileName, Version: version, BlockHashList: hashList}
-	err = client.UpdateFile(&localFileMetadata, &returnedVersion)
+	err = client.UpdateFileContext(ctx, localFileMetadata, &returnedVersion)
 	// log.Println("UpdateFile return version", returnedVersion, err)
-	if err != nil {
-		returnedVersion = -1
+	if err != nil || returnedVersion == -1 {
+		// The server kept its version, the local file stays an unsynced change
+		index.finishJournalEntry(fileName)
+		return -1, err
 	}
 	localFileMetadata.Version = returnedVersion
-	localIndex[fileName] = &localFileMetadata
-	return returnedVersion, err
+	localIndex[fileName] = localFileMetadata
+	index.finishJournalEntry(fileName)
+	return returnedVersion, nil
+}
+
+// Fails unless every block was assigned a BlockStore
+func checkBlockStoreMap(blockHashes []string, blockStoreMap map[string][]string) error {
+	assigned := make(map[string]bool)
+	for _, hashes := range blockStoreMap {
+		for _, blockHash := range hashes {
+			assigned[blockHash] = true
+		}
+	}
+	for _, blockHash := range blockHashes {
+		if !assigned[blockHash] {
+			return fmt.Errorf("no BlockStore assigned to block %s", blockHash)
+		}
+	}
+	return nil
 }
 
-func deleteLocalFile(fileName string, client RPCClient, remoteIndex map[string]*FileMetaData, localIndex map[string]*FileMetaData) error {
-	localIndex[fileName] = remoteIndex[fileName]
+// Asks every BlockStore which of the blocks assigned to it are already stored, so that only
+// the missing ones are uploaded. Blocks known to be stored are not asked about. A BlockStore
+// which can't be asked is assumed to have none.
+func findStoredBlocks(ctx context.Context, client RPCClient, blockStoreMap map[string][]string, knownBlocks []string) map[string]bool {
+	storedBlocks := make(map[string]bool)
+	for _, blockHash := range knownBlocks {
+		storedBlocks[blockHash] = true
+	}
+	for blockStoreAddr, blockHashes := range blockStoreMap {
+		unknownHashes := make([]string, 0, len(blockHashes))
+		for _, blockHash := range blockHashes {
+			if !storedBlocks[blockHash] {
+				unknownHashes = append(unknownHashes, blockHash)
+			}
+		}
+		if len(unknownHashes) == 0 {
+			continue
+		}
+		var presentHashes []string
+		if err := client.HasBlocksContext(ctx, unknownHashes, blockStoreAddr, &presentHashes); err != nil {
+			log.Println("Error while checking blocks on", blockStoreAddr, err)
+			continue
+		}
+		for _, blockHash := range presentHashes {
+			storedBlocks[blockHash] = true
+		}
+	}
+	return storedBlocks
+}
+
+func deleteLocalFile(fileName string, client RPCClient, index LocalIndex, remoteIndex map[string]*FileMetaData, localIndex map[string]*FileMetaData) error {
+	remoteMeta, remoteExists := remoteIndex[fileName]
 	filePath := filepath.Join(client.BaseDir, fileName)
-	if _, err := os.Stat(filePath); err == nil {
-		e := os.Remove(filePath)
-		if e != nil {
-			log.Fatal("Error during removing deleted file", e)
+	if !remoteExists {
+		// A local-only file reverted by a pull-only sync, the server has nothing to record
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
 		}
+		delete(localIndex, fileName)
+		return nil
+	}
+	entry := &journalEntry{operation: JOURNAL_DELETE_LOCAL, meta: remoteMeta}
+	if err := index.writeJournalEntry(entry); err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		// The local file stays, and so does its index entry
+		index.finishJournalEntry(fileName)
+		return err
 	}
+	localIndex[fileName] = remoteMeta
+	index.finishJournalEntry(fileName)
 	return nil
 }
 
-func deleteFile(fileName string, client RPCClient, localIndex map[string]*FileMetaData, blockStoreAddrs []string) (int32, error) {
-	version := localIndex[fileName].Version
+func deleteFile(ctx context.Context, fileName string, version int32, client RPCClient, index LocalIndex, localIndex map[string]*FileMetaData) (int32, error) {
 	var tombstoneHashList []string = []string{TOMBSTONE_HASHVALUE}
-	localFileMetadata := FileMetaData{Filename: fileName, Version: version + 1, BlockHashList: tombstoneHashList}
+	localFileMetadata := FileMetaData{Filename: fileName, Version: version, BlockHashList: tombstoneHashList}
+	entry := &journalEntry{operation: JOURNAL_DELETE_REMOTE, meta: &localFileMetadata}
+	if err := index.writeJournalEntry(entry); err != nil {
+		return -1, err
+	}
 	var returnedVersion int32
-	err := client.UpdateFile(&localFileMetadata, &returnedVersion)
+	err := client.UpdateFileContext(ctx, &localFileMetadata, &returnedVersion)
 	// log.Println("UpdateFile return version", returnedVersion, err)
-	if err != nil || returnedVersion != version+1 {
+	if err != nil || returnedVersion != version {
 		returnedVersion = -1
 	} else {
 		localFileMetadata.Version = returnedVersion
 		localIndex[fileName] = &localFileMetadata
 	}
+	index.finishJournalEntry(fileName)
 	return returnedVersion, err
 }
 
@@ -315,44 +856,187 @@ func isFileDeleted(fileMetaData *FileMetaData) bool {
 	return false
 }
 
-func downloadFile(fileName string, client RPCClient, remoteIndex map[string]*FileMetaData, localIndex map[string]*FileMetaData, blockStoreAddrs []string) error {
+// Downloads the remote version of the file. The blocks are streamed into a temporary file in the
+// base directory which replaces the local file only once every block has been fetched and verified,
+// so a failed download leaves the previous local file (and local index entry) untouched.
+func downloadFile(ctx context.Context, fileName string, client RPCClient, index LocalIndex, remoteIndex map[string]*FileMetaData, localIndex map[string]*FileMetaData, cache *BlockCache, summary *SyncSummary) error {
 	// Check if the file is deleted in the remote index (TOMBSTONE RECORD)
-	if isFileDeleted(remoteIndex[fileName]) {
+	remoteMeta := remoteIndex[fileName]
+	if isFileDeleted(remoteMeta) {
 		// Copy metadata of file
-		localIndex[fileName] = remoteIndex[fileName]
+		localIndex[fileName] = remoteMeta
 		return nil
 	}
+	entry := &journalEntry{operation: JOURNAL_DOWNLOAD, meta: remoteMeta}
+	if err := index.writeJournalEntry(entry); err != nil {
+		return err
+	}
 	localPath := filepath.Join(client.BaseDir, fileName)
-	localFile, err := os.Create(localPath)
+	var tempPath string
+	var err error
+	if remoteMeta.FileType == FileType_SYMLINK {
+		tempPath, err = createTempSymlink(client.BaseDir, fileName, remoteMeta.SymlinkTarget)
+	} else {
+		tempPath, err = downloadToTempFile(ctx, client, remoteMeta, localPath, cache, summary)
+	}
 	if err != nil {
-		log.Println("Error while creating file", err)
-	}
-	defer localFile.Close()
-	// Write metadata of file and update localIndex object (not db)
-	// err = WriteMetaFile(remoteIndex, client.BaseDir)
-	// if err != nil {
-	// 	log.Println("Error in updating local index", err)
-	// }
-	localIndex[fileName] = remoteIndex[fileName]
+		index.finishJournalEntry(fileName)
+		return err
+	}
+	if err := os.Rename(tempPath, localPath); err != nil {
+		os.Remove(tempPath)
+		index.finishJournalEntry(fileName)
+		return err
+	}
+	syncDir(client.BaseDir)
+	if err := index.markJournalFileReplaced(fileName); err != nil {
+		log.Println("Error while updating sync journal", err)
+	}
+	// Update localIndex only once the file is in place
+	localIndex[fileName] = remoteMeta
+	index.finishJournalEntry(fileName)
+	return nil
+}
+
+// Writes the blocks of the remote file into a new temporary file next to localPath and applies
+// the recorded mode and modification time. Returns the path of the complete temporary file.
+func downloadToTempFile(ctx context.Context, client RPCClient, remoteMeta *FileMetaData, localPath string, cache *BlockCache, summary *SyncSummary) (string, error) {
+	tempFile, err := createTempFile(client.BaseDir, remoteMeta.Filename)
+	if err != nil {
+		return "", err
+	}
+	tempPath := tempFile.Name()
+	complete := false
+	defer func() {
+		if !complete {
+			tempFile.Close()
+			os.Remove(tempPath)
+		}
+	}()
+	if remoteMeta.Mode != 0 {
+		if err := tempFile.Chmod(os.FileMode(remoteMeta.Mode).Perm()); err != nil {
+			return "", err
+		}
+	} else if fileStats, err := os.Stat(localPath); err == nil {
+		// No recorded mode, keep the permissions of the file being replaced
+		if err := tempFile.Chmod(fileStats.Mode().Perm()); err != nil {
+			return "", err
+		}
+	}
 	// Nothing to write if file is empty
-	if len(remoteIndex[fileName].BlockHashList) == 1 && remoteIndex[fileName].BlockHashList[0] == EMPTYFILE_HASHVALUE {
-		return nil
+	hashList := remoteMeta.BlockHashList
+	if !(len(hashList) == 1 && hashList[0] == EMPTYFILE_HASHVALUE) {
+		// Only the blocks missing from the local block cache are fetched
+		missingHashes := make([]string, 0)
+		for _, blockHash := range hashList {
+			if !cache.Has(blockHash) {
+				missingHashes = append(missingHashes, blockHash)
+			}
+		}
+		revBlockStoreMap := make(map[string]string)
+		if len(missingHashes) > 0 {
+			var blockStoreMap map[string][]string
+			if err := client.GetBlockStoreMapContext(ctx, missingHashes, &blockStoreMap); err != nil {
+				return "", err
+			}
+			revBlockStoreMap = reverseBlockStoreMap(blockStoreMap)
+		}
+		for _, blockHash := range hashList {
+			blockData, err := fetchBlock(ctx, client, blockHash, revBlockStoreMap, cache, summary)
+			if err != nil {
+				return "", err
+			}
+			if _, err := tempFile.Write(blockData); err != nil {
+				return "", err
+			}
+		}
 	}
-	fileContent := ""
-	var blockStoreMap map[string][]string
-	client.GetBlockStoreMap(remoteIndex[fileName].BlockHashList, &blockStoreMap)
-	revBlockStoreMap := reverseBlockStoreMap(blockStoreMap)
-	for _, blockHash := range remoteIndex[fileName].BlockHashList {
-		var block Block
-		var blockStoreAddr string = revBlockStoreMap[blockHash]
-		err := client.GetBlock(blockHash, blockStoreAddr, &block)
-		if err != nil {
-			log.Println("Error while executing GetBlock call", err)
+	if err := tempFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", err
+	}
+	if remoteMeta.Mtime != 0 {
+		mtime := time.Unix(0, remoteMeta.Mtime)
+		if err := os.Chtimes(tempPath, mtime, mtime); err != nil {
+			return "", err
 		}
-		fileContent += string(block.BlockData)
 	}
-	localFile.WriteString(fileContent)
-	return nil
+	complete = true
+	return tempPath, nil
+}
+
+// Returns the block from the local block cache or, failing that, from its BlockStore.
+// Fetched blocks are verified against their hash and added to the cache.
+func fetchBlock(ctx context.Context, client RPCClient, blockHash string, revBlockStoreMap map[string]string, cache *BlockCache, summary *SyncSummary) ([]byte, error) {
+	if blockData, cached := cache.Get(blockHash); cached {
+		return blockData, nil
+	}
+	blockStoreAddr, exists := revBlockStoreMap[blockHash]
+	if !exists {
+		// Evicted from the cache since the BlockStore map was fetched
+		var blockStoreMap map[string][]string
+		if err := client.GetBlockStoreMapContext(ctx, []string{blockHash}, &blockStoreMap); err != nil {
+			return nil, err
+		}
+		blockStoreAddr = reverseBlockStoreMap(blockStoreMap)[blockHash]
+	}
+	var block Block
+	if err := client.GetBlockContext(ctx, blockHash, blockStoreAddr, &block); err != nil {
+		return nil, fmt.Errorf("fetching block %s from %s: %w", blockHash, blockStoreAddr, err)
+	}
+	if !VerifyBlockHash(blockHash, block.BlockData) {
+		return nil, fmt.Errorf("block %s from %s does not match its hash", blockHash, blockStoreAddr)
+	}
+	if summary != nil {
+		summary.BytesDownloaded += int64(len(block.BlockData))
+	}
+	if err := cache.Put(blockHash, block.BlockData); err != nil {
+		log.Println("Error while caching block", blockHash, err)
+	}
+	return block.BlockData, nil
+}
+
+// Creates a hidden symlink next to the given file, which can later be renamed over it
+func createTempSymlink(dir string, fileName string, target string) (string, error) {
+	for {
+		tempPath := filepath.Join(dir, fmt.Sprintf(".%s%s%d", fileName, TEMP_FILE_MARKER, rand.Uint32()))
+		err := os.Symlink(target, tempPath)
+		if os.IsExist(err) {
+			continue
+		}
+		return tempPath, err
+	}
+}
+
+// Creates a new hidden file next to the given file, which can later be renamed over it.
+// Unlike ioutil.TempFile the file is created with the default 0666 permissions (minus umask).
+func createTempFile(dir string, fileName string) (*os.File, error) {
+	for {
+		tempName := fmt.Sprintf(".%s%s%d", fileName, TEMP_FILE_MARKER, rand.Uint32())
+		tempFile, err := os.OpenFile(filepath.Join(dir, tempName), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return tempFile, err
+	}
+}
+
+// Temporary files of an interrupted download are not part of the synced files
+func isTempFileName(fileName string) bool {
+	return strings.HasPrefix(fileName, ".") && strings.Contains(fileName, TEMP_FILE_MARKER)
+}
+
+// Flushes a rename in the directory to disk. Errors are ignored since not every platform
+// supports syncing a directory.
+func syncDir(dir string) {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	dirFile.Sync()
+	dirFile.Close()
 }
 
 func reverseBlockStoreMap(blockStoreMap map[string][]string) map[string]string {
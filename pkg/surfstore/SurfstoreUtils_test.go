@@ -0,0 +1,666 @@
+package surfstore_test
+
+import (
+	"bytes"
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const TEST_BLOCK_SIZE int = 1024
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// Returns a client of the cluster syncing a new temporary directory
+func newTestClient(t *testing.T, cluster *surfstoretest.Cluster) surfstore.RPCClient {
+	client := cluster.NewClient(t.TempDir(), TEST_BLOCK_SIZE)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func syncClient(t *testing.T, client surfstore.RPCClient) *surfstore.SyncSummary {
+	t.Helper()
+	summary := surfstore.ClientSync(client)
+	if summary.Failed() {
+		t.Fatalf("sync of %s failed: %v", client.BaseDir, summary.Errors)
+	}
+	return summary
+}
+
+func writeTestFile(t *testing.T, client surfstore.RPCClient, fileName string, content []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(client.BaseDir, fileName), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func removeTestFile(t *testing.T, client surfstore.RPCClient, fileName string) {
+	t.Helper()
+	if err := os.Remove(filepath.Join(client.BaseDir, fileName)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkTestFile(t *testing.T, client surfstore.RPCClient, fileName string, expected []byte) {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(client.BaseDir, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Fatalf("%s in %s has %d bytes %.20q, expected %d bytes %.20q", fileName, client.BaseDir, len(content), content, len(expected), expected)
+	}
+}
+
+func checkTestFileMissing(t *testing.T, client surfstore.RPCClient, fileName string) {
+	t.Helper()
+	if _, err := os.Lstat(filepath.Join(client.BaseDir, fileName)); !os.IsNotExist(err) {
+		t.Fatalf("%s in %s should not exist, got %v", fileName, client.BaseDir, err)
+	}
+}
+
+// Returns the metadata of the file on the MetaStore, nil if the server has never seen it
+func remoteMeta(t *testing.T, cluster *surfstoretest.Cluster, fileName string) *surfstore.FileMetaData {
+	t.Helper()
+	fileInfoMap, err := cluster.MetaStore().GetFileInfoMap(context.Background(), &emptypb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileInfoMap.FileInfoMap[fileName]
+}
+
+func checkRemoteVersion(t *testing.T, cluster *surfstoretest.Cluster, fileName string, version int32, deleted bool) {
+	t.Helper()
+	meta := remoteMeta(t, cluster, fileName)
+	if meta == nil {
+		t.Fatalf("%s is not on the server", fileName)
+	}
+	if meta.Version != version || surfstore.IsRemoteFileDeleted(meta) != deleted {
+		t.Fatalf("%s is version %d (deleted %v) on the server, expected version %d (deleted %v)",
+			fileName, meta.Version, surfstore.IsRemoteFileDeleted(meta), version, deleted)
+	}
+}
+
+// Content spanning several blocks, different for each seed
+func testContent(seed byte, size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = seed + byte(i%251)
+	}
+	return content
+}
+
+// Upload case 1: a file present locally and absent from the local and remote index is uploaded
+func TestUploadNewFile(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+
+	content := testContent(1, 3*TEST_BLOCK_SIZE+100)
+	writeTestFile(t, alice, "new.txt", content)
+	summary := syncClient(t, alice)
+	if len(summary.Uploaded) != 1 || summary.Uploaded[0] != "new.txt" {
+		t.Fatalf("uploaded %v, expected [new.txt]", summary.Uploaded)
+	}
+	checkRemoteVersion(t, cluster, "new.txt", 1, false)
+
+	syncClient(t, bob)
+	checkTestFile(t, bob, "new.txt", content)
+}
+
+// Download case 1: a file present locally and in both indexes is downloaded when the remote
+// version is newer than the indexed one
+func TestDownloadNewerRemoteVersion(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+
+	writeTestFile(t, alice, "doc.txt", testContent(1, 2*TEST_BLOCK_SIZE))
+	syncClient(t, alice)
+	syncClient(t, bob)
+
+	edited := testContent(2, 5*TEST_BLOCK_SIZE/2)
+	writeTestFile(t, alice, "doc.txt", edited)
+	syncClient(t, alice)
+	checkRemoteVersion(t, cluster, "doc.txt", 2, false)
+
+	summary := syncClient(t, bob)
+	if len(summary.Downloaded) != 1 {
+		t.Fatalf("downloaded %v, expected [doc.txt]", summary.Downloaded)
+	}
+	checkTestFile(t, bob, "doc.txt", edited)
+}
+
+// Download case 2: a file present locally and in the remote index but not in the local index is
+// replaced by the remote version
+func TestDownloadReplacesUnindexedLocalFile(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+
+	content := testContent(1, TEST_BLOCK_SIZE+1)
+	writeTestFile(t, alice, "shared.txt", content)
+	syncClient(t, alice)
+
+	writeTestFile(t, bob, "shared.txt", testContent(9, 10))
+	syncClient(t, bob)
+	checkTestFile(t, bob, "shared.txt", content)
+	checkRemoteVersion(t, cluster, "shared.txt", 1, false)
+}
+
+// Download case 3: a file absent locally but present in both indexes is downloaded when the remote
+// version is newer, instead of deleting it on the server
+func TestDownloadRestoresLocallyDeletedFileChangedRemotely(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+
+	writeTestFile(t, alice, "notes.txt", testContent(1, 100))
+	syncClient(t, alice)
+	syncClient(t, bob)
+
+	edited := testContent(2, 2*TEST_BLOCK_SIZE)
+	writeTestFile(t, alice, "notes.txt", edited)
+	syncClient(t, alice)
+
+	removeTestFile(t, bob, "notes.txt")
+	syncClient(t, bob)
+	checkTestFile(t, bob, "notes.txt", edited)
+	checkRemoteVersion(t, cluster, "notes.txt", 2, false)
+}
+
+// Download case 4: a file absent locally and from the local index but present in the remote index
+// is downloaded
+func TestDownloadNewRemoteFile(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+
+	syncClient(t, bob)
+	content := testContent(3, 4*TEST_BLOCK_SIZE)
+	empty := []byte{}
+	writeTestFile(t, alice, "remote.bin", content)
+	writeTestFile(t, alice, "empty.txt", empty)
+	syncClient(t, alice)
+
+	summary := syncClient(t, bob)
+	if len(summary.Downloaded) != 2 {
+		t.Fatalf("downloaded %v, expected [empty.txt remote.bin]", summary.Downloaded)
+	}
+	checkTestFile(t, bob, "remote.bin", content)
+	checkTestFile(t, bob, "empty.txt", empty)
+}
+
+// Delete case 1: a file absent locally and present in both indexes with the same version is
+// deleted on the server, and then locally by the other clients
+func TestDeleteFile(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+
+	writeTestFile(t, alice, "old.txt", testContent(1, 100))
+	syncClient(t, alice)
+	syncClient(t, bob)
+
+	removeTestFile(t, alice, "old.txt")
+	summary := syncClient(t, alice)
+	if len(summary.DeletedRemotely) != 1 {
+		t.Fatalf("deleted %v on the server, expected [old.txt]", summary.DeletedRemotely)
+	}
+	checkRemoteVersion(t, cluster, "old.txt", 2, true)
+
+	summary = syncClient(t, bob)
+	if len(summary.DeletedLocally) != 1 {
+		t.Fatalf("deleted %v locally, expected [old.txt]", summary.DeletedLocally)
+	}
+	checkTestFileMissing(t, bob, "old.txt")
+
+	// A file recreated after its deletion gets the version following the tombstone
+	recreated := testContent(4, 10)
+	writeTestFile(t, bob, "old.txt", recreated)
+	syncClient(t, bob)
+	checkRemoteVersion(t, cluster, "old.txt", 3, false)
+	syncClient(t, alice)
+	checkTestFile(t, alice, "old.txt", recreated)
+}
+
+// Concurrent edits: the first upload wins, the other client's edit is replaced by it
+func TestConcurrentEditsKeepFirstUpload(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+
+	writeTestFile(t, alice, "draft.txt", testContent(1, 100))
+	syncClient(t, alice)
+	syncClient(t, bob)
+
+	aliceEdit := testContent(2, 200)
+	writeTestFile(t, alice, "draft.txt", aliceEdit)
+	writeTestFile(t, bob, "draft.txt", testContent(3, 300))
+	syncClient(t, alice)
+	summary := syncClient(t, bob)
+	if len(summary.Downloaded) != 1 || len(summary.Uploaded) != 0 {
+		t.Fatalf("downloaded %v and uploaded %v, expected to download draft.txt", summary.Downloaded, summary.Uploaded)
+	}
+	checkTestFile(t, bob, "draft.txt", aliceEdit)
+	checkRemoteVersion(t, cluster, "draft.txt", 2, false)
+}
+
+// Blocks are stored on the BlockStore chosen by the consistent hash ring
+func TestBlocksFollowConsistentHashRing(t *testing.T) {
+	cluster := surfstoretest.NewCluster(3)
+	defer cluster.Close()
+	alice := newTestClient(t, cluster)
+
+	writeTestFile(t, alice, "spread.bin", testContent(5, 16*TEST_BLOCK_SIZE))
+	syncClient(t, alice)
+
+	ring := cluster.MetaStore().ConsistentHashRing
+	for _, blockHash := range remoteMeta(t, cluster, "spread.bin").BlockHashList {
+		addr := ring.GetResponsibleServer(blockHash)
+		hashes, err := cluster.BlockStore(addr).HasBlocks(context.Background(), &surfstore.BlockHashes{Hashes: []string{blockHash}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hashes.Hashes) != 1 {
+			t.Fatalf("block %s is not on %s", blockHash, addr)
+		}
+	}
+}
+
+// Blocks are hashed with the namespace's algorithm and tagged with it
+func TestHashAlgorithms(t *testing.T) {
+	algorithms := append(surfstore.SupportedHashAlgorithms(), surfstore.HASH_ALGORITHM_LEGACY)
+	for _, algorithm := range algorithms {
+		t.Run("algorithm="+algorithm, func(t *testing.T) {
+			cluster := surfstoretest.NewCluster(2)
+			defer cluster.Close()
+			cluster.MetaStore().HashAlgorithm = algorithm
+			alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+
+			content := testContent(6, 6*TEST_BLOCK_SIZE+7)
+			writeTestFile(t, alice, "hashed.bin", content)
+			syncClient(t, alice)
+			for _, blockHash := range remoteMeta(t, cluster, "hashed.bin").BlockHashList {
+				if hashAlgorithm, _ := surfstore.ParseBlockHash(blockHash); hashAlgorithm != algorithm {
+					t.Fatalf("block hash %s is not tagged with %q", blockHash, algorithm)
+				}
+			}
+			syncClient(t, bob)
+			checkTestFile(t, bob, "hashed.bin", content)
+		})
+	}
+}
+
+// Files indexed with untagged hashes are not uploaded again once the namespace tags its hashes
+func TestLegacyHashesMatchTaggedHashes(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	cluster.MetaStore().HashAlgorithm = surfstore.HASH_ALGORITHM_LEGACY
+	alice := newTestClient(t, cluster)
+
+	writeTestFile(t, alice, "legacy.txt", testContent(7, 2*TEST_BLOCK_SIZE))
+	syncClient(t, alice)
+
+	cluster.MetaStore().HashAlgorithm = surfstore.HASH_ALGORITHM_SHA256
+	summary := syncClient(t, alice)
+	if len(summary.Uploaded) != 0 {
+		t.Fatalf("uploaded %v, expected nothing", summary.Uploaded)
+	}
+	checkRemoteVersion(t, cluster, "legacy.txt", 1, false)
+}
+
+func syncClientWithMode(t *testing.T, client surfstore.RPCClient, mode surfstore.SyncMode, dryRun bool) *surfstore.SyncSummary {
+	t.Helper()
+	summary := surfstore.ClientSyncWithOptions(client, surfstore.SyncOptions{Mode: mode, DryRun: dryRun})
+	if summary.Failed() {
+		t.Fatalf("sync of %s failed: %v", client.BaseDir, summary.Errors)
+	}
+	return summary
+}
+
+func checkPlan(t *testing.T, plan *surfstore.SyncPlan, expected surfstore.SyncPlan) {
+	t.Helper()
+	actual := fmt.Sprint(plan.Download, plan.Upload, plan.DeleteLocal, plan.DeleteRemote)
+	if actual != fmt.Sprint(expected.Download, expected.Upload, expected.DeleteLocal, expected.DeleteRemote) {
+		t.Fatalf("plan %s, expected %s", plan, &expected)
+	}
+}
+
+// Push-only: local changes overwrite the server version, remote changes are left alone
+func TestPushOnlySync(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+
+	writeTestFile(t, alice, "shared.txt", testContent(1, 100))
+	writeTestFile(t, alice, "old.txt", testContent(2, 100))
+	syncClient(t, alice)
+	syncClient(t, bob)
+	writeTestFile(t, alice, "shared.txt", testContent(3, 100))
+	writeTestFile(t, alice, "remote.txt", testContent(4, 100))
+	syncClient(t, alice)
+
+	bobEdit := testContent(5, 300)
+	writeTestFile(t, bob, "shared.txt", bobEdit)
+	writeTestFile(t, bob, "new.txt", testContent(6, 100))
+	removeTestFile(t, bob, "old.txt")
+	plan := syncClientWithMode(t, bob, surfstore.SYNC_PUSH_ONLY, true).Plan
+	checkPlan(t, plan, surfstore.SyncPlan{Download: []string{}, Upload: []string{"new.txt", "shared.txt"},
+		DeleteLocal: []string{}, DeleteRemote: []string{"old.txt"}})
+
+	syncClientWithMode(t, bob, surfstore.SYNC_PUSH_ONLY, false)
+	checkRemoteVersion(t, cluster, "shared.txt", 3, false)
+	checkRemoteVersion(t, cluster, "new.txt", 1, false)
+	checkRemoteVersion(t, cluster, "old.txt", 2, true)
+	checkTestFile(t, bob, "shared.txt", bobEdit)
+	checkTestFileMissing(t, bob, "remote.txt")
+	syncClient(t, alice)
+	checkTestFile(t, alice, "shared.txt", bobEdit)
+	checkTestFileMissing(t, alice, "old.txt")
+
+	// Nothing is left to push
+	plan = syncClientWithMode(t, bob, surfstore.SYNC_PUSH_ONLY, true).Plan
+	checkPlan(t, plan, surfstore.SyncPlan{Download: []string{}, Upload: []string{}, DeleteLocal: []string{}, DeleteRemote: []string{}})
+}
+
+// Pull-only: remote changes are applied, local changes are reverted to the server state, and files
+// the server never had are removed
+func TestPullOnlySync(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, mirror := newTestClient(t, cluster), newTestClient(t, cluster)
+
+	shared, kept := testContent(1, 100), testContent(2, 100)
+	writeTestFile(t, alice, "shared.txt", shared)
+	writeTestFile(t, alice, "kept.txt", kept)
+	syncClient(t, alice)
+	syncClientWithMode(t, mirror, surfstore.SYNC_PULL_ONLY, false)
+	checkTestFile(t, mirror, "shared.txt", shared)
+
+	remote := testContent(3, 100)
+	writeTestFile(t, alice, "remote.txt", remote)
+	syncClient(t, alice)
+	writeTestFile(t, mirror, "shared.txt", testContent(4, 300))
+	removeTestFile(t, mirror, "kept.txt")
+	writeTestFile(t, mirror, "local-only.txt", testContent(5, 100))
+	plan := syncClientWithMode(t, mirror, surfstore.SYNC_PULL_ONLY, true).Plan
+	checkPlan(t, plan, surfstore.SyncPlan{Download: []string{"kept.txt", "remote.txt", "shared.txt"}, Upload: []string{},
+		DeleteLocal: []string{"local-only.txt"}, DeleteRemote: []string{}})
+
+	syncClientWithMode(t, mirror, surfstore.SYNC_PULL_ONLY, false)
+	checkTestFile(t, mirror, "shared.txt", shared)
+	checkTestFile(t, mirror, "kept.txt", kept)
+	checkTestFile(t, mirror, "remote.txt", remote)
+	checkTestFileMissing(t, mirror, "local-only.txt")
+	checkRemoteVersion(t, cluster, "shared.txt", 1, false)
+	checkRemoteVersion(t, cluster, "kept.txt", 1, false)
+	if meta := remoteMeta(t, cluster, "local-only.txt"); meta != nil {
+		t.Fatalf("local-only.txt published as %v", meta)
+	}
+}
+
+// An upload whose blocks weren't all assigned a BlockStore fails instead of publishing the file
+func TestUploadFailsWithoutBlockStoreMap(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		respond func(resp *surfstore.BlockStoreMap) (interface{}, error)
+	}{
+		{"error", func(resp *surfstore.BlockStoreMap) (interface{}, error) {
+			return nil, status.Error(codes.Internal, "injected failure")
+		}},
+		{"partial map", func(resp *surfstore.BlockStoreMap) (interface{}, error) {
+			for _, blockHashes := range resp.BlockStoreMap {
+				blockHashes.Hashes = blockHashes.Hashes[1:]
+			}
+			return resp, nil
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				resp, err := handler(ctx, req)
+				if info.FullMethod == "/surfstore.MetaStore/GetBlockStoreMap" && err == nil {
+					return test.respond(resp.(*surfstore.BlockStoreMap))
+				}
+				return resp, err
+			}
+			cluster := surfstoretest.NewCluster(1, grpc.ChainUnaryInterceptor(interceptor))
+			defer cluster.Close()
+			client := newTestClient(t, cluster)
+			writeTestFile(t, client, "a.txt", testContent(1, 3*TEST_BLOCK_SIZE))
+
+			summary := surfstore.ClientSync(client)
+			if !summary.Failed() || len(summary.Uploaded) != 0 {
+				t.Fatalf("uploaded %v, errors %v", summary.Uploaded, summary.Errors)
+			}
+			if meta := remoteMeta(t, cluster, "a.txt"); meta != nil {
+				t.Fatalf("a.txt published as %v", meta)
+			}
+		})
+	}
+}
+
+// The sync doesn't depend on GetBlockStoreAddrs, blocks are placed with GetBlockStoreMap
+func TestSyncWithoutBlockStoreAddrs(t *testing.T) {
+	failAddrs := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/surfstore.MetaStore/GetBlockStoreAddrs" {
+			return nil, status.Error(codes.Unavailable, "injected failure")
+		}
+		return handler(ctx, req)
+	}
+	cluster := surfstoretest.NewCluster(1, grpc.ChainUnaryInterceptor(failAddrs))
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+	content := testContent(1, 2*TEST_BLOCK_SIZE)
+	writeTestFile(t, alice, "a.txt", content)
+	syncClient(t, alice)
+	syncClient(t, bob)
+	checkTestFile(t, bob, "a.txt", content)
+}
+
+// Mode, modification time and symlinks survive the round trip through the server
+func TestFileAttributesRoundTrip(t *testing.T) {
+	cluster := surfstoretest.NewCluster(1)
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+	content := testContent(1, 2*TEST_BLOCK_SIZE)
+	writeTestFile(t, alice, "run.sh", content)
+	scriptPath := filepath.Join(alice.BaseDir, "run.sh")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	if err := os.Chmod(scriptPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(scriptPath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("run.sh", filepath.Join(alice.BaseDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	syncClient(t, alice)
+	syncClient(t, bob)
+
+	checkTestFile(t, bob, "run.sh", content)
+	stats, err := os.Lstat(filepath.Join(bob.BaseDir, "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Mode().Perm() != 0750 || !stats.ModTime().Equal(mtime) {
+		t.Fatalf("run.sh has mode %v and mtime %v, expected %v and %v", stats.Mode().Perm(), stats.ModTime(), os.FileMode(0750), mtime)
+	}
+	linkPath := filepath.Join(bob.BaseDir, "link")
+	if stats, err := os.Lstat(linkPath); err != nil || stats.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("link is not a symlink: %v", err)
+	}
+	if target, err := os.Readlink(linkPath); err != nil || target != "run.sh" {
+		t.Fatalf("link points to %q: %v", target, err)
+	}
+
+	// A mode change alone is a change
+	if err := os.Chmod(scriptPath, 0600); err != nil {
+		t.Fatal(err)
+	}
+	syncClient(t, alice)
+	syncClient(t, bob)
+	if stats, err := os.Lstat(filepath.Join(bob.BaseDir, "run.sh")); err != nil || stats.Mode().Perm() != 0600 {
+		t.Fatalf("mode change not applied: %v", err)
+	}
+}
+
+// A download cut short by a dead BlockStore leaves the previous local file and no temporary file
+func TestFailedDownloadKeepsLocalFile(t *testing.T) {
+	var cluster *surfstoretest.Cluster
+	var armed, getBlocks int32
+	killOnSecondBlock := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/surfstore.BlockStore/GetBlock" && atomic.LoadInt32(&armed) == 1 {
+			if calls := atomic.AddInt32(&getBlocks, 1); calls == 2 {
+				go cluster.Kill(cluster.BlockStoreAddrs[0])
+			}
+			if atomic.LoadInt32(&getBlocks) >= 2 {
+				return nil, status.Error(codes.Unavailable, "BlockStore killed")
+			}
+		}
+		return handler(ctx, req)
+	}
+	cluster = surfstoretest.NewCluster(1, grpc.ChainUnaryInterceptor(killOnSecondBlock))
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+	oldContent, newContent := testContent(1, 3*TEST_BLOCK_SIZE), testContent(2, 3*TEST_BLOCK_SIZE)
+	writeTestFile(t, alice, "a.txt", oldContent)
+	syncClient(t, alice)
+	syncClient(t, bob)
+	writeTestFile(t, alice, "a.txt", newContent)
+	syncClient(t, alice)
+
+	atomic.StoreInt32(&armed, 1)
+	if summary := surfstore.ClientSync(bob); !summary.Failed() || len(summary.Downloaded) != 0 {
+		t.Fatalf("download without BlockStore succeeded: %v", summary)
+	}
+	if atomic.LoadInt32(&getBlocks) < 2 {
+		t.Fatalf("download stopped after %d blocks", getBlocks)
+	}
+	checkTestFile(t, bob, "a.txt", oldContent)
+	checkIndexedVersion(t, bob.BaseDir, "a.txt", 1)
+	entries, err := os.ReadDir(bob.BaseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), surfstore.TEMP_FILE_MARKER) {
+			t.Fatalf("temporary file %s left behind", entry.Name())
+		}
+	}
+
+	cluster.Restart(cluster.BlockStoreAddrs[0])
+	atomic.StoreInt32(&armed, 0)
+	syncClient(t, bob)
+	checkTestFile(t, bob, "a.txt", newContent)
+}
+
+// Blocks the BlockStores already have are not uploaded again
+func TestIdenticalFilesUploadBlocksOnce(t *testing.T) {
+	var putBlocks int32
+	countPutBlocks := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/surfstore.BlockStore/PutBlock" {
+			atomic.AddInt32(&putBlocks, 1)
+		}
+		return handler(ctx, req)
+	}
+	cluster := surfstoretest.NewCluster(2, grpc.ChainUnaryInterceptor(countPutBlocks))
+	defer cluster.Close()
+	alice, bob := newTestClient(t, cluster), newTestClient(t, cluster)
+	content := testContent(1, 3*TEST_BLOCK_SIZE)
+	writeTestFile(t, alice, "a.txt", content)
+	writeTestFile(t, alice, "b.txt", content)
+	summary := syncClient(t, alice)
+	if len(summary.Uploaded) != 2 {
+		t.Fatalf("uploaded %v", summary.Uploaded)
+	}
+	if puts := atomic.LoadInt32(&putBlocks); puts != 3 {
+		t.Fatalf("%d PutBlock calls for 3 distinct blocks", puts)
+	}
+	if summary.BytesUploaded != int64(len(content)) || summary.BytesSkipped != int64(len(content)) {
+		t.Fatalf("uploaded %d bytes, skipped %d bytes", summary.BytesUploaded, summary.BytesSkipped)
+	}
+	syncClient(t, bob)
+	checkTestFile(t, bob, "a.txt", content)
+	checkTestFile(t, bob, "b.txt", content)
+}
+
+// A canceled sync returns promptly, even while waiting for a rate limiter or a dead server, and
+// the next sync picks up where it stopped
+func TestSyncCancellation(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		block   func(cluster *surfstoretest.Cluster, client *surfstore.RPCClient)
+		unblock func(cluster *surfstoretest.Cluster, client *surfstore.RPCClient)
+	}{
+		{"blocked limiter", func(cluster *surfstoretest.Cluster, client *surfstore.RPCClient) {
+			// The first block goes through, the second waits for over 15 minutes
+			client.UploadLimiter = surfstore.NewRateLimiter(1)
+		}, func(cluster *surfstoretest.Cluster, client *surfstore.RPCClient) {
+			client.UploadLimiter = nil
+		}},
+		{"killed BlockStore", func(cluster *surfstoretest.Cluster, client *surfstore.RPCClient) {
+			cluster.Kill(cluster.BlockStoreAddrs[0])
+			client.RetryPolicy.MaxAttempts = 10
+			client.RetryPolicy.InitialBackoff = time.Minute
+			client.RetryPolicy.MaxBackoff = time.Minute
+		}, func(cluster *surfstoretest.Cluster, client *surfstore.RPCClient) {
+			cluster.Restart(cluster.BlockStoreAddrs[0])
+			client.RetryPolicy = surfstore.DefaultRetryPolicy()
+		}},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cluster := surfstoretest.NewCluster(1)
+			defer cluster.Close()
+			alice, bob := newIndexTestClient(t, cluster, surfstore.INDEX_BACKEND_LOG), newTestClient(t, cluster)
+			content := testContent(1, 2*TEST_BLOCK_SIZE)
+			writeTestFile(t, alice, "a.txt", content)
+			test.block(cluster, &alice)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			var canceledAt time.Time
+			timer := time.AfterFunc(100*time.Millisecond, func() {
+				canceledAt = time.Now()
+				cancel()
+			})
+			defer timer.Stop()
+			summary := surfstore.ClientSyncContext(ctx, alice, surfstore.SyncOptions{})
+			if elapsed := time.Since(canceledAt); canceledAt.IsZero() || elapsed > 2*time.Second {
+				t.Fatalf("sync returned %v after the cancellation", elapsed)
+			}
+			if len(summary.Uploaded) != 0 || !strings.Contains(fmt.Sprint(summary.Errors), context.Canceled.Error()) {
+				t.Fatalf("canceled sync uploaded %v, errors %v", summary.Uploaded, summary.Errors)
+			}
+			if meta := remoteMeta(t, cluster, "a.txt"); meta != nil {
+				t.Fatalf("canceled upload published %v", meta)
+			}
+			checkJournalEmpty(t, alice)
+
+			test.unblock(cluster, &alice)
+			if summary := syncClient(t, alice); len(summary.Uploaded) != 1 {
+				t.Fatalf("uploaded %v after the cancellation", summary.Uploaded)
+			}
+			syncClient(t, bob)
+			checkTestFile(t, bob, "a.txt", content)
+		})
+	}
+}
@@ -0,0 +1,556 @@
+package surfstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+/*
+	WebDAV Frontend
+
+	Exposes the flat namespace of a MetaStore as a WebDAV collection. PROPFIND lists the files of
+	GetFileInfoMap, GET reads the blocks of the latest version, PUT splits the body into blocks and
+	publishes it with UpdateFile, DELETE publishes a tombstone and MOVE republishes the hash list
+	under the new name before deleting the old one. Symlinks are not exposed and subdirectories
+	can't be created.
+
+	The ETag of a file is its quoted version. Writes are version-checked: a PUT, DELETE or MOVE
+	with an If-Match header fails with 412 Precondition Failed unless it names the current version,
+	and every write is published as the successor of the version the file had when it was opened,
+	so a concurrent change is never overwritten silently.
+*/
+
+// WebDAVFileSystem implements webdav.FileSystem on top of the MetaStore and BlockStores
+type WebDAVFileSystem struct {
+	client RPCClient
+}
+
+// Request context key of the version named by the If-Match header
+type webdavExpectedVersionKey struct{}
+
+// Request context key of the remote index shared by the file system calls of a request
+type webdavIndexKey struct{}
+
+// Remote index fetched on first use by a request, and again after the request wrote a file
+type webdavIndex struct {
+	mutex sync.Mutex
+	files map[string]*FileMetaData
+}
+
+// Version named by the If-Match header, for the file of the request path
+type webdavExpectedVersion struct {
+	fileName string
+	version  int32
+}
+
+func NewWebDAVFileSystem(client RPCClient) *WebDAVFileSystem {
+	return &WebDAVFileSystem{client: client}
+}
+
+// NewWebDAVHandler returns an http.Handler serving the WebDAV frontend, with in-memory locks
+func NewWebDAVHandler(client RPCClient) http.Handler {
+	davHandler := &webdav.Handler{
+		FileSystem: NewWebDAVFileSystem(client),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Println("WebDAV", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	fs := davHandler.FileSystem.(*WebDAVFileSystem)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A PROPFIND of N files looks up every file, from a single GetFileInfoMap
+		r = r.WithContext(context.WithValue(r.Context(), webdavIndexKey{}, &webdavIndex{}))
+		switch r.Method {
+		case http.MethodPut, http.MethodDelete, "MOVE":
+			ifMatch := strings.Trim(strings.TrimSpace(r.Header.Get("If-Match")), "\"")
+			if len(ifMatch) == 0 || ifMatch == "*" {
+				break
+			}
+			expected, err := strconv.Atoi(ifMatch)
+			if err != nil {
+				http.Error(w, "invalid If-Match header", http.StatusBadRequest)
+				return
+			}
+			// Fail early with the proper status, the file system checks again when writing
+			fileName := webdavFileName(r.URL.Path)
+			current, err := fs.remoteFile(r.Context(), fileName)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			if checkExpectedVersion(int32(expected), current) != nil {
+				http.Error(w, ErrVersionConflict.Error(), http.StatusPreconditionFailed)
+				return
+			}
+			expectedVersion := webdavExpectedVersion{fileName: fileName, version: int32(expected)}
+			r = r.WithContext(context.WithValue(r.Context(), webdavExpectedVersionKey{}, expectedVersion))
+		}
+		davHandler.ServeHTTP(w, r)
+	})
+}
+
+// Fails unless current is the expected version of the file, version 0 standing for a file
+// which doesn't exist (or is deleted)
+func checkExpectedVersion(expected int32, current *FileMetaData) error {
+	if current == nil || isFileDeleted(current) {
+		if expected == 0 {
+			return nil
+		}
+		return ErrVersionConflict
+	}
+	if current.Version != expected {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// Applies the If-Match version of the request, if any, to the file about to be written.
+// It only covers the file of the request path, not the destination of a MOVE.
+func checkRequestVersion(ctx context.Context, fileName string, current *FileMetaData) error {
+	expected, ok := ctx.Value(webdavExpectedVersionKey{}).(webdavExpectedVersion)
+	if !ok || expected.fileName != fileName {
+		return nil
+	}
+	return checkExpectedVersion(expected.version, current)
+}
+
+// Maps a WebDAV path to a file name, "" being the root collection
+func webdavFileName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Returns the remote index, from the request's copy if it has one
+func (fs *WebDAVFileSystem) remoteIndex(ctx context.Context) (map[string]*FileMetaData, error) {
+	index, cached := ctx.Value(webdavIndexKey{}).(*webdavIndex)
+	if cached {
+		index.mutex.Lock()
+		defer index.mutex.Unlock()
+		if index.files != nil {
+			return index.files, nil
+		}
+	}
+	var files map[string]*FileMetaData
+	if err := fs.client.GetFileInfoMapContext(ctx, &files); err != nil {
+		return nil, err
+	}
+	if files == nil {
+		files = make(map[string]*FileMetaData)
+	}
+	if cached {
+		index.files = files
+	}
+	return files, nil
+}
+
+// Drops the request's copy of the remote index once the request changed it
+func (fs *WebDAVFileSystem) invalidate(ctx context.Context) {
+	if index, cached := ctx.Value(webdavIndexKey{}).(*webdavIndex); cached {
+		index.mutex.Lock()
+		index.files = nil
+		index.mutex.Unlock()
+	}
+}
+
+// Returns the metadata of a file on the server, deleted ones included, nil if it never existed
+func (fs *WebDAVFileSystem) remoteFile(ctx context.Context, fileName string) (*FileMetaData, error) {
+	files, err := fs.remoteIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return files[fileName], nil
+}
+
+// Returns the metadata of a file exposed over WebDAV, nil if there is no such file
+func (fs *WebDAVFileSystem) lookup(ctx context.Context, fileName string) (*FileMetaData, error) {
+	fileMetaData, err := fs.remoteFile(ctx, fileName)
+	if err != nil || fileMetaData == nil {
+		return nil, err
+	}
+	if isFileDeleted(fileMetaData) || fileMetaData.FileType == FileType_SYMLINK {
+		return nil, nil
+	}
+	return fileMetaData, nil
+}
+
+func (fs *WebDAVFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if len(webdavFileName(name)) == 0 {
+		return os.ErrExist
+	}
+	// The namespace is flat
+	return os.ErrPermission
+}
+
+func (fs *WebDAVFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	fileName := webdavFileName(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if len(fileName) == 0 {
+		if writable {
+			return nil, os.ErrPermission
+		}
+		return &webdavFile{fs: fs, ctx: ctx, isDir: true}, nil
+	}
+	if ValidateFileName(fileName) != nil {
+		if flag&os.O_CREATE != 0 {
+			return nil, os.ErrPermission
+		}
+		return nil, os.ErrNotExist
+	}
+	current, err := fs.lookup(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if current != nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, os.ErrExist
+	}
+	if writable {
+		if err := checkRequestVersion(ctx, fileName, current); err != nil {
+			return nil, err
+		}
+	}
+	file := &webdavFile{fs: fs, ctx: ctx, name: fileName, meta: current, writable: writable}
+	if current != nil && !(writable && flag&os.O_TRUNC != 0) {
+		// The content is fetched on first use, PROPFIND and GET of a HEAD request never need it
+		file.needsContent = true
+	}
+	return file, nil
+}
+
+func (fs *WebDAVFileSystem) RemoveAll(ctx context.Context, name string) error {
+	fileName := webdavFileName(name)
+	if len(fileName) == 0 {
+		return os.ErrPermission
+	}
+	if ValidateFileName(fileName) != nil {
+		return nil
+	}
+	current, err := fs.lookup(ctx, fileName)
+	if err != nil || current == nil {
+		return err
+	}
+	if err := checkRequestVersion(ctx, fileName, current); err != nil {
+		return err
+	}
+	defer fs.invalidate(ctx)
+	_, err = DeleteRemoteFile(fs.client, fileName, NextRemoteVersion(current))
+	return err
+}
+
+// Renames a file without copying its blocks: the hash list is published under the new name
+// and the old name is deleted
+func (fs *WebDAVFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldFileName := webdavFileName(oldName)
+	newFileName := webdavFileName(newName)
+	if len(oldFileName) == 0 || ValidateFileName(newFileName) != nil {
+		return os.ErrPermission
+	}
+	if ValidateFileName(oldFileName) != nil {
+		return os.ErrNotExist
+	}
+	source, err := fs.lookup(ctx, oldFileName)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		return os.ErrNotExist
+	}
+	if err := checkRequestVersion(ctx, oldFileName, source); err != nil {
+		return err
+	}
+	destination, err := fs.remoteFile(ctx, newFileName)
+	if err != nil {
+		return err
+	}
+	if destination != nil && !isFileDeleted(destination) {
+		return os.ErrExist
+	}
+	moved := &FileMetaData{
+		Filename:      newFileName,
+		Version:       NextRemoteVersion(destination),
+		BlockHashList: source.BlockHashList,
+		Mode:          source.Mode,
+		Mtime:         source.Mtime,
+		FileType:      source.FileType,
+		Size:          source.Size,
+	}
+	defer fs.invalidate(ctx)
+	var returnedVersion int32
+	if err := fs.client.UpdateFileContext(ctx, moved, &returnedVersion); err != nil {
+		return err
+	}
+	if returnedVersion != moved.Version {
+		return ErrVersionConflict
+	}
+	_, err = DeleteRemoteFile(fs.client, oldFileName, NextRemoteVersion(source))
+	return err
+}
+
+func (fs *WebDAVFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fileName := webdavFileName(name)
+	if len(fileName) == 0 {
+		return &webdavFileInfo{isDir: true}, nil
+	}
+	if ValidateFileName(fileName) != nil {
+		return nil, os.ErrNotExist
+	}
+	current, err := fs.lookup(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, os.ErrNotExist
+	}
+	return &webdavFileInfo{name: fileName, meta: current}, nil
+}
+
+// A file opened over WebDAV. The content is staged in a local temporary file: read from the
+// BlockStores on first use and, for writable files, published as a new version on Close.
+type webdavFile struct {
+	fs *WebDAVFileSystem
+	// Context of the request which opened the file
+	ctx   context.Context
+	name  string
+	isDir bool
+	// Version the file had when it was opened, nil for a new file. Replaced by the published
+	// version on Close.
+	meta     *FileMetaData
+	writable bool
+	// Whether the content of meta still has to be fetched into temp
+	needsContent bool
+	temp         *os.File
+	written      bool
+	// Directory listing and the position of Readdir in it
+	entries   []os.FileInfo
+	dirOffset int
+}
+
+// Creates the temporary file and fills it with the current content if necessary
+func (f *webdavFile) content() (*os.File, error) {
+	if f.isDir {
+		return nil, os.ErrInvalid
+	}
+	if f.temp == nil {
+		temp, err := ioutil.TempFile("", "surfstore-webdav-")
+		if err != nil {
+			return nil, err
+		}
+		f.temp = temp
+	}
+	if f.needsContent {
+		if _, err := ReadRemoteFile(f.fs.client, f.meta, f.temp); err != nil {
+			return nil, err
+		}
+		if _, err := f.temp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		f.needsContent = false
+	}
+	return f.temp, nil
+}
+
+func (f *webdavFile) Read(p []byte) (int, error) {
+	temp, err := f.content()
+	if err != nil {
+		return 0, err
+	}
+	return temp.Read(p)
+}
+
+func (f *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	if f.isDir {
+		return 0, nil
+	}
+	temp, err := f.content()
+	if err != nil {
+		return 0, err
+	}
+	return temp.Seek(offset, whence)
+}
+
+func (f *webdavFile) Write(p []byte) (int, error) {
+	if !f.writable {
+		return 0, os.ErrPermission
+	}
+	temp, err := f.content()
+	if err != nil {
+		return 0, err
+	}
+	f.written = true
+	return temp.Write(p)
+}
+
+func (f *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.isDir {
+		return nil, os.ErrInvalid
+	}
+	if f.entries == nil {
+		files, err := f.fs.remoteIndex(f.ctx)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = make([]os.FileInfo, 0, len(files))
+		for fileName, fileMetaData := range files {
+			if isFileDeleted(fileMetaData) || fileMetaData.FileType == FileType_SYMLINK || ValidateFileName(fileName) != nil {
+				continue
+			}
+			f.entries = append(f.entries, &webdavFileInfo{name: fileName, meta: fileMetaData})
+		}
+		sort.Slice(f.entries, func(i, j int) bool { return f.entries[i].Name() < f.entries[j].Name() })
+	}
+	remaining := f.entries[f.dirOffset:]
+	if count <= 0 {
+		f.dirOffset = len(f.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	f.dirOffset += count
+	return remaining[:count], nil
+}
+
+func (f *webdavFile) Stat() (os.FileInfo, error) {
+	if f.isDir {
+		return &webdavFileInfo{isDir: true}, nil
+	}
+	info := &webdavFileInfo{name: f.name, meta: f.meta, file: f}
+	if f.temp != nil && !f.needsContent {
+		tempStats, err := f.temp.Stat()
+		if err != nil {
+			return nil, err
+		}
+		info.size = tempStats.Size()
+		info.sizeKnown = true
+	}
+	return info, nil
+}
+
+// Publishes the content of a written (or newly created) file as the successor of the version
+// it was opened with
+func (f *webdavFile) Close() error {
+	if f.isDir {
+		return nil
+	}
+	defer func() {
+		if f.temp != nil {
+			f.temp.Close()
+			os.Remove(f.temp.Name())
+			f.temp = nil
+		}
+	}()
+	if !f.writable || (!f.written && f.meta != nil && f.needsContent) {
+		return nil
+	}
+	temp, err := f.content()
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fileMetaData := &FileMetaData{
+		Filename: f.name,
+		Version:  NextRemoteVersion(f.meta),
+		Mtime:    time.Now().UnixNano(),
+		FileType: FileType_REGULAR,
+	}
+	if f.meta != nil {
+		fileMetaData.Mode = f.meta.Mode
+	}
+	defer f.fs.invalidate(f.ctx)
+	if _, err := WriteRemoteFile(f.fs.client, fileMetaData, temp); err != nil {
+		return err
+	}
+	f.meta = fileMetaData
+	return nil
+}
+
+// webdavFileInfo describes the root collection or a file, it also provides the ETag and the
+// content type without reading the content
+type webdavFileInfo struct {
+	name  string
+	isDir bool
+	meta  *FileMetaData
+	// Open file the info was taken from, its version changes once it is published
+	file      *webdavFile
+	size      int64
+	sizeKnown bool
+}
+
+func (info *webdavFileInfo) Name() string {
+	if info.isDir {
+		return "/"
+	}
+	return info.name
+}
+
+func (info *webdavFileInfo) Size() int64 {
+	if info.sizeKnown || info.meta == nil {
+		return info.size
+	}
+	return info.meta.Size
+}
+
+func (info *webdavFileInfo) Mode() os.FileMode {
+	if info.isDir {
+		return os.ModeDir | 0755
+	}
+	if info.meta != nil && info.meta.Mode != 0 {
+		return os.FileMode(info.meta.Mode).Perm()
+	}
+	return 0644
+}
+
+func (info *webdavFileInfo) ModTime() time.Time {
+	if info.meta != nil && info.meta.Mtime != 0 {
+		return time.Unix(0, info.meta.Mtime)
+	}
+	return time.Now()
+}
+
+func (info *webdavFileInfo) IsDir() bool {
+	return info.isDir
+}
+
+func (info *webdavFileInfo) Sys() interface{} {
+	return nil
+}
+
+func (info *webdavFileInfo) ETag(ctx context.Context) (string, error) {
+	meta := info.meta
+	if info.file != nil {
+		meta = info.file.meta
+	}
+	if meta == nil {
+		return "", webdav.ErrNotImplemented
+	}
+	return strconv.Quote(strconv.Itoa(int(meta.Version))), nil
+}
+
+func (info *webdavFileInfo) ContentType(ctx context.Context) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(info.name)); len(contentType) > 0 {
+		return contentType, nil
+	}
+	return "application/octet-stream", nil
+}
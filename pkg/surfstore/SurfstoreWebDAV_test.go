@@ -0,0 +1,149 @@
+package surfstore_test
+
+import (
+	"bytes"
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"cse224/proj4/pkg/surfstoretest"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// A minimal WebDAV client
+type webdavClient struct {
+	t       *testing.T
+	baseURL string
+}
+
+type webdavResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (c *webdavClient) do(method string, path string, body []byte, header map[string]string) webdavResponse {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return webdavResponse{status: resp.StatusCode, header: resp.Header, body: respBody}
+}
+
+func (c *webdavClient) expect(expected int, method string, path string, body []byte, header map[string]string) webdavResponse {
+	c.t.Helper()
+	resp := c.do(method, path, body, header)
+	if resp.status != expected {
+		c.t.Fatalf("%s %s returned %d, expected %d: %s", method, path, resp.status, expected, resp.body)
+	}
+	return resp
+}
+
+// Lists the hrefs and ETags of a Depth: 1 PROPFIND of the root collection
+func (c *webdavClient) list() map[string]string {
+	c.t.Helper()
+	resp := c.expect(http.StatusMultiStatus, "PROPFIND", "/", nil, map[string]string{"Depth": "1"})
+	var multistatus struct {
+		Responses []struct {
+			Href string `xml:"href"`
+			ETag string `xml:"propstat>prop>getetag"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(resp.body, &multistatus); err != nil {
+		c.t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	for _, response := range multistatus.Responses {
+		entries[response.Href] = response.ETag
+	}
+	return entries
+}
+
+func TestWebDAV(t *testing.T) {
+	var fileInfoMapCalls int32
+	countCalls := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/surfstore.MetaStore/GetFileInfoMap" {
+			atomic.AddInt32(&fileInfoMapCalls, 1)
+		}
+		return handler(ctx, req)
+	}
+	cluster := surfstoretest.NewCluster(1, grpc.ChainUnaryInterceptor(countCalls))
+	defer cluster.Close()
+	server := httptest.NewServer(surfstore.NewWebDAVHandler(newTestClient(t, cluster)))
+	defer server.Close()
+	dav := &webdavClient{t: t, baseURL: server.URL}
+
+	content := testContent(1, 3*TEST_BLOCK_SIZE)
+	dav.expect(http.StatusCreated, http.MethodPut, "/a.txt", content, nil)
+	resp := dav.expect(http.StatusOK, http.MethodGet, "/a.txt", nil, nil)
+	if !bytes.Equal(resp.body, content) || resp.header.Get("ETag") != `"1"` {
+		t.Fatalf("GET returned %d bytes, ETag %s", len(resp.body), resp.header.Get("ETag"))
+	}
+
+	// Writes naming a stale version fail, and leave the file alone
+	dav.expect(http.StatusPreconditionFailed, http.MethodPut, "/a.txt", []byte("stale"), map[string]string{"If-Match": `"0"`})
+	dav.expect(http.StatusPreconditionFailed, http.MethodDelete, "/a.txt", nil, map[string]string{"If-Match": `"2"`})
+	updated := testContent(2, TEST_BLOCK_SIZE)
+	dav.expect(http.StatusCreated, http.MethodPut, "/a.txt", updated, map[string]string{"If-Match": `"1"`})
+	checkRemoteVersion(t, cluster, "a.txt", 2, false)
+
+	// A PROPFIND fetches the remote index once, however many files it lists
+	for _, fileName := range []string{"b.txt", "c.txt", "d.txt"} {
+		dav.expect(http.StatusCreated, http.MethodPut, "/"+fileName, []byte(fileName), nil)
+	}
+	atomic.StoreInt32(&fileInfoMapCalls, 0)
+	entries := dav.list()
+	if calls := atomic.LoadInt32(&fileInfoMapCalls); calls != 1 {
+		t.Errorf("PROPFIND of %d entries made %d GetFileInfoMap calls", len(entries), calls)
+	}
+	hrefs := make([]string, 0, len(entries))
+	for href := range entries {
+		hrefs = append(hrefs, href)
+	}
+	sort.Strings(hrefs)
+	if strings.Join(hrefs, " ") != "/ /a.txt /b.txt /c.txt /d.txt" || entries["/a.txt"] != `"2"` {
+		t.Fatalf("PROPFIND listed %v", entries)
+	}
+
+	// MOVE publishes the hash list under the new name and deletes the old one
+	dav.expect(http.StatusCreated, "MOVE", "/a.txt", nil, map[string]string{"Destination": server.URL + "/e.txt"})
+	dav.expect(http.StatusNotFound, http.MethodGet, "/a.txt", nil, nil)
+	if resp := dav.expect(http.StatusOK, http.MethodGet, "/e.txt", nil, nil); !bytes.Equal(resp.body, updated) {
+		t.Fatalf("moved file has %d bytes", len(resp.body))
+	}
+	checkRemoteVersion(t, cluster, "a.txt", 3, true)
+
+	dav.expect(http.StatusNoContent, http.MethodDelete, "/e.txt", nil, map[string]string{"If-Match": `"1"`})
+	dav.expect(http.StatusNotFound, http.MethodGet, "/e.txt", nil, nil)
+	if _, exists := dav.list()["/e.txt"]; exists {
+		t.Fatal("deleted file listed")
+	}
+
+	// Names which would escape the base directory of the syncing clients are refused
+	if resp := dav.do(http.MethodPut, "/a%5C..%5Cevil", []byte("evil"), nil); resp.status < 400 {
+		t.Fatalf("PUT of an invalid name returned %d", resp.status)
+	}
+	if _, exists := cluster.MetaStore().FileMetaMap[`a\..\evil`]; exists {
+		t.Fatal("invalid name published")
+	}
+}
@@ -0,0 +1,152 @@
+// Package surfstoretest runs a Surfstore cluster in-process for tests. The MetaStore and the
+// BlockStores serve gRPC over in-memory bufconn listeners instead of TCP ports, and the clients
+// created by the cluster dial them by name.
+package surfstoretest
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"fmt"
+	"net"
+	"sync"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Buffer size of each in-memory connection
+const BUFCONN_SIZE int = 1 << 20
+
+// Address of the MetaStore, the BlockStores are named "blockstore0", "blockstore1", ...
+const META_ADDR string = "metastore"
+
+type Cluster struct {
+	MetaAddr        string
+	BlockStoreAddrs []string
+
+	metaStore   *surfstore.MetaStore
+	blockStores map[string]*surfstore.BlockStore
+
+	mutex   sync.Mutex
+	servers map[string]*server
+}
+
+// A gRPC server which can be stopped and started again with the same service
+type server struct {
+	register   func(*grpc.Server)
+	opts       []grpc.ServerOption
+	listener   *bufconn.Listener
+	grpcServer *grpc.Server
+	// Name of the service in health checks, and the health service of the running server
+	service string
+	health  *surfstore.HealthServer
+}
+
+// NewCluster starts a MetaStore and numBlockStores BlockStores, whose gRPC servers get opts,
+// e.g. interceptors
+func NewCluster(numBlockStores int, opts ...grpc.ServerOption) *Cluster {
+	c := &Cluster{
+		MetaAddr:    META_ADDR,
+		blockStores: make(map[string]*surfstore.BlockStore),
+		servers:     make(map[string]*server),
+	}
+	for i := 0; i < numBlockStores; i++ {
+		addr := fmt.Sprintf("blockstore%d", i)
+		blockStore := surfstore.NewBlockStore()
+		c.BlockStoreAddrs = append(c.BlockStoreAddrs, addr)
+		c.blockStores[addr] = blockStore
+		c.servers[addr] = &server{opts: opts, service: surfstore.HEALTH_SERVICE_BLOCK, register: func(grpcServer *grpc.Server) {
+			surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		}}
+	}
+	c.metaStore = surfstore.NewMetaStore(c.BlockStoreAddrs)
+	c.servers[META_ADDR] = &server{opts: opts, service: surfstore.HEALTH_SERVICE_META, register: func(grpcServer *grpc.Server) {
+		surfstore.RegisterMetaStoreServer(grpcServer, c.metaStore)
+	}}
+	for _, s := range c.servers {
+		s.start()
+	}
+	return c
+}
+
+func (s *server) start() {
+	s.listener = bufconn.Listen(BUFCONN_SIZE)
+	s.grpcServer = grpc.NewServer(s.opts...)
+	s.register(s.grpcServer)
+	s.health = surfstore.NewHealthServer(s.service)
+	s.health.Register(s.grpcServer)
+	s.health.SetServing()
+	go s.grpcServer.Serve(s.listener)
+}
+
+// NewClient returns a client of the cluster syncing baseDir
+func (c *Cluster) NewClient(baseDir string, blockSize int) surfstore.RPCClient {
+	client := surfstore.NewSurfstoreRPCClient(c.MetaAddr, baseDir, blockSize)
+	client.DialOptions = []grpc.DialOption{grpc.WithContextDialer(c.dial)}
+	return client
+}
+
+// Connects to the server named addr, failing like a refused connection if it is stopped
+func (c *Cluster) dial(ctx context.Context, addr string) (net.Conn, error) {
+	c.mutex.Lock()
+	s, exists := c.servers[addr]
+	var listener *bufconn.Listener
+	if exists && s.grpcServer != nil {
+		listener = s.listener
+	}
+	c.mutex.Unlock()
+	if listener == nil {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	return listener.DialContext(ctx)
+}
+
+// MetaStore returns the service of the MetaStore, to inspect the files on the server
+func (c *Cluster) MetaStore() *surfstore.MetaStore {
+	return c.metaStore
+}
+
+// BlockStore returns the service of a BlockStore, to inspect the blocks it holds
+func (c *Cluster) BlockStore(addr string) *surfstore.BlockStore {
+	return c.blockStores[addr]
+}
+
+// Health returns the health service of the server named addr, to report it NOT_SERVING
+func (c *Cluster) Health(addr string) *surfstore.HealthServer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s, exists := c.servers[addr]; exists {
+		return s.health
+	}
+	return nil
+}
+
+// Kill stops the server named addr, closing its connections. Its state is kept for Restart.
+func (c *Cluster) Kill(addr string) {
+	c.mutex.Lock()
+	s, exists := c.servers[addr]
+	if !exists || s.grpcServer == nil {
+		c.mutex.Unlock()
+		return
+	}
+	grpcServer := s.grpcServer
+	s.grpcServer = nil
+	c.mutex.Unlock()
+	grpcServer.Stop()
+}
+
+// Restart starts the server named addr again after Kill, with the files or blocks it held
+func (c *Cluster) Restart(addr string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s, exists := c.servers[addr]; exists && s.grpcServer == nil {
+		s.start()
+	}
+}
+
+// Close stops every server of the cluster
+func (c *Cluster) Close() {
+	for addr := range c.servers {
+		c.Kill(addr)
+	}
+}
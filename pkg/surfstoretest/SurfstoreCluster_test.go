@@ -0,0 +1,60 @@
+package surfstoretest
+
+import (
+	"cse224/proj4/pkg/surfstore"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestKillAndRestartBlockStore(t *testing.T) {
+	cluster := NewCluster(1)
+	defer cluster.Close()
+	client := cluster.NewClient(t.TempDir(), 1024)
+	defer client.Close()
+	client.RetryPolicy.MaxAttempts = 1
+
+	if err := ioutil.WriteFile(filepath.Join(client.BaseDir, "a.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cluster.Kill(cluster.BlockStoreAddrs[0])
+	if summary := surfstore.ClientSync(client); !summary.Failed() || len(summary.Uploaded) != 0 {
+		t.Fatalf("sync without BlockStore uploaded %v, errors %v", summary.Uploaded, summary.Errors)
+	}
+
+	cluster.Restart(cluster.BlockStoreAddrs[0])
+	if summary := surfstore.ClientSync(client); summary.Failed() || len(summary.Uploaded) != 1 {
+		t.Fatalf("sync after restart uploaded %v, errors %v", summary.Uploaded, summary.Errors)
+	}
+}
+
+func TestRetryWhileMetaStoreRestarts(t *testing.T) {
+	cluster := NewCluster(2)
+	defer cluster.Close()
+	client := cluster.NewClient(t.TempDir(), 1024)
+	defer client.Close()
+	if summary := surfstore.ClientSync(client); summary.Failed() {
+		t.Fatal(summary.Errors)
+	}
+
+	cluster.Kill(cluster.MetaAddr)
+	restarted := make(chan bool)
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		cluster.Restart(cluster.MetaAddr)
+		close(restarted)
+	}()
+	// The default retry policy outlasts the outage
+	if summary := surfstore.ClientSync(client); summary.Failed() {
+		t.Fatal(summary.Errors)
+	}
+	<-restarted
+}